@@ -0,0 +1,44 @@
+package api
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"github.com/orange-cloudfoundry/promfetcher/config"
+)
+
+// RegisterAdmin adds admin endpoints protected by basic auth, nothing is registered when admin user is not set
+func RegisterAdmin(rtr *mux.Router, c config.AdminConfig, reload func() error) {
+	if c.User == "" {
+		return
+	}
+	routerAdmin := rtr.PathPrefix("/admin").Subrouter()
+	routerAdmin.Use(basicAuth(c.User, c.Pass))
+	routerAdmin.HandleFunc("/reload", func(w http.ResponseWriter, req *http.Request) {
+		if err := reload(); err != nil {
+			http.Error(w, fmt.Sprintf("failed to reload config: %s", err.Error()), http.StatusUnprocessableEntity)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("config reloaded\n"))
+	}).Methods(http.MethodPost)
+}
+
+func basicAuth(user, pass string) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			reqUser, reqPass, ok := req.BasicAuth()
+			if !ok ||
+				subtle.ConstantTimeCompare([]byte(reqUser), []byte(user)) != 1 ||
+				subtle.ConstantTimeCompare([]byte(reqPass), []byte(pass)) != 1 {
+				w.Header().Set("WWW-Authenticate", `Basic realm="promfetcher admin"`)
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, req)
+		})
+	}
+}
@@ -0,0 +1,69 @@
+package api_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/gorilla/mux"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/orange-cloudfoundry/promfetcher/api"
+	"github.com/orange-cloudfoundry/promfetcher/config"
+)
+
+var _ = Describe("Api/Admin", func() {
+	var router *mux.Router
+	var reloadErr error
+	var nbReloads int
+
+	BeforeEach(func() {
+		reloadErr = nil
+		nbReloads = 0
+		router = mux.NewRouter()
+		api.RegisterAdmin(router, config.AdminConfig{User: "admin", Pass: "secret"}, func() error {
+			nbReloads++
+			return reloadErr
+		})
+	})
+
+	reload := func(user, pass string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/admin/reload", nil)
+		if user != "" {
+			req.SetBasicAuth(user, pass)
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	It("reloads config", func() {
+		rec := reload("admin", "secret")
+		Expect(rec.Code).To(Equal(http.StatusOK))
+		Expect(nbReloads).To(Equal(1))
+	})
+
+	It("answers reload error", func() {
+		reloadErr = errors.New("invalid config")
+		rec := reload("admin", "secret")
+		Expect(rec.Code).To(Equal(http.StatusUnprocessableEntity))
+		Expect(rec.Body.String()).To(ContainSubstring("invalid config"))
+	})
+
+	It("refuses unauthenticated requests", func() {
+		Expect(reload("", "").Code).To(Equal(http.StatusUnauthorized))
+		Expect(reload("admin", "wrong").Code).To(Equal(http.StatusUnauthorized))
+		Expect(nbReloads).To(Equal(0))
+	})
+
+	It("is not registered without admin user", func() {
+		router = mux.NewRouter()
+		api.RegisterAdmin(router, config.AdminConfig{}, func() error {
+			nbReloads++
+			return nil
+		})
+		Expect(reload("", "").Code).To(Equal(http.StatusNotFound))
+		Expect(nbReloads).To(Equal(0))
+	})
+})
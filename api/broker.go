@@ -3,30 +3,67 @@ package api
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
 	"os"
 
 	"code.cloudfoundry.org/lager"
-	"github.com/jinzhu/gorm"
+	"github.com/orange-cloudfoundry/promfetcher/caches"
 	"github.com/orange-cloudfoundry/promfetcher/config"
+	"github.com/orange-cloudfoundry/promfetcher/fetchers"
 	"github.com/orange-cloudfoundry/promfetcher/models"
+	"github.com/orange-cloudfoundry/promfetcher/stores"
 	"github.com/pivotal-cf/brokerapi/v7"
 	"github.com/pivotal-cf/brokerapi/v7/domain"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
 )
 
+const defaultEndpoint = "/metrics"
+
 type BrokerParams struct {
 	Endpoint string `json:"endpoint"`
 }
 
+// BindingCredentials are given to app on bind, they contain everything needed to scrape
+// the app through promfetcher.
+type BindingCredentials struct {
+	URL          string `json:"url"`
+	URLByName    string `json:"url_by_name,omitempty"`
+	OnlyAppURL   string `json:"only_app_url"`
+	Endpoint     string `json:"endpoint"`
+	ScrapeConfig string `json:"scrape_config"`
+}
+
+type scrapeConfig struct {
+	JobName       string         `yaml:"job_name"`
+	Scheme        string         `yaml:"scheme"`
+	MetricsPath   string         `yaml:"metrics_path"`
+	StaticConfigs []staticConfig `yaml:"static_configs"`
+}
+
+type staticConfig struct {
+	Targets []string `yaml:"targets"`
+}
+
 type Broker struct {
-	brokerConfig config.BrokerConfig
-	baseURL      string
-	db           *gorm.DB
+	brokerConfig  config.BrokerConfig
+	baseURL       string
+	store         stores.EndpointStore
+	routesFetcher fetchers.RoutesFetch
+	endpointCache *caches.EndpointCache
 }
 
-func NewBroker(brokerConfig config.BrokerConfig, baseURL string, db *gorm.DB) *Broker {
-	return &Broker{brokerConfig: brokerConfig, baseURL: baseURL, db: db}
+func NewBroker(brokerConfig config.BrokerConfig, baseURL string, store stores.EndpointStore, routesFetcher fetchers.RoutesFetch, endpointCache *caches.EndpointCache) *Broker {
+	return &Broker{
+		brokerConfig:  brokerConfig,
+		baseURL:       baseURL,
+		store:         store,
+		routesFetcher: routesFetcher,
+		endpointCache: endpointCache,
+	}
 }
 
 func (b *Broker) Handler() http.Handler {
@@ -46,10 +83,10 @@ func (b Broker) Services(ctx context.Context) ([]domain.Service, error) {
 			Name:                 "promfetcher",
 			Description:          "Fetch your prometheus metrics on each instance of your app",
 			Bindable:             true,
-			InstancesRetrievable: false,
+			InstancesRetrievable: true,
 			BindingsRetrievable:  true,
 			Tags:                 nil,
-			PlanUpdatable:        false,
+			PlanUpdatable:        true,
 			Plans: []domain.ServicePlan{
 				{
 					ID:          b.brokerConfig.BrokerPlanID,
@@ -61,6 +98,16 @@ func (b Broker) Services(ctx context.Context) ([]domain.Service, error) {
 						DisplayName: "fetch-app",
 					},
 				},
+				{
+					ID:          b.brokerConfig.BrokerSystemPlanID,
+					Name:        "system-metrics",
+					Description: "Expose system metrics built by promfetcher on each instance of your app, for apps without prometheus metrics",
+					Free:        &t,
+					Bindable:    &t,
+					Metadata: &domain.ServicePlanMetadata{
+						DisplayName: "system-metrics",
+					},
+				},
 			},
 			Requires: []domain.RequiredPermission{},
 			Metadata: &domain.ServiceMetadata{
@@ -77,84 +124,306 @@ func (b Broker) Services(ctx context.Context) ([]domain.Service, error) {
 }
 
 func (b Broker) Provision(ctx context.Context, instanceID string, details domain.ProvisionDetails, asyncAllowed bool) (domain.ProvisionedServiceSpec, error) {
+	params, err := parseParams(details.RawParameters)
+	if err != nil {
+		return domain.ProvisionedServiceSpec{}, err
+	}
+	rawParams, err := json.Marshal(params)
+	if err != nil {
+		return domain.ProvisionedServiceSpec{}, err
+	}
+
+	instance, err := b.store.ServiceInstance(instanceID)
+	if err != nil && !errors.Is(err, stores.ErrNotFound) {
+		return domain.ProvisionedServiceSpec{}, storeUnavailable(err, "error when getting service instance in store")
+	}
+	if err == nil {
+		if instance.PlanID == details.PlanID && instance.Parameters == string(rawParams) {
+			return domain.ProvisionedServiceSpec{AlreadyExists: true}, nil
+		}
+		return domain.ProvisionedServiceSpec{}, brokerapi.ErrInstanceAlreadyExists
+	}
+
+	err = b.store.SaveServiceInstance(models.ServiceInstance{
+		GUID:       instanceID,
+		ServiceID:  details.ServiceID,
+		PlanID:     details.PlanID,
+		Parameters: string(rawParams),
+	})
+	if err != nil {
+		return domain.ProvisionedServiceSpec{}, storeUnavailable(err, "error when creating service instance in store")
+	}
 	return domain.ProvisionedServiceSpec{}, nil
 }
 
 func (b Broker) Deprovision(ctx context.Context, instanceID string, details domain.DeprovisionDetails, asyncAllowed bool) (domain.DeprovisionServiceSpec, error) {
+	err := b.store.DeleteInstanceAppEndpoints(instanceID)
+	if err != nil {
+		return domain.DeprovisionServiceSpec{}, storeUnavailable(err, "error when deleting bindings in store")
+	}
+	b.invalidateCache()
+	err = b.store.DeleteServiceInstance(instanceID)
+	if errors.Is(err, stores.ErrNotFound) {
+		return domain.DeprovisionServiceSpec{}, brokerapi.ErrInstanceDoesNotExist
+	}
+	if err != nil {
+		return domain.DeprovisionServiceSpec{}, storeUnavailable(err, "error when deleting service instance in store")
+	}
 	return domain.DeprovisionServiceSpec{}, nil
 }
 
 func (b Broker) GetInstance(ctx context.Context, instanceID string) (domain.GetInstanceDetailsSpec, error) {
-	return domain.GetInstanceDetailsSpec{}, nil
+	instance, params, err := b.instance(instanceID)
+	if err != nil {
+		return domain.GetInstanceDetailsSpec{}, err
+	}
+	if instance.GUID == "" {
+		return domain.GetInstanceDetailsSpec{}, brokerapi.ErrInstanceDoesNotExist
+	}
+	return domain.GetInstanceDetailsSpec{
+		ServiceID:  instance.ServiceID,
+		PlanID:     instance.PlanID,
+		Parameters: params,
+	}, nil
 }
 
 func (b Broker) Update(ctx context.Context, instanceID string, details domain.UpdateDetails, asyncAllowed bool) (domain.UpdateServiceSpec, error) {
+	instance, params, err := b.instance(instanceID)
+	if err != nil {
+		return domain.UpdateServiceSpec{}, err
+	}
+	if len(details.RawParameters) > 0 {
+		params, err = parseParams(details.RawParameters)
+		if err != nil {
+			return domain.UpdateServiceSpec{}, err
+		}
+	}
+	rawParams, err := json.Marshal(params)
+	if err != nil {
+		return domain.UpdateServiceSpec{}, err
+	}
+
+	// instances created before being stored are registered on their first update
+	instance.GUID = instanceID
+	instance.ServiceID = details.ServiceID
+	if details.PlanID != "" {
+		instance.PlanID = details.PlanID
+	}
+	instance.Parameters = string(rawParams)
+	err = b.store.SaveServiceInstance(instance)
+	if err != nil {
+		return domain.UpdateServiceSpec{}, storeUnavailable(err, "error when updating service instance in store")
+	}
+
+	err = b.store.UpdateInstanceAppEndpoints(instanceID, params.Endpoint, b.isSystemPlan(instance.PlanID))
+	if err != nil {
+		return domain.UpdateServiceSpec{}, storeUnavailable(err, "error when updating bindings in store")
+	}
+	b.invalidateCache()
 	return domain.UpdateServiceSpec{}, nil
 }
 
 func (b Broker) LastOperation(ctx context.Context, instanceID string, details domain.PollDetails) (domain.LastOperation, error) {
-	return domain.LastOperation{}, nil
+	return domain.LastOperation{State: domain.Succeeded}, nil
 }
 
 func (b Broker) Bind(ctx context.Context, instanceID, bindingID string, details domain.BindDetails, asyncAllowed bool) (domain.Binding, error) {
-	if b.db == nil {
-		return domain.Binding{}, fmt.Errorf("no db set broker unusable")
+	params, err := parseParams(details.RawParameters)
+	if err != nil {
+		return domain.Binding{}, err
 	}
-	var params BrokerParams
-	err := json.Unmarshal(details.RawParameters, &params)
-	if err != nil && len(details.RawParameters) > 0 {
-		return domain.Binding{}, fmt.Errorf("error when loading params: %s", err.Error())
+	_, instanceParams, err := b.instance(instanceID)
+	if err != nil {
+		return domain.Binding{}, err
 	}
 
-	if params.Endpoint != "" && params.Endpoint[0] != '/' {
-		return domain.Binding{}, fmt.Errorf("endpoint must be a path starting with /")
+	inherited := false
+	if params.Endpoint == "" {
+		params.Endpoint = instanceParams.Endpoint
+		inherited = true
 	}
 
-	b.db.Delete(models.AppEndpoint{}, "app_guid = ?", details.AppGUID)
-	if params.Endpoint == "" {
-		return domain.Binding{}, nil
+	// cloud controller retries binds, a binding already created with same app and endpoint is not an error
+	appEndpoint, err := b.store.AppEndpoint(bindingID)
+	if err != nil && !errors.Is(err, stores.ErrNotFound) {
+		return domain.Binding{}, storeUnavailable(err, "error when getting app in store")
+	}
+	if err == nil {
+		if appEndpoint.AppGUID != details.AppGUID || appEndpoint.Endpoint != params.Endpoint {
+			return domain.Binding{}, brokerapi.ErrBindingAlreadyExists
+		}
+		return domain.Binding{
+			AlreadyExists: true,
+			Credentials:   b.credentials(appEndpoint.AppGUID, appEndpoint.Endpoint),
+		}, nil
 	}
 
-	err = b.db.Create(&models.AppEndpoint{
-		GUID:     bindingID,
-		AppGUID:  details.AppGUID,
-		Endpoint: params.Endpoint,
-	}).Error
+	err = b.store.CreateAppEndpoint(models.AppEndpoint{
+		GUID:          bindingID,
+		AppGUID:       details.AppGUID,
+		InstanceGUID:  instanceID,
+		Endpoint:      params.Endpoint,
+		Inherited:     inherited,
+		SystemMetrics: b.isSystemPlan(details.PlanID),
+	})
 	if err != nil {
-		return domain.Binding{}, fmt.Errorf("error when getting creating app entry in db: %s", err.Error())
+		return domain.Binding{}, storeUnavailable(err, "error when creating app entry in store")
 	}
-	return domain.Binding{}, nil
+	b.invalidateCache(details.AppGUID)
+	return domain.Binding{
+		Credentials: b.credentials(details.AppGUID, params.Endpoint),
+	}, nil
 }
 
 func (b Broker) Unbind(ctx context.Context, instanceID, bindingID string, details domain.UnbindDetails, asyncAllowed bool) (domain.UnbindSpec, error) {
-	if b.db == nil {
+	appEndpoint, err := b.store.AppEndpoint(bindingID)
+	if errors.Is(err, stores.ErrNotFound) {
 		return domain.UnbindSpec{}, nil
 	}
-	b.db.Delete(models.AppEndpoint{}, "guid = ?", bindingID)
+	if err != nil {
+		return domain.UnbindSpec{}, storeUnavailable(err, "error when getting app in store")
+	}
+	err = b.store.DeleteAppEndpoint(bindingID)
+	if err != nil {
+		return domain.UnbindSpec{}, storeUnavailable(err, "error when deleting app in store")
+	}
+	b.invalidateCache(appEndpoint.AppGUID)
 	return domain.UnbindSpec{}, nil
 }
 
 func (b Broker) GetBinding(ctx context.Context, instanceID, bindingID string) (domain.GetBindingSpec, error) {
-	var appEndpoint models.AppEndpoint
-	if b.db == nil {
-		return domain.GetBindingSpec{}, fmt.Errorf("no db set broker unusable")
+	appEndpoint, err := b.store.AppEndpoint(bindingID)
+	if errors.Is(err, stores.ErrNotFound) {
+		return domain.GetBindingSpec{}, brokerapi.ErrBindingNotFound
 	}
-	err := b.db.First(&appEndpoint, "guid = ?", bindingID).Error
 	if err != nil {
-		return domain.GetBindingSpec{}, fmt.Errorf("error when getting app in db: %s", err.Error())
-	}
-	if appEndpoint.GUID == "" {
-		return domain.GetBindingSpec{
-			Credentials: map[string]string{},
-		}, nil
+		return domain.GetBindingSpec{}, storeUnavailable(err, "error when getting app in store")
 	}
 	return domain.GetBindingSpec{
-		Credentials: map[string]string{
-			"endpoint": appEndpoint.Endpoint,
-		},
+		Credentials: b.credentials(appEndpoint.AppGUID, appEndpoint.Endpoint),
 	}, nil
 }
 
 func (b Broker) LastBindingOperation(ctx context.Context, instanceID, bindingID string, details domain.PollDetails) (domain.LastOperation, error) {
-	return domain.LastOperation{}, nil
+	return domain.LastOperation{State: domain.Succeeded}, nil
+}
+
+// instance retrieves service instance and its parameters, an empty instance is given when not found
+func (b Broker) instance(instanceID string) (models.ServiceInstance, BrokerParams, error) {
+	var params BrokerParams
+	instance, err := b.store.ServiceInstance(instanceID)
+	if errors.Is(err, stores.ErrNotFound) {
+		return models.ServiceInstance{}, params, nil
+	}
+	if err != nil {
+		return instance, params, storeUnavailable(err, "error when getting service instance in store")
+	}
+	if instance.Parameters == "" {
+		return instance, params, nil
+	}
+	err = json.Unmarshal([]byte(instance.Parameters), &params)
+	if err != nil {
+		return instance, params, fmt.Errorf("error when loading service instance params: %s", err.Error())
+	}
+	return instance, params, nil
+}
+
+// invalidateCache refreshes endpoint cache for given apps or for all apps when none given,
+// a failure is only logged as cache is periodically refreshed
+func (b Broker) invalidateCache(appGUIDs ...string) {
+	if b.endpointCache == nil {
+		return
+	}
+	var err error
+	if len(appGUIDs) == 0 {
+		err = b.endpointCache.Load()
+	} else {
+		err = b.endpointCache.Invalidate(appGUIDs...)
+	}
+	if err != nil {
+		log.Warnf("failed to invalidate endpoint cache: %s", err.Error())
+	}
+}
+
+func (b Broker) isSystemPlan(planID string) bool {
+	return planID != "" && planID == b.brokerConfig.BrokerSystemPlanID
+}
+
+// storeUnavailable gives a 503 to cloud controller on store failure, e.g. when database is down,
+// cloud controller can then retry later
+func storeUnavailable(err error, msg string) error {
+	return brokerapi.NewFailureResponse(
+		fmt.Errorf("%s: %s", msg, err.Error()),
+		http.StatusServiceUnavailable,
+		"store-unavailable",
+	)
+}
+
+func parseParams(rawParams json.RawMessage) (BrokerParams, error) {
+	var params BrokerParams
+	if len(rawParams) == 0 {
+		return params, nil
+	}
+	err := json.Unmarshal(rawParams, &params)
+	if err != nil {
+		return params, fmt.Errorf("error when loading params: %s", err.Error())
+	}
+	if params.Endpoint != "" && params.Endpoint[0] != '/' {
+		return params, fmt.Errorf("endpoint must be a path starting with /")
+	}
+	return params, nil
+}
+
+// credentials build binding credentials for an app, url by name is only given
+// when app is currently known in routing table
+func (b Broker) credentials(appGUID, endpoint string) BindingCredentials {
+	if endpoint == "" {
+		endpoint = defaultEndpoint
+	}
+	creds := BindingCredentials{
+		URL:        fmt.Sprintf("%s/v2/apps/%s/metrics", b.baseURL, appGUID),
+		OnlyAppURL: fmt.Sprintf("%s/v2/apps/%s/only-app-metrics", b.baseURL, appGUID),
+		Endpoint:   endpoint,
+	}
+	if b.routesFetcher != nil {
+		routes := b.routesFetcher.Routes().FindById(appGUID)
+		if len(routes) > 0 {
+			tags := routes[0].Tags
+			creds.URLByName = fmt.Sprintf(
+				"%s/v2/apps/%s/%s/%s/metrics",
+				b.baseURL,
+				url.PathEscape(tags.OrganizationName),
+				url.PathEscape(tags.SpaceName),
+				url.PathEscape(tags.AppName),
+			)
+		}
+	}
+	creds.ScrapeConfig = b.scrapeConfig(appGUID)
+	return creds
+}
+
+// scrapeConfig gives a prometheus scrape config ready to be pasted in prometheus configuration
+func (b Broker) scrapeConfig(appGUID string) string {
+	u, err := url.Parse(b.baseURL)
+	if err != nil {
+		return ""
+	}
+	scheme := u.Scheme
+	if scheme == "" {
+		scheme = "http"
+	}
+	content, err := yaml.Marshal([]scrapeConfig{
+		{
+			JobName:     "promfetcher-" + appGUID,
+			Scheme:      scheme,
+			MetricsPath: fmt.Sprintf("%s/v2/apps/%s/metrics", u.Path, appGUID),
+			StaticConfigs: []staticConfig{
+				{Targets: []string{u.Host}},
+			},
+		},
+	})
+	if err != nil {
+		return ""
+	}
+	return string(content)
 }
@@ -2,6 +2,8 @@ package api_test
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"net/url"
 
@@ -11,8 +13,13 @@ import (
 
 	"github.com/jinzhu/gorm"
 	"github.com/orange-cloudfoundry/promfetcher/api"
+	"github.com/orange-cloudfoundry/promfetcher/caches"
 	"github.com/orange-cloudfoundry/promfetcher/config"
+	"github.com/orange-cloudfoundry/promfetcher/fetchers/fetchersfakes"
+	"github.com/orange-cloudfoundry/promfetcher/migrations"
 	"github.com/orange-cloudfoundry/promfetcher/models"
+	"github.com/orange-cloudfoundry/promfetcher/stores"
+	"github.com/pivotal-cf/brokerapi/v7"
 	"github.com/pivotal-cf/brokerapi/v7/domain"
 )
 
@@ -20,24 +27,47 @@ var _ = Describe("Api/Broker", func() {
 	var db *gorm.DB
 	var err error
 	var broker *api.Broker
+	var endpointCache *caches.EndpointCache
 	var router *mux.Router
 
 	BeforeEach(func() {
 		db, err = gorm.Open("sqlite3", "file::memory:?cache=shared")
 		Expect(err).ShouldNot(HaveOccurred())
 
-		db.AutoMigrate(&models.AppEndpoint{})
+		err = migrations.Up(db)
 		Expect(err).ShouldNot(HaveOccurred())
 
+		routesFetcher := &fetchersfakes.FakeRoutesFetch{}
+		routesFetcher.RoutesReturns(models.Routes{
+			"app.example.net": []*models.Route{
+				{
+					Address: "10.0.0.1:61000",
+					Tags: models.Tags{
+						ProcessType:      "web",
+						OrganizationName: "my org",
+						SpaceName:        "myspace",
+						AppName:          "myapp",
+						AppID:            "d245c244-1875-a718-1248-2547e141a45c",
+					},
+				},
+			},
+		})
+
+		store := stores.NewGormStore(db)
+		endpointCache = caches.NewEndpointCache(store)
+
 		broker = api.NewBroker(
 			config.BrokerConfig{
-				BrokerPlanID:    "e2900be3-709b-419e-b63b-de3aabcd9e15",
-				BrokerServiceID: "75bcebab-cc25-4ef6-89dc-a91b953919f1",
-				User:            "user",
-				Pass:            "password",
+				BrokerPlanID:       "e2900be3-709b-419e-b63b-de3aabcd9e15",
+				BrokerSystemPlanID: "4c5f3a8e-1b7d-4e52-9a0f-6d2c8b3e7f41",
+				BrokerServiceID:    "75bcebab-cc25-4ef6-89dc-a91b953919f1",
+				User:               "user",
+				Pass:               "password",
 			},
 			"http://localhost:8085",
-			db,
+			store,
+			routesFetcher,
+			endpointCache,
 		)
 
 		router = broker.Handler().(*mux.Router)
@@ -48,6 +78,24 @@ var _ = Describe("Api/Broker", func() {
 		Expect(err).ShouldNot(HaveOccurred())
 	})
 
+	Context("Store unavailable", func() {
+		It("should answer 503 when database is down", func() {
+			err = db.Close()
+			Expect(err).ShouldNot(HaveOccurred())
+
+			_, err = broker.Provision(nil, "a758f25d-2d01-419e-b63b-de3aabcd9e15", domain.ProvisionDetails{
+				PlanID: "e2900be3-709b-419e-b63b-de3aabcd9e15",
+			}, false)
+			Expect(err).To(HaveOccurred())
+			var failure *brokerapi.FailureResponse
+			Expect(errors.As(err, &failure)).To(BeTrue())
+			Expect(failure.ValidatedStatusCode(nil)).To(Equal(http.StatusServiceUnavailable))
+
+			db, err = gorm.Open("sqlite3", "file::memory:?cache=shared")
+			Expect(err).ShouldNot(HaveOccurred())
+		})
+	})
+
 	Context("Service", func() {
 		It("returns service informations", func() {
 			services, err := broker.Services(nil)
@@ -59,8 +107,9 @@ var _ = Describe("Api/Broker", func() {
 				"name": "promfetcher",
 				"description": "Fetch your prometheus metrics on each instance of your app",
 				"bindable": true,
+				"instances_retrievable": true,
 				"bindings_retrievable": true,
-				"plan_updateable": false,
+				"plan_updateable": true,
 				"plans": [
 					{
 						"id": "e2900be3-709b-419e-b63b-de3aabcd9e15",
@@ -71,6 +120,16 @@ var _ = Describe("Api/Broker", func() {
 						"metadata": {
 							"displayName": "fetch-app"
 						}
+					},
+					{
+						"id": "4c5f3a8e-1b7d-4e52-9a0f-6d2c8b3e7f41",
+						"name": "system-metrics",
+						"description": "Expose system metrics built by promfetcher on each instance of your app, for apps without prometheus metrics",
+						"free": true,
+						"bindable": true,
+						"metadata": {
+							"displayName": "system-metrics"
+						}
 					}
 				],
 				"metadata": {
@@ -98,8 +157,9 @@ var _ = Describe("Api/Broker", func() {
 				}`),
 			}
 
-			_, err := broker.Bind(nil, instanceID, bindingID, details, false)
+			binding, err := broker.Bind(nil, instanceID, bindingID, details, false)
 			Expect(err).ShouldNot(HaveOccurred())
+			Expect(binding.Credentials).To(BeAssignableToTypeOf(api.BindingCredentials{}))
 
 			result := db.First(&app, "guid = ?", bindingID)
 			Expect(result.RowsAffected).Should(BeEquivalentTo(1))
@@ -109,7 +169,7 @@ var _ = Describe("Api/Broker", func() {
 
 			bindingSpec, err := broker.GetBinding(nil, instanceID, bindingID)
 			Expect(err).ShouldNot(HaveOccurred())
-			Expect(bindingSpec).To(Equal(domain.GetBindingSpec{Credentials: map[string]string{"endpoint": "/metrics"}}))
+			Expect(bindingSpec.Credentials).To(Equal(binding.Credentials))
 
 			var unbindDetails = domain.UnbindDetails{
 				PlanID:    details.PlanID,
@@ -120,12 +180,242 @@ var _ = Describe("Api/Broker", func() {
 			Expect(result.RowsAffected).Should(BeZero())
 		})
 
+		It("gives credentials to scrape app", func() {
+			var details = domain.BindDetails{
+				AppGUID: "d245c244-1875-a718-1248-2547e141a45c",
+				RawParameters: []byte(`{
+					"endpoint": "/actuator/prometheus"
+				}`),
+			}
+
+			binding, err := broker.Bind(nil, instanceID, bindingID, details, false)
+			Expect(err).ShouldNot(HaveOccurred())
+
+			creds := binding.Credentials.(api.BindingCredentials)
+			Expect(creds.URL).To(Equal("http://localhost:8085/v2/apps/d245c244-1875-a718-1248-2547e141a45c/metrics"))
+			Expect(creds.URLByName).To(Equal("http://localhost:8085/v2/apps/my%20org/myspace/myapp/metrics"))
+			Expect(creds.OnlyAppURL).To(Equal("http://localhost:8085/v2/apps/d245c244-1875-a718-1248-2547e141a45c/only-app-metrics"))
+			Expect(creds.Endpoint).To(Equal("/actuator/prometheus"))
+			Expect(creds.ScrapeConfig).To(MatchYAML(`
+- job_name: promfetcher-d245c244-1875-a718-1248-2547e141a45c
+  scheme: http
+  metrics_path: /v2/apps/d245c244-1875-a718-1248-2547e141a45c/metrics
+  static_configs:
+  - targets:
+    - localhost:8085
+`))
+		})
+
+		It("keeps an endpoint for each binding of an app", func() {
+			for i, endpoint := range []string{"/metrics", "/actuator/prometheus"} {
+				_, err := broker.Bind(nil, instanceID, fmt.Sprintf("binding-%d", i), domain.BindDetails{
+					AppGUID:       "d245c244-1875-a718-1248-2547e141a45c",
+					RawParameters: []byte(fmt.Sprintf(`{"endpoint": "%s"}`, endpoint)),
+				}, false)
+				Expect(err).ShouldNot(HaveOccurred())
+			}
+
+			var apps []models.AppEndpoint
+			db.Find(&apps, "app_guid = ?", "d245c244-1875-a718-1248-2547e141a45c")
+			Expect(apps).To(HaveLen(2))
+		})
+
+		It("answers same binding again when bind is retried", func() {
+			details := domain.BindDetails{
+				AppGUID:       "d245c244-1875-a718-1248-2547e141a45c",
+				RawParameters: []byte(`{"endpoint": "/actuator/prometheus"}`),
+			}
+			binding, err := broker.Bind(nil, instanceID, bindingID, details, false)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(binding.AlreadyExists).To(BeFalse())
+
+			retried, err := broker.Bind(nil, instanceID, bindingID, details, false)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(retried.AlreadyExists).To(BeTrue())
+			Expect(retried.Credentials).To(Equal(binding.Credentials))
+		})
+
+		It("answers 409 when binding exists with other settings", func() {
+			_, err := broker.Bind(nil, instanceID, bindingID, domain.BindDetails{
+				AppGUID:       "d245c244-1875-a718-1248-2547e141a45c",
+				RawParameters: []byte(`{"endpoint": "/actuator/prometheus"}`),
+			}, false)
+			Expect(err).ShouldNot(HaveOccurred())
+
+			_, err = broker.Bind(nil, instanceID, bindingID, domain.BindDetails{
+				AppGUID:       "d245c244-1875-a718-1248-2547e141a45c",
+				RawParameters: []byte(`{"endpoint": "/metrics"}`),
+			}, false)
+			Expect(err).To(Equal(brokerapi.ErrBindingAlreadyExists))
+			var failure *brokerapi.FailureResponse
+			Expect(errors.As(err, &failure)).To(BeTrue())
+			Expect(failure.ValidatedStatusCode(nil)).To(Equal(http.StatusConflict))
+		})
+
+		It("invalidates endpoint cache on (un)bind", func() {
+			appGUID := "d245c244-1875-a718-1248-2547e141a45c"
+			_, err := broker.Bind(nil, instanceID, bindingID, domain.BindDetails{
+				AppGUID:       appGUID,
+				RawParameters: []byte(`{"endpoint": "/actuator/prometheus"}`),
+			}, false)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(endpointCache.Endpoints(appGUID).Paths("/metrics")).To(Equal([]string{"/actuator/prometheus"}))
+
+			_, err = broker.Unbind(nil, instanceID, bindingID, domain.UnbindDetails{}, false)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(endpointCache.Endpoints(appGUID)).To(BeEmpty())
+		})
+
+		It("gives default endpoint in credentials when none is set", func() {
+			binding, err := broker.Bind(nil, instanceID, bindingID, domain.BindDetails{
+				AppGUID: "e245c244-1875-a718-1248-2547e141a45c",
+			}, false)
+			Expect(err).ShouldNot(HaveOccurred())
+
+			creds := binding.Credentials.(api.BindingCredentials)
+			Expect(creds.Endpoint).To(Equal("/metrics"))
+			Expect(creds.URLByName).To(BeEmpty())
+		})
+
 		It("fail gracefully when not found", func() {
 			bindingSpec, err := broker.GetBinding(nil, instanceID, bindingID)
 			Expect(bindingSpec).To(Equal(domain.GetBindingSpec{}))
-			Expect(err).To(HaveOccurred())
+			Expect(err).To(Equal(brokerapi.ErrBindingNotFound))
+			var failure *brokerapi.FailureResponse
+			Expect(errors.As(err, &failure)).To(BeTrue())
+			Expect(failure.ValidatedStatusCode(nil)).To(Equal(http.StatusNotFound))
 		})
 
+		It("answers 503 on binding when database is down", func() {
+			err = db.Close()
+			Expect(err).ShouldNot(HaveOccurred())
+
+			_, err = broker.GetBinding(nil, instanceID, bindingID)
+			var failure *brokerapi.FailureResponse
+			Expect(errors.As(err, &failure)).To(BeTrue())
+			Expect(failure.ValidatedStatusCode(nil)).To(Equal(http.StatusServiceUnavailable))
+
+			db, err = gorm.Open("sqlite3", "file::memory:?cache=shared")
+			Expect(err).ShouldNot(HaveOccurred())
+		})
+
+	})
+
+	Context("Instances", func() {
+		var instanceID = "a758f25d-2d01-419e-b63b-de3aabcd9e15"
+		var serviceID = "75bcebab-cc25-4ef6-89dc-a91b953919f1"
+		var planID = "e2900be3-709b-419e-b63b-de3aabcd9e15"
+
+		BeforeEach(func() {
+			_, err := broker.Provision(nil, instanceID, domain.ProvisionDetails{
+				ServiceID:     serviceID,
+				PlanID:        planID,
+				RawParameters: []byte(`{"endpoint": "/actuator/prometheus"}`),
+			}, false)
+			Expect(err).ShouldNot(HaveOccurred())
+		})
+
+		It("gives instance parameters", func() {
+			instance, err := broker.GetInstance(nil, instanceID)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(instance.ServiceID).To(Equal(serviceID))
+			Expect(instance.PlanID).To(Equal(planID))
+			Expect(instance.Parameters).To(Equal(api.BrokerParams{Endpoint: "/actuator/prometheus"}))
+		})
+
+		It("fails when getting unknown instance", func() {
+			_, err := broker.GetInstance(nil, "unknown")
+			Expect(err).To(MatchError(brokerapi.ErrInstanceDoesNotExist))
+		})
+
+		It("accepts same provision twice but not different one", func() {
+			spec, err := broker.Provision(nil, instanceID, domain.ProvisionDetails{
+				ServiceID:     serviceID,
+				PlanID:        planID,
+				RawParameters: []byte(`{"endpoint": "/actuator/prometheus"}`),
+			}, false)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(spec.AlreadyExists).To(BeTrue())
+
+			_, err = broker.Provision(nil, instanceID, domain.ProvisionDetails{
+				ServiceID: serviceID,
+				PlanID:    planID,
+			}, false)
+			Expect(err).To(MatchError(brokerapi.ErrInstanceAlreadyExists))
+		})
+
+		It("makes bindings inherit instance parameters", func() {
+			var app1, app2 models.AppEndpoint
+			_, err := broker.Bind(nil, instanceID, "binding-1", domain.BindDetails{
+				AppGUID: "d245c244-1875-a718-1248-2547e141a45c",
+			}, false)
+			Expect(err).ShouldNot(HaveOccurred())
+			_, err = broker.Bind(nil, instanceID, "binding-2", domain.BindDetails{
+				AppGUID:       "e245c244-1875-a718-1248-2547e141a45c",
+				RawParameters: []byte(`{"endpoint": "/metrics"}`),
+			}, false)
+			Expect(err).ShouldNot(HaveOccurred())
+
+			db.First(&app1, "guid = ?", "binding-1")
+			Expect(app1.Endpoint).To(Equal("/actuator/prometheus"))
+			Expect(app1.Inherited).To(BeTrue())
+
+			_, err = broker.Update(nil, instanceID, domain.UpdateDetails{
+				ServiceID:     serviceID,
+				PlanID:        planID,
+				RawParameters: []byte(`{"endpoint": "/prometheus"}`),
+			}, false)
+			Expect(err).ShouldNot(HaveOccurred())
+
+			instance, err := broker.GetInstance(nil, instanceID)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(instance.Parameters).To(Equal(api.BrokerParams{Endpoint: "/prometheus"}))
+
+			app1 = models.AppEndpoint{}
+			db.First(&app1, "guid = ?", "binding-1")
+			Expect(app1.Endpoint).To(Equal("/prometheus"))
+			db.First(&app2, "guid = ?", "binding-2")
+			Expect(app2.Endpoint).To(Equal("/metrics"))
+		})
+
+		It("asks for system metrics when bound with system plan", func() {
+			var app models.AppEndpoint
+			_, err := broker.Bind(nil, instanceID, "binding-1", domain.BindDetails{
+				AppGUID: "d245c244-1875-a718-1248-2547e141a45c",
+				PlanID:  planID,
+			}, false)
+			Expect(err).ShouldNot(HaveOccurred())
+			db.First(&app, "guid = ?", "binding-1")
+			Expect(app.SystemMetrics).To(BeFalse())
+
+			_, err = broker.Update(nil, instanceID, domain.UpdateDetails{
+				ServiceID: serviceID,
+				PlanID:    "4c5f3a8e-1b7d-4e52-9a0f-6d2c8b3e7f41",
+			}, false)
+			Expect(err).ShouldNot(HaveOccurred())
+
+			app = models.AppEndpoint{}
+			db.First(&app, "guid = ?", "binding-1")
+			Expect(app.SystemMetrics).To(BeTrue())
+			Expect(app.Endpoint).To(Equal("/actuator/prometheus"))
+		})
+
+		It("deletes bindings on deprovision", func() {
+			_, err := broker.Bind(nil, instanceID, "binding-1", domain.BindDetails{
+				AppGUID: "d245c244-1875-a718-1248-2547e141a45c",
+			}, false)
+			Expect(err).ShouldNot(HaveOccurred())
+
+			_, err = broker.Deprovision(nil, instanceID, domain.DeprovisionDetails{}, false)
+			Expect(err).ShouldNot(HaveOccurred())
+
+			var count int
+			db.Model(models.AppEndpoint{}).Where("instance_guid = ?", instanceID).Count(&count)
+			Expect(count).To(BeZero())
+
+			_, err = broker.GetInstance(nil, instanceID)
+			Expect(err).To(MatchError(brokerapi.ErrInstanceDoesNotExist))
+		})
 	})
 
 	Context("Handler", func() {
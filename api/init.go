@@ -15,12 +15,14 @@ import (
 )
 
 type Api struct {
-	metFetcher *fetchers.MetricsFetcher
+	metFetcher    *fetchers.MetricsFetcher
+	routesFetcher fetchers.RoutesFetch
 }
 
-func Register(rtr *mux.Router, metFetcher *fetchers.MetricsFetcher, routesFetcher *fetchers.RoutesFetcher, broker *Broker, userdocs *userdocs.UserDoc) {
+func Register(rtr *mux.Router, metFetcher *fetchers.MetricsFetcher, routesFetcher fetchers.RoutesFetch, broker *Broker, userdocs *userdocs.UserDoc) {
 	api := &Api{
-		metFetcher: metFetcher,
+		metFetcher:    metFetcher,
+		routesFetcher: routesFetcher,
 	}
 
 	rtr.Use(AccessLogMiddleware)
@@ -68,5 +70,5 @@ func Register(rtr *mux.Router, metFetcher *fetchers.MetricsFetcher, routesFetche
 	rtr.PathPrefix("/assets/").Handler(http.StripPrefix("/assets/", http.FileServer(http.FS(htmlContent))))
 	rtr.Handle("/doc", userdocs)
 	rtr.Handle("/metrics", promhttp.Handler())
-	rtr.HandleFunc("/routes", routesFetcher.RouteHandler).Methods(http.MethodGet)
+	rtr.HandleFunc("/routes", api.routes).Methods(http.MethodGet)
 }
@@ -0,0 +1,11 @@
+package api
+
+import (
+	"net/http"
+)
+
+func (a Api) routes(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte(a.routesFetcher.Routes().String()))
+}
@@ -0,0 +1,93 @@
+package caches
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/orange-cloudfoundry/promfetcher/models"
+	"github.com/orange-cloudfoundry/promfetcher/stores"
+)
+
+// EndpointCache keeps app endpoints set by broker in memory to not ask database on each scrape
+type EndpointCache struct {
+	mu        sync.RWMutex
+	store     stores.EndpointStore
+	endpoints map[string]models.AppEndpoints
+}
+
+func NewEndpointCache(store stores.EndpointStore) *EndpointCache {
+	return &EndpointCache{
+		store:     store,
+		endpoints: make(map[string]models.AppEndpoints),
+	}
+}
+
+// Load retrieves all app endpoints from store, current cache is kept on error
+func (c *EndpointCache) Load() error {
+	appEndpoints, err := c.store.AppEndpoints()
+	if err != nil {
+		return fmt.Errorf("error when loading app endpoints from store: %s", err.Error())
+	}
+	endpoints := make(map[string]models.AppEndpoints)
+	for _, appEndpoint := range appEndpoints {
+		endpoints[appEndpoint.AppGUID] = append(endpoints[appEndpoint.AppGUID], appEndpoint)
+	}
+
+	c.mu.Lock()
+	c.endpoints = endpoints
+	c.mu.Unlock()
+	return nil
+}
+
+// Invalidate reloads app endpoints for given apps from store
+func (c *EndpointCache) Invalidate(appGUIDs ...string) error {
+	for _, appGUID := range appGUIDs {
+		appEndpoints, err := c.store.AppEndpointsByApp(appGUID)
+		if err != nil {
+			return fmt.Errorf("error when loading app endpoints from store: %s", err.Error())
+		}
+		c.mu.Lock()
+		if len(appEndpoints) == 0 {
+			delete(c.endpoints, appGUID)
+		} else {
+			c.endpoints[appGUID] = appEndpoints
+		}
+		c.mu.Unlock()
+	}
+	return nil
+}
+
+// Endpoints gives endpoints set by bindings for an app
+func (c *EndpointCache) Endpoints(appGUID string) models.AppEndpoints {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	appEndpoints, ok := c.endpoints[appGUID]
+	if !ok {
+		return make(models.AppEndpoints, 0)
+	}
+	return appEndpoints
+}
+
+// Run refreshes periodically the whole cache, this let multiple promfetcher instances
+// sharing the same database see bindings made on others
+func (c *EndpointCache) Run(interval time.Duration, stop <-chan struct{}) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			err := c.Load()
+			if err != nil {
+				log.Errorf("failed to refresh endpoint cache: %s", err.Error())
+			}
+		case <-stop:
+			return
+		}
+	}
+}
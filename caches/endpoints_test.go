@@ -0,0 +1,98 @@
+package caches_test
+
+import (
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/orange-cloudfoundry/promfetcher/caches"
+	"github.com/orange-cloudfoundry/promfetcher/migrations"
+	"github.com/orange-cloudfoundry/promfetcher/models"
+	"github.com/orange-cloudfoundry/promfetcher/stores"
+)
+
+var _ = Describe("EndpointCache", func() {
+	var db *gorm.DB
+	var err error
+	var cache *caches.EndpointCache
+	var appGUID = "d245c244-1875-a718-1248-2547e141a45c"
+
+	BeforeEach(func() {
+		db, err = gorm.Open("sqlite3", "file::memory:?cache=shared")
+		Expect(err).ShouldNot(HaveOccurred())
+
+		Expect(migrations.Up(db)).To(Succeed())
+
+		for guid, endpoint := range map[string]string{
+			"binding-1": "/metrics",
+			"binding-2": "/actuator/prometheus",
+			"binding-3": "/metrics",
+			"binding-4": "",
+		} {
+			db.Create(&models.AppEndpoint{
+				GUID:     guid,
+				AppGUID:  appGUID,
+				Endpoint: endpoint,
+			})
+		}
+
+		cache = caches.NewEndpointCache(stores.NewGormStore(db))
+		Expect(cache.Load()).To(Succeed())
+	})
+
+	AfterEach(func() {
+		Expect(db.Close()).ShouldNot(HaveOccurred())
+	})
+
+	It("gives distinct endpoints of an app", func() {
+		Expect(cache.Endpoints(appGUID).Paths("/metrics")).To(Equal([]string{
+			"/actuator/prometheus",
+			"/metrics",
+		}))
+	})
+
+	It("gives no endpoints for unknown app", func() {
+		Expect(cache.Endpoints("unknown")).To(BeEmpty())
+	})
+
+	It("does not ask database until invalidated", func() {
+		db.Create(&models.AppEndpoint{
+			GUID:          "binding-5",
+			AppGUID:       appGUID,
+			SystemMetrics: true,
+		})
+		Expect(cache.Endpoints(appGUID).SystemMetrics()).To(BeFalse())
+
+		Expect(cache.Invalidate(appGUID)).To(Succeed())
+		Expect(cache.Endpoints(appGUID).SystemMetrics()).To(BeTrue())
+	})
+
+	It("forgets app without endpoints anymore when invalidated", func() {
+		db.Delete(models.AppEndpoint{}, "app_guid = ?", appGUID)
+		Expect(cache.Invalidate(appGUID)).To(Succeed())
+		Expect(cache.Endpoints(appGUID)).To(BeEmpty())
+	})
+
+	It("keeps cache when database is unreachable", func() {
+		Expect(db.Close()).To(Succeed())
+		Expect(cache.Load()).ToNot(Succeed())
+		Expect(cache.Endpoints(appGUID)).To(HaveLen(4))
+
+		db, err = gorm.Open("sqlite3", "file::memory:?cache=shared")
+		Expect(err).ShouldNot(HaveOccurred())
+	})
+
+	It("loads from any store", func() {
+		store := stores.NewMemoryStore()
+		Expect(store.CreateAppEndpoint(models.AppEndpoint{
+			GUID:     "binding-1",
+			AppGUID:  appGUID,
+			Endpoint: "/metrics",
+		})).To(Succeed())
+
+		cache = caches.NewEndpointCache(store)
+		Expect(cache.Load()).To(Succeed())
+		Expect(cache.Endpoints(appGUID).Paths("/metrics")).To(Equal([]string{"/metrics"}))
+	})
+})
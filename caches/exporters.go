@@ -0,0 +1,129 @@
+package caches
+
+import (
+	"sync"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/orange-cloudfoundry/promfetcher/metrics"
+)
+
+// sweepInterval is minimum time between two removals of expired entries
+const sweepInterval = time.Minute
+
+type exporterEntry struct {
+	families  map[string]*dto.MetricFamily
+	fetchedAt time.Time
+	expiresAt time.Time
+}
+
+// exporterCall is a fetch in progress, callers asking for the same key wait for it
+type exporterCall struct {
+	done     chan struct{}
+	families map[string]*dto.MetricFamily
+	err      error
+}
+
+// ExporterCache keeps results of external exporters to not scrape them for each app.
+// A result older than its ttl is still given while it is refreshed in background until max stale is reached,
+// concurrent requests for the same missing result share a single scrape
+type ExporterCache struct {
+	mu        sync.Mutex
+	entries   map[string]*exporterEntry
+	calls     map[string]*exporterCall
+	lastSweep time.Time
+}
+
+func NewExporterCache() *ExporterCache {
+	return &ExporterCache{
+		entries:   make(map[string]*exporterEntry),
+		calls:     make(map[string]*exporterCall),
+		lastSweep: time.Now(),
+	}
+}
+
+// Get gives a copy of cached metrics of exporter request identified by key, fetch is used
+// to scrape them when missing or stale. Name is the external exporter name used in metrics
+func (c *ExporterCache) Get(name, key string, ttl, maxStale time.Duration, fetch func() (map[string]*dto.MetricFamily, error)) (map[string]*dto.MetricFamily, error) {
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	if ok {
+		age := time.Since(entry.fetchedAt)
+		if age < ttl {
+			c.mu.Unlock()
+			metrics.ExporterCacheRequestsTotal.WithLabelValues(name, "hit").Inc()
+			metrics.ExporterCacheAge.WithLabelValues(name).Observe(age.Seconds())
+			return cloneFamilies(entry.families), nil
+		}
+		if age < ttl+maxStale {
+			c.fetch(name, key, ttl+maxStale, fetch)
+			c.mu.Unlock()
+			metrics.ExporterCacheRequestsTotal.WithLabelValues(name, "stale").Inc()
+			metrics.ExporterCacheAge.WithLabelValues(name).Observe(age.Seconds())
+			return cloneFamilies(entry.families), nil
+		}
+	}
+	call := c.fetch(name, key, ttl+maxStale, fetch)
+	c.mu.Unlock()
+	metrics.ExporterCacheRequestsTotal.WithLabelValues(name, "miss").Inc()
+
+	<-call.done
+	if call.err != nil {
+		return nil, call.err
+	}
+	return cloneFamilies(call.families), nil
+}
+
+// fetch starts fetching metrics for key or gives the fetch already in progress, c.mu must be held
+func (c *ExporterCache) fetch(name, key string, retention time.Duration, fetch func() (map[string]*dto.MetricFamily, error)) *exporterCall {
+	if call, ok := c.calls[key]; ok {
+		return call
+	}
+	call := &exporterCall{done: make(chan struct{})}
+	c.calls[key] = call
+	go func() {
+		call.families, call.err = fetch()
+
+		c.mu.Lock()
+		delete(c.calls, key)
+		now := time.Now()
+		if call.err == nil {
+			c.entries[key] = &exporterEntry{
+				families:  call.families,
+				fetchedAt: now,
+				expiresAt: now.Add(retention),
+			}
+		} else {
+			// stale result, if any, is kept until it expires
+			log.WithField("external_exporter", name).Debugf("error when refreshing cache: %s", call.err.Error())
+		}
+		if now.Sub(c.lastSweep) > sweepInterval {
+			c.sweep(now)
+		}
+		c.mu.Unlock()
+		close(call.done)
+	}()
+	return call
+}
+
+// sweep removes entries which can't be given anymore, c.mu must be held
+func (c *ExporterCache) sweep(now time.Time) {
+	for key, entry := range c.entries {
+		if now.After(entry.expiresAt) {
+			delete(c.entries, key)
+		}
+	}
+	c.lastSweep = now
+}
+
+// cloneFamilies gives a deep copy of metric families as callers add labels and merge them
+func cloneFamilies(families map[string]*dto.MetricFamily) map[string]*dto.MetricFamily {
+	cloned := make(map[string]*dto.MetricFamily, len(families))
+	for name, family := range families {
+		cloned[name] = proto.Clone(family).(*dto.MetricFamily)
+	}
+	return cloned
+}
@@ -0,0 +1,154 @@
+package caches_test
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/orange-cloudfoundry/promfetcher/caches"
+)
+
+var _ = Describe("ExporterCache", func() {
+	var cache *caches.ExporterCache
+	var calls *atomic.Int32
+	var fetchErr *atomic.Pointer[error]
+	var fetch func() (map[string]*dto.MetricFamily, error)
+
+	value := func(families map[string]*dto.MetricFamily) float64 {
+		return families["exporter_metric"].Metric[0].GetGauge().GetValue()
+	}
+
+	BeforeEach(func() {
+		cache = caches.NewExporterCache()
+		// background refreshes of previous specs must not change counters of next ones
+		testCalls := &atomic.Int32{}
+		testFetchErr := &atomic.Pointer[error]{}
+		calls, fetchErr = testCalls, testFetchErr
+		fetch = func() (map[string]*dto.MetricFamily, error) {
+			n := testCalls.Add(1)
+			if err := testFetchErr.Load(); err != nil {
+				return nil, *err
+			}
+			return map[string]*dto.MetricFamily{
+				"exporter_metric": {
+					Name: proto.String("exporter_metric"),
+					Metric: []*dto.Metric{{
+						Gauge: &dto.Gauge{Value: proto.Float64(float64(n))},
+					}},
+				},
+			}, nil
+		}
+	})
+
+	It("gives cached result while fresh", func() {
+		families, err := cache.Get("exporter", "key", time.Minute, time.Minute, fetch)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(value(families)).To(Equal(float64(1)))
+
+		families, err = cache.Get("exporter", "key", time.Minute, time.Minute, fetch)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(value(families)).To(Equal(float64(1)))
+		Expect(calls.Load()).To(Equal(int32(1)))
+	})
+
+	It("gives copies of cached result", func() {
+		families, err := cache.Get("exporter", "key", time.Minute, time.Minute, fetch)
+		Expect(err).ShouldNot(HaveOccurred())
+		families["exporter_metric"].Metric = append(families["exporter_metric"].Metric, &dto.Metric{})
+
+		families, err = cache.Get("exporter", "key", time.Minute, time.Minute, fetch)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(families["exporter_metric"].Metric).To(HaveLen(1))
+	})
+
+	It("does not share results between keys", func() {
+		_, err := cache.Get("exporter", "key1", time.Minute, time.Minute, fetch)
+		Expect(err).ShouldNot(HaveOccurred())
+		families, err := cache.Get("exporter", "key2", time.Minute, time.Minute, fetch)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(value(families)).To(Equal(float64(2)))
+	})
+
+	It("gives stale result and refreshes it in background", func() {
+		_, err := cache.Get("exporter", "key", 50*time.Millisecond, time.Minute, fetch)
+		Expect(err).ShouldNot(HaveOccurred())
+		time.Sleep(60 * time.Millisecond)
+
+		families, err := cache.Get("exporter", "key", 50*time.Millisecond, time.Minute, fetch)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(value(families)).To(Equal(float64(1)))
+
+		Eventually(func() float64 {
+			families, err := cache.Get("exporter", "key", 50*time.Millisecond, time.Minute, fetch)
+			Expect(err).ShouldNot(HaveOccurred())
+			return value(families)
+		}).Should(Equal(float64(2)))
+	})
+
+	It("keeps stale result when refresh fails", func() {
+		_, err := cache.Get("exporter", "key", 50*time.Millisecond, time.Minute, fetch)
+		Expect(err).ShouldNot(HaveOccurred())
+		time.Sleep(60 * time.Millisecond)
+
+		refreshErr := fmt.Errorf("exporter down")
+		fetchErr.Store(&refreshErr)
+		_, err = cache.Get("exporter", "key", 50*time.Millisecond, time.Minute, fetch)
+		Expect(err).ShouldNot(HaveOccurred())
+		Eventually(calls.Load).Should(Equal(int32(2)))
+
+		families, err := cache.Get("exporter", "key", 50*time.Millisecond, time.Minute, fetch)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(value(families)).To(Equal(float64(1)))
+	})
+
+	It("fetches again when result is too old", func() {
+		_, err := cache.Get("exporter", "key", 20*time.Millisecond, 20*time.Millisecond, fetch)
+		Expect(err).ShouldNot(HaveOccurred())
+		time.Sleep(50 * time.Millisecond)
+
+		families, err := cache.Get("exporter", "key", 20*time.Millisecond, 20*time.Millisecond, fetch)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(value(families)).To(Equal(float64(2)))
+	})
+
+	It("does not cache errors", func() {
+		firstErr := fmt.Errorf("exporter down")
+		fetchErr.Store(&firstErr)
+		_, err := cache.Get("exporter", "key", time.Minute, time.Minute, fetch)
+		Expect(err).To(MatchError("exporter down"))
+
+		fetchErr.Store(nil)
+		families, err := cache.Get("exporter", "key", time.Minute, time.Minute, fetch)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(value(families)).To(Equal(float64(2)))
+	})
+
+	It("shares a single fetch between concurrent requests", func() {
+		release := make(chan struct{})
+		blockingFetch := func() (map[string]*dto.MetricFamily, error) {
+			<-release
+			return fetch()
+		}
+		wg := &sync.WaitGroup{}
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer GinkgoRecover()
+				defer wg.Done()
+				families, err := cache.Get("exporter", "key", time.Minute, time.Minute, blockingFetch)
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(value(families)).To(Equal(float64(1)))
+			}()
+		}
+		time.Sleep(20 * time.Millisecond)
+		close(release)
+		wg.Wait()
+		Expect(calls.Load()).To(Equal(int32(1)))
+	})
+})
@@ -16,6 +16,16 @@ type BackendFactory struct {
 	factory FactoryRoundTripper
 }
 
+const defaultScrapeTimeout = 30 * time.Second
+
+// ScrapeTimeout gives timeout of route or default timeout when not set
+func ScrapeTimeout(route *models.Route) time.Duration {
+	if route.Timeout > 0 {
+		return route.Timeout
+	}
+	return defaultScrapeTimeout
+}
+
 func NewBackendFactory(c config.Config) *BackendFactory {
 	backendTLSConfig := &tls.Config{
 		InsecureSkipVerify: c.SkipSSLValidation,
@@ -43,7 +53,10 @@ func NewBackendFactory(c config.Config) *BackendFactory {
 func (f BackendFactory) NewClient(route *models.Route, followRedirect bool) *http.Client {
 	client := &http.Client{
 		Transport: f.factory.New(route.ServerCertDomainSan),
-		Timeout:   30 * time.Second,
+		Timeout:   ScrapeTimeout(route),
+	}
+	if route.TLSConfig != nil {
+		client.Transport = f.factory.NewWithTLS(route.ServerCertDomainSan, route.TLSConfig)
 	}
 
 	if !followRedirect {
@@ -40,5 +40,24 @@ var _ = Describe("Backend", func() {
 			Expect(httpTrans.MaxIdleConns).To(Equal(100))
 			Expect(httpTrans.MaxIdleConnsPerHost).To(Equal(100))
 		})
+
+		It("uses tls config and timeout of route when set", func() {
+			factory := clients.NewBackendFactory(config.Config{
+				CAPool:            &x509.CertPool{},
+				SkipSSLValidation: false,
+			})
+
+			client := factory.NewClient(&models.Route{
+				ServerCertDomainSan: "exporter.example.net",
+				Timeout:             5 * time.Second,
+				TLSConfig:           &tls.Config{InsecureSkipVerify: true},
+			}, false)
+
+			Expect(client.Timeout).To(Equal(5 * time.Second))
+			httpTrans, ok := client.Transport.(*http.Transport)
+			Expect(ok).To(BeTrue())
+			Expect(httpTrans.TLSClientConfig.InsecureSkipVerify).To(BeTrue())
+			Expect(httpTrans.TLSClientConfig.ServerName).To(Equal("exporter.example.net"))
+		})
 	})
 })
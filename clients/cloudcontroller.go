@@ -0,0 +1,210 @@
+package clients
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/orange-cloudfoundry/promfetcher/config"
+)
+
+// CloudControllerClient requests cloud controller v3 api with a token retrieved
+// from uaa with client credentials
+type CloudControllerClient struct {
+	apiURL       string
+	uaaURL       string
+	clientID     string
+	clientSecret string
+	httpClient   *http.Client
+
+	mu          sync.Mutex
+	token       string
+	tokenExpiry time.Time
+}
+
+// StatusError is given when cloud controller answers with an error status, e.g. 404 on a deleted resource
+type StatusError struct {
+	StatusCode int
+	Path       string
+	Body       string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("cloud controller answered %d on %s: %s", e.StatusCode, e.Path, e.Body)
+}
+
+type ccPage struct {
+	Pagination struct {
+		Next *struct {
+			Href string `json:"href"`
+		} `json:"next"`
+	} `json:"pagination"`
+	Resources []json.RawMessage `json:"resources"`
+}
+
+type ccRoot struct {
+	Links struct {
+		UAA struct {
+			Href string `json:"href"`
+		} `json:"uaa"`
+		Login struct {
+			Href string `json:"href"`
+		} `json:"login"`
+	} `json:"links"`
+}
+
+type uaaToken struct {
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int    `json:"expires_in"`
+}
+
+func NewCloudControllerClient(c config.CloudControllerConfig, caPool *x509.CertPool) *CloudControllerClient {
+	return &CloudControllerClient{
+		apiURL:       strings.TrimSuffix(c.APIURL, "/"),
+		uaaURL:       strings.TrimSuffix(c.UAAURL, "/"),
+		clientID:     c.ClientID,
+		clientSecret: c.ClientSecret,
+		httpClient: &http.Client{
+			Timeout: 30 * time.Second,
+			Transport: &http.Transport{
+				Proxy: http.ProxyFromEnvironment,
+				TLSClientConfig: &tls.Config{
+					InsecureSkipVerify: c.SkipSSLValidation,
+					RootCAs:            caPool,
+				},
+			},
+		},
+	}
+}
+
+// List retrieves all resources of a v3 endpoint by following pagination,
+// each resource is unmarshalled by calling onResource
+func (c *CloudControllerClient) List(path string, onResource func(raw json.RawMessage) error) error {
+	next := c.apiURL + path
+	for next != "" {
+		var page ccPage
+		err := c.get(next, &page)
+		if err != nil {
+			return err
+		}
+		for _, raw := range page.Resources {
+			err = onResource(raw)
+			if err != nil {
+				return fmt.Errorf("error when loading resource from %s: %s", path, err.Error())
+			}
+		}
+		next = ""
+		if page.Pagination.Next != nil {
+			next = page.Pagination.Next.Href
+		}
+	}
+	return nil
+}
+
+// Get retrieves a v3 endpoint and unmarshal it in v
+func (c *CloudControllerClient) Get(path string, v interface{}) error {
+	return c.get(c.apiURL+path, v)
+}
+
+func (c *CloudControllerClient) get(u string, v interface{}) error {
+	token, err := c.accessToken()
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "bearer "+token)
+	req.Header.Set("Accept", "application/json")
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("error when requesting cloud controller: %s", err.Error())
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized {
+		// token may have been revoked, a new one will be asked on next request
+		c.mu.Lock()
+		c.token = ""
+		c.mu.Unlock()
+	}
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return &StatusError{StatusCode: resp.StatusCode, Path: req.URL.Path, Body: string(b)}
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// accessToken gives current token or retrieves a new one from uaa when expired
+func (c *CloudControllerClient) accessToken() (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.token != "" && time.Now().Before(c.tokenExpiry) {
+		return c.token, nil
+	}
+	if c.uaaURL == "" {
+		uaaURL, err := c.discoverUAAURL()
+		if err != nil {
+			return "", err
+		}
+		c.uaaURL = uaaURL
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "client_credentials")
+	req, err := http.NewRequest(http.MethodPost, c.uaaURL+"/oauth/token", strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.SetBasicAuth(url.QueryEscape(c.clientID), url.QueryEscape(c.clientSecret))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("error when requesting uaa token: %s", err.Error())
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("uaa answered %d when requesting token", resp.StatusCode)
+	}
+	var token uaaToken
+	err = json.NewDecoder(resp.Body).Decode(&token)
+	if err != nil {
+		return "", fmt.Errorf("error when loading uaa token: %s", err.Error())
+	}
+	c.token = token.AccessToken
+	// renew token a bit before it expires to not use an expired token on long requests
+	c.tokenExpiry = time.Now().Add(time.Duration(token.ExpiresIn)*time.Second - 30*time.Second)
+	return c.token, nil
+}
+
+func (c *CloudControllerClient) discoverUAAURL() (string, error) {
+	resp, err := c.httpClient.Get(c.apiURL + "/")
+	if err != nil {
+		return "", fmt.Errorf("error when requesting cloud controller root: %s", err.Error())
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("cloud controller answered %d on root", resp.StatusCode)
+	}
+	var root ccRoot
+	err = json.NewDecoder(resp.Body).Decode(&root)
+	if err != nil {
+		return "", fmt.Errorf("error when loading cloud controller root: %s", err.Error())
+	}
+	uaaURL := root.Links.UAA.Href
+	if uaaURL == "" {
+		uaaURL = root.Links.Login.Href
+	}
+	if uaaURL == "" {
+		return "", fmt.Errorf("no uaa link found on cloud controller root, uaa_url must be set")
+	}
+	return strings.TrimSuffix(uaaURL, "/"), nil
+}
@@ -12,8 +12,13 @@ type FactoryRoundTripper struct {
 }
 
 func (t *FactoryRoundTripper) New(expectedServerName string) http.RoundTripper {
+	return t.NewWithTLS(expectedServerName, t.Template.TLSClientConfig)
+}
+
+// NewWithTLS gives a round tripper from template using given tls config instead of template one
+func (t *FactoryRoundTripper) NewWithTLS(expectedServerName string, tlsConfig *tls.Config) http.RoundTripper {
 
-	customTLSConfig := TLSConfigWithServerName(expectedServerName, t.Template.TLSClientConfig)
+	customTLSConfig := TLSConfigWithServerName(expectedServerName, tlsConfig)
 	maxIdle := 100
 	if t.Template.MaxIdleConns != 0 {
 		maxIdle = t.Template.MaxIdleConns
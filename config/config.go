@@ -3,6 +3,7 @@ package config
 import (
 	"crypto/tls"
 	"crypto/x509"
+	"database/sql"
 	"fmt"
 	"io"
 	"net/url"
@@ -15,9 +16,10 @@ import (
 	_ "github.com/jinzhu/gorm/dialects/postgres"
 	_ "github.com/jinzhu/gorm/dialects/sqlite"
 	log "github.com/sirupsen/logrus"
+	yaml3 "go.yaml.in/yaml/v3"
 	"gopkg.in/yaml.v2"
 
-	"github.com/orange-cloudfoundry/promfetcher/models"
+	"github.com/orange-cloudfoundry/promfetcher/stores"
 )
 
 type NatsConfig struct {
@@ -43,24 +45,71 @@ var defaultNatsConfig = NatsConfig{
 }
 
 type BackendConfig struct {
-	ClientAuthCertificate tls.Certificate
-	MaxConns              int64 `yaml:"max_conns"`
+	ClientAuthCertificate tls.Certificate `yaml:"-"`
+	MaxConns              int64           `yaml:"max_conns"`
 
 	TLSPem `yaml:",inline"` // embed to get cert_chain and private_key for client authentication
 }
 
 type BrokerConfig struct {
-	BrokerServiceID string `yaml:"broker_service_id"`
-	BrokerPlanID    string `yaml:"broker_plan_id"`
-	User            string `yaml:"user"`
-	Pass            string `yaml:"pass"`
+	BrokerServiceID    string `yaml:"broker_service_id"`
+	BrokerPlanID       string `yaml:"broker_plan_id"`
+	BrokerSystemPlanID string `yaml:"broker_system_plan_id"`
+	User               string `yaml:"user"`
+	Pass               string `yaml:"pass"`
 }
 
 var defaultBrokerConfig = BrokerConfig{
-	BrokerPlanID:    "e2900be3-709b-419e-b63b-de3aabcd9e15",
-	BrokerServiceID: "75bcebab-cc25-4ef6-89dc-a91b953919f1",
-	User:            "user",
-	Pass:            "password",
+	BrokerPlanID:       "e2900be3-709b-419e-b63b-de3aabcd9e15",
+	BrokerSystemPlanID: "4c5f3a8e-1b7d-4e52-9a0f-6d2c8b3e7f41",
+	BrokerServiceID:    "75bcebab-cc25-4ef6-89dc-a91b953919f1",
+	User:               "user",
+	Pass:               "password",
+}
+
+type EndpointStoreConfig struct {
+	// Type is one of database, memory or file, database is used by default when db_conn is set
+	// and memory otherwise
+	Type string `yaml:"type"`
+	Path string `yaml:"path"`
+}
+
+type RouteSourceConfig struct {
+	// Type is nats (default) to receive routes from gorouter bus,
+	// cloud_controller to poll routes from cloud controller v3 api
+	// or file to load routes from a local yaml or json file
+	Type            string                `yaml:"type"`
+	CloudController CloudControllerConfig `yaml:"cloud_controller"`
+	File            FileRouteSourceConfig `yaml:"file"`
+}
+
+var defaultRouteSourceConfig = RouteSourceConfig{
+	CloudController: CloudControllerConfig{PollInterval: 30 * time.Second, StatsConcurrency: 10},
+	File:            FileRouteSourceConfig{PollInterval: 5 * time.Second},
+}
+
+type CloudControllerConfig struct {
+	APIURL string `yaml:"api_url"`
+	// UAAURL is found from cloud controller api when not set
+	UAAURL            string        `yaml:"uaa_url"`
+	ClientID          string        `yaml:"client_id"`
+	ClientSecret      string        `yaml:"client_secret"`
+	SkipSSLValidation bool          `yaml:"skip_ssl_validation"`
+	PollInterval      time.Duration `yaml:"poll_interval"`
+	// StatsConcurrency is maximum number of processes stats requested at the same time on each poll
+	StatsConcurrency int `yaml:"stats_concurrency"`
+}
+
+type FileRouteSourceConfig struct {
+	Path string `yaml:"path"`
+	// PollInterval is interval to check if file has changed
+	PollInterval time.Duration `yaml:"poll_interval"`
+}
+
+type RoutesSnapshotConfig struct {
+	// Path of file where routing table is saved to be reloaded at start, disabled when empty
+	Path     string        `yaml:"path"`
+	Interval time.Duration `yaml:"interval"`
 }
 
 type Log struct {
@@ -69,20 +118,25 @@ type Log struct {
 	InJson  bool   `yaml:"in_json"`
 }
 
-func (c *Log) UnmarshalYAML(unmarshal func(interface{}) error) error {
-	type plain Log
-	err := unmarshal((*plain)(c))
-	if err != nil {
+func (c Log) validate() error {
+	if c.Level == "" {
+		return nil
+	}
+	_, err := log.ParseLevel(c.Level)
+	return err
+}
+
+// Apply sets level and format of logger, it is not done when parsing config
+// to let a config be checked without changing logger
+func (c Log) Apply() error {
+	if err := c.validate(); err != nil {
 		return err
 	}
 	log.SetFormatter(&log.TextFormatter{
 		DisableColors: c.NoColor,
 	})
 	if c.Level != "" {
-		lvl, err := log.ParseLevel(c.Level)
-		if err != nil {
-			return err
-		}
+		lvl, _ := log.ParseLevel(c.Level)
 		log.SetLevel(lvl)
 	}
 	if c.InJson {
@@ -92,6 +146,20 @@ func (c *Log) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	return nil
 }
 
+// ScrapeMetricsConfig chooses which app labels are set on scrape histograms,
+// they are disabled by default to keep number of series bounded
+type ScrapeMetricsConfig struct {
+	OrganizationLabel bool `yaml:"organization_label"`
+	SpaceLabel        bool `yaml:"space_label"`
+	AppLabel          bool `yaml:"app_label"`
+}
+
+// AdminConfig sets credentials of admin endpoints, they are disabled when user is not set
+type AdminConfig struct {
+	User string `yaml:"user"`
+	Pass string `yaml:"pass"`
+}
+
 type TLSPem struct {
 	CertChain  string `yaml:"cert_chain"`
 	PrivateKey string `yaml:"private_key"`
@@ -128,12 +196,31 @@ type Config struct {
 	SQLCnxMaxIdle         int      `yaml:"sql_cnx_max_idle"`
 	SQLCnxMaxOpen         int      `yaml:"sql_cnx_max_open"`
 	SQLCnxMaxLife         string   `yaml:"sql_cnx_max_life"`
-	NotExitWhenConnFailed bool     `yaml:"not_exit_when_conn_failed"`
+	NotExitWhenConnFailed bool     `yaml:"not_exit_when_conn_failed"` // Deprecated: promfetcher does not exit anymore when database is unreachable
+	DbAutoMigrate         bool     `yaml:"db_auto_migrate"`
 	DB                    *gorm.DB `yaml:"-"`
 
+	EndpointStore        EndpointStoreConfig  `yaml:"endpoint_store"`
+	Store                stores.EndpointStore `yaml:"-"`
+	EndpointCacheRefresh time.Duration        `yaml:"endpoint_cache_refresh_interval"`
+
+	RouteSource    RouteSourceConfig    `yaml:"route_source"`
+	RoutesSnapshot RoutesSnapshotConfig `yaml:"routes_snapshot"`
+
+	// ReadinessStableWindow is how long number of routes must not change before being ready
+	ReadinessStableWindow time.Duration `yaml:"readiness_stable_window"`
+	ReadinessMaxWait      time.Duration `yaml:"readiness_max_wait"`
+
 	BaseURL string `yaml:"base_url"`
 
 	ExternalExporters ExternalExporters `yaml:"external_exporters"`
+
+	ScrapeMetrics ScrapeMetricsConfig `yaml:"scrape_metrics"`
+
+	Admin AdminConfig `yaml:"admin"`
+
+	// source is yaml node tree of loaded config, it gives location of keys in errors
+	source *yaml3.Node
 }
 
 var defaultConfig = Config{
@@ -155,22 +242,48 @@ var defaultConfig = Config{
 	SQLCnxMaxIdle:               5,
 	SQLCnxMaxOpen:               10,
 	SQLCnxMaxLife:               "1h",
+	DbAutoMigrate:               true,
+	EndpointCacheRefresh:        time.Minute,
 	Broker:                      defaultBrokerConfig,
+	RouteSource:                 defaultRouteSourceConfig,
+	RoutesSnapshot:              RoutesSnapshotConfig{Interval: 30 * time.Second},
+	ReadinessStableWindow:       10 * time.Second,
+	ReadinessMaxWait:            2 * time.Minute,
 	BaseURL:                     "http://localhost:8085",
 }
 
 func DefaultConfig() (*Config, error) {
 	c := defaultConfig
+	c.Store = stores.NewMemoryStore()
 	return &c, nil
 }
 
 func (c *Config) Process() error {
+	if err := c.Validate(); err != nil {
+		return err
+	}
+	if err := c.gormDB(); err != nil {
+		return fmt.Errorf("error on creating db connexion: %s", err.Error())
+	}
+	if err := c.endpointStore(); err != nil {
+		return fmt.Errorf("error on creating endpoint store: %s", err.Error())
+	}
+	return nil
+}
+
+// Validate checks config and loads certificates, no connection is opened
+// so it can be used to check a config before reloading it.
+// Errors are located in config when it was loaded by Initialize.
+func (c *Config) Validate() error {
+	return c.locate(c.validate())
+}
+
+func (c *Config) validate() error {
 	c.BaseURL = strings.TrimSuffix(c.BaseURL, "/")
 	if c.Backends.CertChain != "" && c.Backends.PrivateKey != "" {
 		certificate, err := tls.X509KeyPair([]byte(c.Backends.CertChain), []byte(c.Backends.PrivateKey))
 		if err != nil {
-			errMsg := fmt.Sprintf("Error loading key pair: %s", err.Error())
-			return fmt.Errorf("error: %s", errMsg)
+			return fmt.Errorf("backends.private_key: error loading key pair: %s", err.Error())
 		}
 		c.Backends.ClientAuthCertificate = certificate
 	}
@@ -178,27 +291,25 @@ func (c *Config) Process() error {
 	if c.Nats.TLSEnabled {
 		certificate, err := tls.X509KeyPair([]byte(c.Nats.CertChain), []byte(c.Nats.PrivateKey))
 		if err != nil {
-			errMsg := fmt.Sprintf("Error loading NATS key pair: %s", err.Error())
-			return fmt.Errorf("error: %s", errMsg)
+			return fmt.Errorf("nats.private_key: error loading NATS key pair: %s", err.Error())
 		}
 		c.Nats.ClientAuthCertificate = certificate
 
 		certPool := x509.NewCertPool()
 		if ok := certPool.AppendCertsFromPEM([]byte(c.Nats.CACerts)); !ok {
-			return fmt.Errorf("error while adding CACerts to gorouter's routing-api cert pool: \n%s", c.Nats.CACerts)
+			return fmt.Errorf("nats.ca_certs: error while adding CACerts to gorouter's routing-api cert pool: \n%s", c.Nats.CACerts)
 		}
 		c.Nats.CAPool = certPool
 	}
 
 	if c.EnableSSL {
 		if c.TLSPEM.PrivateKey == "" || c.TLSPEM.CertChain == "" {
-			return fmt.Errorf("error parsing PEM blocks of router.tls_pem, missing cert or key")
+			return fmt.Errorf("tls_pem: error parsing PEM blocks of router.tls_pem, missing cert or key")
 		}
 
 		certificate, err := tls.X509KeyPair([]byte(c.TLSPEM.CertChain), []byte(c.TLSPEM.PrivateKey))
 		if err != nil {
-			errMsg := fmt.Sprintf("Error loading key pair: %s", err.Error())
-			return fmt.Errorf("error: %s", errMsg)
+			return fmt.Errorf("tls_pem.private_key: error loading key pair: %s", err.Error())
 		}
 		c.SSLCertificate = certificate
 	}
@@ -206,8 +317,69 @@ func (c *Config) Process() error {
 	if err := c.buildCertPool(); err != nil {
 		return err
 	}
-	if err := c.gormDB(); err != nil {
-		return fmt.Errorf("error on creating db connexion: %s", err.Error())
+	if err := c.Logging.validate(); err != nil {
+		return fmt.Errorf("logging.level: %s", err.Error())
+	}
+	if err := c.validateDB(); err != nil {
+		return err
+	}
+	if err := c.EndpointStore.validate(c.DbConn); err != nil {
+		return fmt.Errorf("endpoint_store.%s", err.Error())
+	}
+	if err := c.RouteSource.validate(); err != nil {
+		return fmt.Errorf("route_source.%s", err.Error())
+	}
+	return nil
+}
+
+// validate gives errors prefixed by their key, e.g. `type: ...`
+func (c RouteSourceConfig) validate() error {
+	switch c.Type {
+	case "", "nats":
+		return nil
+	case "cloud_controller":
+		if c.CloudController.APIURL == "" {
+			return fmt.Errorf("cloud_controller.api_url: must be set for cloud_controller route source")
+		}
+		if c.CloudController.ClientID == "" {
+			return fmt.Errorf("cloud_controller.client_id: must be set for cloud_controller route source")
+		}
+		return nil
+	case "file":
+		if c.File.Path == "" {
+			return fmt.Errorf("file.path: must be set for file route source")
+		}
+		return nil
+	}
+	return fmt.Errorf("type: route source type %s not found", c.Type)
+}
+
+func (c *Config) endpointStore() error {
+	var err error
+	switch c.EndpointStore.Type {
+	case "":
+		if c.DB == nil {
+			c.Store = stores.NewMemoryStore()
+			return nil
+		}
+		c.Store = stores.NewGormStore(c.DB)
+	case "database":
+		if c.DB == nil {
+			return fmt.Errorf("db_conn must be set for database store")
+		}
+		c.Store = stores.NewGormStore(c.DB)
+	case "memory":
+		c.Store = stores.NewMemoryStore()
+	case "file":
+		if c.EndpointStore.Path == "" {
+			return fmt.Errorf("path must be set for file store")
+		}
+		c.Store, err = stores.NewFileStore(c.EndpointStore.Path)
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("store type %s not found", c.EndpointStore.Type)
 	}
 	return nil
 }
@@ -216,10 +388,36 @@ func (c *Config) gormDB() error {
 	if c.DbConn == "" {
 		return nil
 	}
-	u, err := url.Parse(c.DbConn)
+	dialect, connStr, err := c.dbDialect()
 	if err != nil {
 		return err
 	}
+	// pool is opened without requiring database to be up, promfetcher then starts with database degraded
+	// and database monitor waits for it to be back
+	sqlDB, err := sql.Open(dialect, connStr)
+	if err != nil {
+		return err
+	}
+	c.DB, err = gorm.Open(dialect, sqlDB)
+	if err != nil {
+		log.Warnf("database is unreachable, starting without it: %s", err.Error())
+	}
+	dur, err := time.ParseDuration(c.SQLCnxMaxLife)
+	if err != nil {
+		return err
+	}
+	c.DB.DB().SetMaxIdleConns(c.SQLCnxMaxIdle)
+	c.DB.DB().SetMaxOpenConns(c.SQLCnxMaxOpen)
+	c.DB.DB().SetConnMaxLifetime(dur)
+	return nil
+}
+
+// dbDialect gives gorm dialect and connection string from db_conn url
+func (c *Config) dbDialect() (string, string, error) {
+	u, err := url.Parse(c.DbConn)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid db_conn: %s", err.Error())
+	}
 	user := ""
 	if u.User != nil {
 		user = u.User.Username()
@@ -235,33 +433,53 @@ func (c *Config) gormDB() error {
 		if user != "" {
 			user += "@"
 		}
-		connStr := fmt.Sprintf("%stcp(%s)%s%s", user, u.Host, u.Path, u.RawQuery)
-		c.DB, err = gorm.Open("mysql", connStr)
-		if err != nil {
-			return err
-		}
+		return "mysql", fmt.Sprintf("%stcp(%s)%s%s", user, u.Host, u.Path, u.RawQuery), nil
 	case "sqlite":
-		path := strings.TrimPrefix(u.Path, "/")
-		c.DB, err = gorm.Open("sqlite3", path)
-		if err != nil {
-			return err
-		}
+		return "sqlite3", strings.TrimPrefix(u.Path, "/"), nil
 	case "postgres":
-		c.DB, err = gorm.Open("postgres", u.String())
-		if err != nil {
-			return err
+		return "postgres", u.String(), nil
+	}
+	return "", "", fmt.Errorf("sgbd %s not found in db_conn, it must be one of mysql, mariadb, sqlite or postgres", u.Scheme)
+}
+
+// validateDB checks db_conn and sql settings without connecting to database
+func (c *Config) validateDB() error {
+	if c.DbConn != "" {
+		if _, _, err := c.dbDialect(); err != nil {
+			return fmt.Errorf("db_conn: %s", err.Error())
 		}
-	default:
-		return fmt.Errorf("sgbd not found")
 	}
-	dur, err := time.ParseDuration(c.SQLCnxMaxLife)
-	if err != nil {
-		return err
+	if _, err := time.ParseDuration(c.SQLCnxMaxLife); err != nil {
+		return fmt.Errorf("sql_cnx_max_life: %s", err.Error())
+	}
+	return nil
+}
+
+// Warnings gives settings which are valid but probably not wanted
+func (c *Config) Warnings() []string {
+	warnings := make([]string, 0)
+	if c.EndpointStore.Type == "" && c.DbConn == "" {
+		warnings = append(warnings, "no db_conn nor endpoint_store type set, memory endpoint store is used: "+
+			"bindings are lost on restart and not shared between instances (set endpoint_store type to memory to hide this warning)")
+	}
+	return warnings
+}
+
+// validate gives errors prefixed by their key, e.g. `type: ...`
+func (c EndpointStoreConfig) validate(dbConn string) error {
+	switch c.Type {
+	case "", "memory":
+	case "database":
+		if dbConn == "" {
+			return fmt.Errorf("type: db_conn must be set for database store")
+		}
+	case "file":
+		if c.Path == "" {
+			return fmt.Errorf("path: must be set for file store")
+		}
+	default:
+		return fmt.Errorf("type: store type %s not found", c.Type)
 	}
-	c.DB.DB().SetMaxIdleConns(c.SQLCnxMaxIdle)
-	c.DB.DB().SetMaxOpenConns(c.SQLCnxMaxOpen)
-	c.DB.DB().SetConnMaxLifetime(dur)
-	c.DB.AutoMigrate(&models.AppEndpoint{})
 	return nil
 }
 
@@ -273,24 +491,42 @@ func (c *Config) buildCertPool() error {
 
 	if c.CACerts != "" {
 		if ok := certPool.AppendCertsFromPEM([]byte(c.CACerts)); !ok {
-			return fmt.Errorf("error while adding CACerts to gorouter's cert pool: \n%s", c.CACerts)
+			return fmt.Errorf("ca_certs: error while adding CACerts to gorouter's cert pool: \n%s", c.CACerts)
 		}
 	}
 	c.CAPool = certPool
 	return nil
 }
 
+// Initialize loads config from yaml where ${VAR} are replaced by environment variables,
+// keys are then overridden by PROMFETCHER_* environment variables.
+// Unknown keys and type errors are rejected.
 func (c *Config) Initialize(configYAML []byte) error {
-	return yaml.Unmarshal(configYAML, &c)
+	source, err := parseSource(configYAML)
+	if err != nil {
+		return err
+	}
+	c.source = source
+	configYAML, err = interpolateEnv(configYAML, source)
+	if err != nil {
+		return err
+	}
+	err = yaml.UnmarshalStrict(configYAML, c)
+	if err != nil {
+		return c.locate(err)
+	}
+	return c.applyEnvOverrides()
 }
 
-func InitConfigFromFile(file *os.File) (*Config, error) {
+// LoadConfigFromFile reads and validates config without opening any connection,
+// it is used to reload config while promfetcher is running
+func LoadConfigFromFile(path string) (*Config, error) {
 	c, err := DefaultConfig()
 	if err != nil {
 		return nil, err
 	}
 
-	b, err := io.ReadAll(file)
+	b, err := os.ReadFile(path)
 	if err != nil {
 		return nil, err
 	}
@@ -300,6 +536,78 @@ func InitConfigFromFile(file *os.File) (*Config, error) {
 		return nil, err
 	}
 
+	err = c.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// CheckConfig parses and validates config without opening any connection
+func CheckConfig(configYAML []byte) (*Config, error) {
+	c, err := DefaultConfig()
+	if err != nil {
+		return nil, err
+	}
+	err = c.Initialize(configYAML)
+	if err != nil {
+		return nil, err
+	}
+	err = c.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Redacted gives a copy of config where secrets are hidden, it can be printed
+func (c Config) Redacted() Config {
+	c.Nats.Pass = redact(c.Nats.Pass)
+	c.Nats.PrivateKey = redact(c.Nats.PrivateKey)
+	c.TLSPEM.PrivateKey = redact(c.TLSPEM.PrivateKey)
+	c.Backends.PrivateKey = redact(c.Backends.PrivateKey)
+	c.Broker.Pass = redact(c.Broker.Pass)
+	c.Admin.Pass = redact(c.Admin.Pass)
+	c.RouteSource.CloudController.ClientSecret = redact(c.RouteSource.CloudController.ClientSecret)
+	c.ExternalExporters = c.ExternalExporters.redacted()
+	if u, err := url.Parse(c.DbConn); err == nil {
+		c.DbConn = u.Redacted()
+	} else if c.DbConn != "" {
+		c.DbConn = redactedValue
+	}
+	return c
+}
+
+const redactedValue = "<redacted>"
+
+func redact(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return redactedValue
+}
+
+func InitConfigFromFile(file *os.File) (*Config, error) {
+	b, err := io.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+	return InitConfig(b)
+}
+
+// InitConfig loads and processes config, default config overridden by environment is given when configYAML is empty
+func InitConfig(configYAML []byte) (*Config, error) {
+	c, err := DefaultConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.Initialize(configYAML)
+	if err != nil {
+		return nil, err
+	}
+
 	err = c.Process()
 	if err != nil {
 		return nil, err
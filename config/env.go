@@ -0,0 +1,270 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	yaml3 "go.yaml.in/yaml/v3"
+	"gopkg.in/yaml.v2"
+)
+
+// EnvPrefix is prefix of environment variables overriding config keys,
+// e.g. PROMFETCHER_NATS_PASS overrides pass in nats
+const EnvPrefix = "PROMFETCHER_"
+
+// envFileSuffix is suffix of environment variables giving a file to read value from
+const envFileSuffix = "_FILE"
+
+var envVarRegex = regexp.MustCompile(`\$?\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// interpolateEnv replaces ${VAR} in config values by value of environment variable VAR,
+// $${VAR} gives a literal ${VAR}. Comments are ignored and values are quoted when needed,
+// they are replaced in place to keep lines of config in errors. root is node tree parsed from config.
+func interpolateEnv(configYAML []byte, root *yaml3.Node) ([]byte, error) {
+	if !bytes.Contains(configYAML, []byte("${")) {
+		return configYAML, nil
+	}
+	replacements := make([]envReplacement, 0)
+	for _, n := range scalarNodes(root) {
+		value, err := interpolateValue(n.Value)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", n.Line, err.Error())
+		}
+		if value != n.Value {
+			replacements = append(replacements, envReplacement{node: n, value: value})
+		}
+	}
+	if len(replacements) == 0 {
+		return configYAML, nil
+	}
+	if result, ok := replaceInText(configYAML, replacements); ok {
+		return result, nil
+	}
+	return encodeReplaced(root, replacements)
+}
+
+type envReplacement struct {
+	node  *yaml3.Node
+	value string
+}
+
+func interpolateValue(value string) (string, error) {
+	var err error
+	result := envVarRegex.ReplaceAllStringFunc(value, func(match string) string {
+		if strings.HasPrefix(match, "$$") {
+			return match[1:]
+		}
+		name := envVarRegex.FindStringSubmatch(match)[1]
+		envValue, ok := os.LookupEnv(name)
+		if !ok && err == nil {
+			err = fmt.Errorf("environment variable %s used in config is not set", name)
+		}
+		return envValue
+	})
+	return result, err
+}
+
+// scalarNodes gives scalars of yaml document, keys included, aliases are not followed
+func scalarNodes(n *yaml3.Node) []*yaml3.Node {
+	if n.Kind == yaml3.ScalarNode {
+		return []*yaml3.Node{n}
+	}
+	if n.Kind == yaml3.AliasNode {
+		return nil
+	}
+	scalars := make([]*yaml3.Node, 0)
+	for _, child := range n.Content {
+		scalars = append(scalars, scalarNodes(child)...)
+	}
+	return scalars
+}
+
+// replaceInText replaces scalars written on a single line by their interpolated value,
+// it is not ok when a scalar spans multiple lines, e.g. a block scalar
+func replaceInText(configYAML []byte, replacements []envReplacement) ([]byte, bool) {
+	lines := strings.Split(string(configYAML), "\n")
+	// replacing from the end keeps positions of scalars not replaced yet
+	sort.Slice(replacements, func(i, j int) bool {
+		a, b := replacements[i].node, replacements[j].node
+		if a.Line != b.Line {
+			return a.Line > b.Line
+		}
+		return a.Column > b.Column
+	})
+	for _, r := range replacements {
+		if r.node.Line < 1 || r.node.Line > len(lines) {
+			return nil, false
+		}
+		line := []rune(lines[r.node.Line-1])
+		start := r.node.Column - 1
+		end, ok := scalarEnd(line, start, r.node)
+		if !ok {
+			return nil, false
+		}
+		value := strconv.Quote(r.value)
+		if r.node.Style == 0 && isPlain(r.value) {
+			value = r.value
+		}
+		lines[r.node.Line-1] = string(line[:start]) + value + string(line[end:])
+	}
+	return []byte(strings.Join(lines, "\n")), true
+}
+
+// scalarEnd gives position following scalar starting at start in line
+func scalarEnd(line []rune, start int, n *yaml3.Node) (int, bool) {
+	if start < 0 || start >= len(line) {
+		return 0, false
+	}
+	switch n.Style {
+	case 0:
+		end := start + len([]rune(n.Value))
+		if end > len(line) || string(line[start:end]) != n.Value {
+			return 0, false
+		}
+		return end, true
+	case yaml3.DoubleQuotedStyle:
+		if line[start] != '"' {
+			return 0, false
+		}
+		for i := start + 1; i < len(line); i++ {
+			switch line[i] {
+			case '\\':
+				i++
+			case '"':
+				return i + 1, true
+			}
+		}
+	case yaml3.SingleQuotedStyle:
+		if line[start] != '\'' {
+			return 0, false
+		}
+		for i := start + 1; i < len(line); i++ {
+			if line[i] != '\'' {
+				continue
+			}
+			if i+1 < len(line) && line[i+1] == '\'' {
+				i++
+				continue
+			}
+			return i + 1, true
+		}
+	}
+	return 0, false
+}
+
+// isPlain is true when value is read back as is without quotes, e.g. a number or a hostname,
+// it is then kept unquoted to be decoded as other values
+func isPlain(value string) bool {
+	if strings.ContainsAny(value, "\n\r,[]{}") {
+		return false
+	}
+	doc := &yaml3.Node{}
+	if err := yaml3.Unmarshal([]byte(value), doc); err != nil || len(doc.Content) != 1 {
+		return false
+	}
+	n := doc.Content[0]
+	return n.Kind == yaml3.ScalarNode && n.Style == 0 && n.Value == value
+}
+
+// encodeReplaced gives config encoded again with interpolated values, lines of config may change
+func encodeReplaced(root *yaml3.Node, replacements []envReplacement) ([]byte, error) {
+	for _, r := range replacements {
+		r.node.Value = r.value
+		if r.node.Style == 0 {
+			// plain values are resolved again, e.g. as a number
+			r.node.Tag = ""
+		}
+	}
+	buf := &bytes.Buffer{}
+	encoder := yaml3.NewEncoder(buf)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(root); err != nil {
+		return nil, err
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// applyEnvOverrides sets config keys from environment variables named after their yaml path,
+// value is read from a file when variable is suffixed by _FILE
+func (c *Config) applyEnvOverrides() error {
+	return applyEnvOverrides(reflect.ValueOf(c).Elem(), EnvPrefix, "")
+}
+
+func applyEnvOverrides(v reflect.Value, envPrefix, keyPrefix string) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		tag := strings.Split(field.Tag.Get("yaml"), ",")
+		name := tag[0]
+		if name == "-" {
+			continue
+		}
+		fieldValue := v.Field(i)
+		if len(tag) > 1 && tag[1] == "inline" {
+			if err := applyEnvOverrides(fieldValue, envPrefix, keyPrefix); err != nil {
+				return err
+			}
+			continue
+		}
+		if name == "" {
+			name = strings.ToLower(field.Name)
+		}
+		envName := envPrefix + strings.ToUpper(name)
+		key := keyPrefix + name
+
+		value, ok, err := lookupEnv(envName)
+		if err != nil {
+			return err
+		}
+		if ok {
+			if err := setFromEnv(fieldValue, value); err != nil {
+				return fmt.Errorf("error when setting %s from environment: %s", key, err.Error())
+			}
+			continue
+		}
+		if fieldValue.Kind() == reflect.Struct {
+			if err := applyEnvOverrides(fieldValue, envName+"_", key+"."); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// lookupEnv gives value of environment variable or content of file given by its _FILE variant
+func lookupEnv(envName string) (string, bool, error) {
+	value, ok := os.LookupEnv(envName)
+	path, okFile := os.LookupEnv(envName + envFileSuffix)
+	if ok && okFile {
+		return "", false, fmt.Errorf("only one of %s and %s must be set", envName, envName+envFileSuffix)
+	}
+	if !okFile {
+		return value, ok, nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", false, fmt.Errorf("error when reading %s: %s", envName+envFileSuffix, err.Error())
+	}
+	return strings.TrimRight(string(b), "\r\n"), true, nil
+}
+
+// setFromEnv sets strings as is, other values are parsed as yaml
+func setFromEnv(v reflect.Value, value string) error {
+	if v.Kind() == reflect.String {
+		v.SetString(value)
+		return nil
+	}
+	return yaml.Unmarshal([]byte(value), v.Addr().Interface())
+}
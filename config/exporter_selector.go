@@ -0,0 +1,104 @@
+package config
+
+import (
+	"fmt"
+	"maps"
+	"path"
+	"reflect"
+	"slices"
+	"strings"
+
+	"github.com/orange-cloudfoundry/promfetcher/models"
+)
+
+// ExporterSelector restricts apps an external exporter is applied to,
+// an app is selected when it matches one pattern of each set criteria and every tags matchers.
+// Patterns are globs as in path.Match, e.g. `rabbitmq-*`
+type ExporterSelector struct {
+	Organizations []string          `yaml:"organizations"`
+	Spaces        []string          `yaml:"spaces"`
+	Apps          []string          `yaml:"apps"`
+	AppGUIDs      []string          `yaml:"app_guids"`
+	Tags          map[string]string `yaml:"tags"`
+}
+
+// validate checks patterns and tags, errors are prefixed by their key, e.g. `spaces: ...`
+func (s *ExporterSelector) validate() error {
+	criteria := []struct {
+		key      string
+		patterns []string
+	}{
+		{"organizations", s.Organizations},
+		{"spaces", s.Spaces},
+		{"apps", s.Apps},
+		{"app_guids", s.AppGUIDs},
+	}
+	for _, criterion := range criteria {
+		for _, pattern := range criterion.patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("%s: invalid pattern %q in selector: %s", criterion.key, pattern, err.Error())
+			}
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(s.Tags)) {
+		if _, ok := tagValue(models.Tags{}, name); !ok {
+			return fmt.Errorf("tags.%s: unknown tag %s in selector", name, name)
+		}
+		if _, err := path.Match(s.Tags[name], ""); err != nil {
+			return fmt.Errorf("tags.%s: invalid pattern %q in selector: %s", name, s.Tags[name], err.Error())
+		}
+	}
+	return nil
+}
+
+// Selects is true when app with given tags is selected, a nil selector selects every apps
+func (s *ExporterSelector) Selects(tags models.Tags) bool {
+	if s == nil {
+		return true
+	}
+	if !matchAny(s.Organizations, tags.OrganizationName) ||
+		!matchAny(s.Spaces, tags.SpaceName) ||
+		!matchAny(s.Apps, tags.AppName) ||
+		!matchAny(s.AppGUIDs, tags.AppID) {
+		return false
+	}
+	for name, pattern := range s.Tags {
+		value, _ := tagValue(tags, name)
+		if !match(pattern, value) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchAny is true when value matches one of patterns or when there is no pattern
+func matchAny(patterns []string, value string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if match(pattern, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// match is path.Match where patterns have already been checked when loading config
+func match(pattern, value string) bool {
+	ok, _ := path.Match(pattern, value)
+	return ok
+}
+
+// tagValue gives value of a tag by its json name, e.g. process_type
+func tagValue(tags models.Tags, name string) (string, bool) {
+	v := reflect.ValueOf(tags)
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		jsonName, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if jsonName == name {
+			return v.Field(i).String(), true
+		}
+	}
+	return "", false
+}
@@ -2,10 +2,23 @@ package config
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
 	"fmt"
+	"io"
+	"maps"
+	"net/http"
 	"net/url"
+	"os"
+	"slices"
 	"strings"
 	txttpl "text/template"
+	"time"
+
+	"gopkg.in/yaml.v2"
 
 	"github.com/orange-cloudfoundry/promfetcher/models"
 )
@@ -14,27 +27,124 @@ type ExternalExporters []*ExternalExporter
 
 type ExternalExporter struct {
 	Name        string                     `yaml:"name"`
-	Host        string                     `yaml:"host"`
-	MetricsPath string                     `yaml:"metrics_path"`
+	Host        ValueTemplate              `yaml:"host"`
+	MetricsPath ValueTemplate              `yaml:"metrics_path"`
 	Scheme      string                     `yaml:"scheme"`
 	Params      map[string][]ValueTemplate `yaml:"params"`
 	IsTls       bool                       `yaml:"-"`
+	// apps external exporter is applied to, all apps when not set
+	Selector *ExporterSelector `yaml:"selector"`
+
+	// client settings, backends settings are used when not set
+	BasicAuth       *BasicAuth               `yaml:"basic_auth"`
+	BearerToken     string                   `yaml:"bearer_token"`
+	BearerTokenFile string                   `yaml:"bearer_token_file"`
+	Headers         map[string]ValueTemplate `yaml:"headers"`
+	TLS             *ExporterTLSConfig       `yaml:"tls"`
+	Timeout         time.Duration            `yaml:"timeout"`
+	tlsConfig       *tls.Config
+
+	// results are cached for cache_ttl, then given while refreshed in background for cache_max_stale
+	CacheTTL      time.Duration `yaml:"cache_ttl"`
+	CacheMaxStale time.Duration `yaml:"cache_max_stale"`
+}
+
+type BasicAuth struct {
+	Username     string `yaml:"username"`
+	Password     string `yaml:"password"`
+	PasswordFile string `yaml:"password_file"`
+}
+
+// ExporterTLSConfig is tls config of an external exporter, client certificate is set with cert_chain and private_key
+type ExporterTLSConfig struct {
+	CACerts            string `yaml:"ca_certs"`
+	ServerName         string `yaml:"server_name"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+	TLSPem             `yaml:",inline"`
+}
+
+// redacted gives a copy of external exporters where credentials are hidden
+func (ees ExternalExporters) redacted() ExternalExporters {
+	if ees == nil {
+		return nil
+	}
+	redactedEes := make(ExternalExporters, len(ees))
+	for i, ee := range ees {
+		redactedEe := *ee
+		redactedEe.BearerToken = redact(redactedEe.BearerToken)
+		if ee.BasicAuth != nil {
+			basicAuth := *ee.BasicAuth
+			basicAuth.Password = redact(basicAuth.Password)
+			redactedEe.BasicAuth = &basicAuth
+		}
+		if ee.TLS != nil {
+			tlsConfig := *ee.TLS
+			tlsConfig.PrivateKey = redact(tlsConfig.PrivateKey)
+			redactedEe.TLS = &tlsConfig
+		}
+		if ee.Headers != nil {
+			redactedEe.Headers = make(map[string]ValueTemplate, len(ee.Headers))
+			for k, v := range ee.Headers {
+				if strings.EqualFold(k, "Authorization") {
+					v = ValueTemplate{Raw: redact(v.Raw)}
+				}
+				redactedEe.Headers[k] = v
+			}
+		}
+		redactedEes[i] = &redactedEe
+	}
+	return redactedEes
+}
+
+// exporterItem keeps error of an external exporter to give it with exporter position in list
+type exporterItem struct {
+	exporter *ExternalExporter
+	err      error
+}
+
+func (i *exporterItem) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	i.exporter = &ExternalExporter{}
+	i.err = unmarshal(i.exporter)
+	if _, ok := i.err.(*yaml.TypeError); ok {
+		// type errors already give their line
+		return i.err
+	}
+	return nil
+}
+
+// UnmarshalYAML gives errors of external exporters prefixed by their key path, e.g. `external_exporters[0].host: ...`
+func (ees *ExternalExporters) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var items []exporterItem
+	err := unmarshal(&items)
+	if err != nil {
+		return err
+	}
+	exporters := make(ExternalExporters, len(items))
+	for i, item := range items {
+		if item.err != nil {
+			return fmt.Errorf("external_exporters[%d].%s", i, item.err.Error())
+		}
+		exporters[i] = item.exporter
+	}
+	*ees = exporters
+	return nil
 }
 
+// UnmarshalYAML gives errors prefixed by their key, e.g. `host: ...`
 func (ee *ExternalExporter) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	type plain ExternalExporter
 	err := unmarshal((*plain)(ee))
 	if err != nil {
 		return err
 	}
-	if ee.Host == "" {
-		return fmt.Errorf("host must be provided on external exporter")
+	if ee.Host.Raw == "" {
+		return fmt.Errorf("host: must be provided on external exporter")
 	}
-	if ee.MetricsPath == "" {
-		ee.MetricsPath = "/metrics"
+	if ee.MetricsPath.Raw == "" {
+		ee.MetricsPath = ValueTemplate{Raw: "/metrics"}
 	}
 	if ee.Name == "" {
-		ee.Name = ee.Host + ee.MetricsPath
+		ee.Name = ee.Host.Raw + ee.MetricsPath.Raw
 	}
 	if ee.Scheme == "" {
 		ee.Scheme = "http"
@@ -42,24 +152,154 @@ func (ee *ExternalExporter) UnmarshalYAML(unmarshal func(interface{}) error) err
 	if ee.Scheme == "https" {
 		ee.IsTls = true
 	}
+	if ee.BearerToken != "" && ee.BearerTokenFile != "" {
+		return fmt.Errorf("bearer_token_file: only one of bearer_token and bearer_token_file must be set on external exporter %s", ee.Name)
+	}
+	if ee.BasicAuth != nil && (ee.BearerToken != "" || ee.BearerTokenFile != "") {
+		return fmt.Errorf("basic_auth: only one of basic_auth and bearer token must be set on external exporter %s", ee.Name)
+	}
+	if ee.BasicAuth != nil && ee.BasicAuth.Password != "" && ee.BasicAuth.PasswordFile != "" {
+		return fmt.Errorf("basic_auth.password_file: only one of password and password_file must be set on external exporter %s", ee.Name)
+	}
+	if ee.CacheTTL < 0 || ee.CacheMaxStale < 0 {
+		return fmt.Errorf("cache_ttl: cache_ttl and cache_max_stale must not be negative on external exporter %s", ee.Name)
+	}
+	if ee.CacheTTL > 0 && ee.CacheMaxStale == 0 {
+		ee.CacheMaxStale = ee.CacheTTL
+	}
+	if ee.TLS != nil {
+		ee.tlsConfig, err = ee.TLS.tlsConfig()
+		if err != nil {
+			return fmt.Errorf("tls.%s", err.Error())
+		}
+	}
+	if ee.Selector != nil {
+		if err := ee.Selector.validate(); err != nil {
+			return fmt.Errorf("selector.%s", err.Error())
+		}
+	}
+	return ee.parseTemplates()
+}
 
+// parseTemplates parses templated values, errors are prefixed by their key, e.g. `headers.X-App: ...`
+func (ee *ExternalExporter) parseTemplates() error {
+	if err := ee.Host.parse(); err != nil {
+		return fmt.Errorf("host: %s", err.Error())
+	}
+	if err := ee.MetricsPath.parse(); err != nil {
+		return fmt.Errorf("metrics_path: %s", err.Error())
+	}
+	for _, key := range slices.Sorted(maps.Keys(ee.Params)) {
+		for i := range ee.Params[key] {
+			if err := ee.Params[key][i].parse(); err != nil {
+				return fmt.Errorf("params.%s[%d]: %s", key, i, err.Error())
+			}
+		}
+	}
+	for _, key := range slices.Sorted(maps.Keys(ee.Headers)) {
+		valueTpl := ee.Headers[key]
+		if err := valueTpl.parse(); err != nil {
+			return fmt.Errorf("headers.%s: %s", key, err.Error())
+		}
+		ee.Headers[key] = valueTpl
+	}
 	return nil
 }
 
+func (c ExporterTLSConfig) tlsConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: c.InsecureSkipVerify,
+	}
+	if c.CACerts != "" {
+		certPool, err := x509.SystemCertPool()
+		if err != nil {
+			certPool = x509.NewCertPool()
+		}
+		if ok := certPool.AppendCertsFromPEM([]byte(c.CACerts)); !ok {
+			return nil, fmt.Errorf("ca_certs: error while adding ca_certs to cert pool")
+		}
+		tlsConfig.RootCAs = certPool
+	}
+	if c.CertChain != "" || c.PrivateKey != "" {
+		certificate, err := tls.X509KeyPair([]byte(c.CertChain), []byte(c.PrivateKey))
+		if err != nil {
+			return nil, fmt.Errorf("private_key: error loading key pair: %s", err.Error())
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+	return tlsConfig, nil
+}
+
 func (ee *ExternalExporter) ToRoute(tags models.Tags) (*models.Route, error) {
 	urlValues, err := ee.ParamsToURLValues(tags)
 	if err != nil {
 		return nil, fmt.Errorf("error on external exporter `%s`: %s", ee.Name, err.Error())
 	}
-	return &models.Route{
+	headers, err := ee.RequestHeaders(tags)
+	if err != nil {
+		return nil, fmt.Errorf("error on external exporter `%s`: %s", ee.Name, err.Error())
+	}
+	host, err := ee.Host.ResolveTags(tags)
+	if err != nil {
+		return nil, fmt.Errorf("error on host of external exporter `%s`: %s", ee.Name, err.Error())
+	}
+	metricsPath, err := ee.MetricsPath.ResolveTags(tags)
+	if err != nil {
+		return nil, fmt.Errorf("error on metrics path of external exporter `%s`: %s", ee.Name, err.Error())
+	}
+	route := &models.Route{
 		PrivateInstanceID: ee.Name,
 		Tags:              tags,
-		Address:           ee.Host,
+		Address:           host,
 		TLS:               ee.IsTls,
 		URLParams:         urlValues,
-		MetricsPath:       ee.MetricsPath,
-		Host:              ee.Host,
-	}, nil
+		MetricsPath:       metricsPath,
+		Host:              host,
+		Headers:           headers,
+		Timeout:           ee.Timeout,
+		TLSConfig:         ee.tlsConfig,
+	}
+	if ee.TLS != nil {
+		route.ServerCertDomainSan = ee.TLS.ServerName
+	}
+	return route, nil
+}
+
+// RequestHeaders gives headers sent to external exporter with templated values resolved,
+// credentials files are read on each call to follow their rotation
+func (ee *ExternalExporter) RequestHeaders(tags models.Tags) (http.Header, error) {
+	headers := make(http.Header)
+	for key, valueTpl := range ee.Headers {
+		value, err := valueTpl.ResolveTags(tags)
+		if err != nil {
+			return nil, err
+		}
+		headers.Set(key, value)
+	}
+	if ee.BasicAuth != nil {
+		password := ee.BasicAuth.Password
+		if ee.BasicAuth.PasswordFile != "" {
+			b, err := os.ReadFile(ee.BasicAuth.PasswordFile)
+			if err != nil {
+				return nil, err
+			}
+			password = strings.TrimRight(string(b), "\r\n")
+		}
+		auth := base64.StdEncoding.EncodeToString([]byte(ee.BasicAuth.Username + ":" + password))
+		headers.Set("Authorization", "Basic "+auth)
+	}
+	token := ee.BearerToken
+	if ee.BearerTokenFile != "" {
+		b, err := os.ReadFile(ee.BearerTokenFile)
+		if err != nil {
+			return nil, err
+		}
+		token = strings.TrimRight(string(b), "\r\n")
+	}
+	if token != "" {
+		headers.Set("Authorization", "Bearer "+token)
+	}
+	return headers, nil
 }
 
 func (ee *ExternalExporter) ParamsToURLValues(tags models.Tags) (url.Values, error) {
@@ -78,29 +318,60 @@ func (ee *ExternalExporter) ParamsToURLValues(tags models.Tags) (url.Values, err
 	return urlValue, nil
 }
 
+// templateFuncs are functions usable in templates in addition to text/template ones
+var templateFuncs = txttpl.FuncMap{
+	"lower": strings.ToLower,
+	"upper": strings.ToUpper,
+	// replace is made to be used in pipelines, e.g. {{ .AppName | replace "_" "-" }}
+	"replace": func(old, new, s string) string {
+		return strings.ReplaceAll(s, old, new)
+	},
+	// hash gives first 16 hexadecimal characters of sha256 of a value, it can be used in a hostname
+	"hash": func(s string) string {
+		sum := sha256.Sum256([]byte(s))
+		return hex.EncodeToString(sum[:])[:16]
+	},
+}
+
+// ValueTemplate is a value which can be a text/template rendered with app tags
 type ValueTemplate struct {
 	Raw string
 	tpl *txttpl.Template
 }
 
 func (vt *ValueTemplate) UnmarshalYAML(unmarshal func(interface{}) error) error {
-	rawString := ""
-	err := unmarshal(&rawString)
-	if err != nil {
-		return err
-	}
-	vt.Raw = rawString
+	return unmarshal(&vt.Raw)
+}
+
+// parse loads value as a template when it contains an action, it is done by external exporter
+// to give errors with their key
+func (vt *ValueTemplate) parse() error {
 	if !strings.Contains(vt.Raw, "{{") {
 		return nil
 	}
 
-	vt.tpl, err = txttpl.New("").Parse(vt.Raw)
+	var err error
+	vt.tpl, err = txttpl.New("").Funcs(templateFuncs).Parse(vt.Raw)
 	if err != nil {
-		return err
+		return fmt.Errorf("invalid template %q: %s", vt.Raw, err.Error())
+	}
+	// unknown tags are only found when executing template
+	err = vt.tpl.Execute(io.Discard, models.Tags{})
+	if err != nil {
+		return fmt.Errorf("invalid template %q: %s", vt.Raw, err.Error())
 	}
 	return nil
 }
 
+// IsTemplate is true when value depends on app tags
+func (vt ValueTemplate) IsTemplate() bool {
+	return vt.tpl != nil
+}
+
+func (vt ValueTemplate) MarshalYAML() (interface{}, error) {
+	return vt.Raw, nil
+}
+
 func (vt *ValueTemplate) ResolveTags(tags models.Tags) (string, error) {
 	if vt.tpl == nil {
 		return vt.Raw, nil
@@ -0,0 +1,226 @@
+package config_test
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/orange-cloudfoundry/promfetcher/config"
+	"github.com/orange-cloudfoundry/promfetcher/models"
+)
+
+var _ = Describe("ExternalExporter", func() {
+	tags := models.Tags{
+		AppID:   "d245c244-1875-a718-1248-2547e141a45c",
+		AppName: "myapp",
+	}
+
+	loadExporter := func(configYAML string) *config.ExternalExporter {
+		c, err := config.CheckConfig([]byte(configYAML))
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(c.ExternalExporters).To(HaveLen(1))
+		return c.ExternalExporters[0]
+	}
+
+	Context("ToRoute", func() {
+		It("sets headers and timeout", func() {
+			ee := loadExporter(`
+external_exporters:
+- host: exporter.example.net
+  timeout: 5s
+  headers:
+    X-Scope: "{{ .AppName }}"
+  basic_auth:
+    username: user
+    password: secret
+`)
+			route, err := ee.ToRoute(tags)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(route.Timeout).To(Equal(5 * time.Second))
+			Expect(route.Headers.Get("X-Scope")).To(Equal("myapp"))
+			Expect(route.Headers.Get("Authorization")).To(Equal("Basic dXNlcjpzZWNyZXQ="))
+			Expect(route.TLSConfig).To(BeNil())
+		})
+
+		It("reads bearer token from file on each route", func() {
+			tokenFile := filepath.Join(GinkgoT().TempDir(), "token")
+			Expect(os.WriteFile(tokenFile, []byte("first-token\n"), 0600)).To(Succeed())
+			ee := loadExporter(`
+external_exporters:
+- host: exporter.example.net
+  bearer_token_file: ` + tokenFile + `
+`)
+			route, err := ee.ToRoute(tags)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(route.Headers.Get("Authorization")).To(Equal("Bearer first-token"))
+
+			Expect(os.WriteFile(tokenFile, []byte("second-token"), 0600)).To(Succeed())
+			route, err = ee.ToRoute(tags)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(route.Headers.Get("Authorization")).To(Equal("Bearer second-token"))
+		})
+
+		It("fails when token file is missing", func() {
+			ee := loadExporter(`
+external_exporters:
+- host: exporter.example.net
+  bearer_token_file: /not/exists
+`)
+			_, err := ee.ToRoute(tags)
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("sets tls config", func() {
+			ee := loadExporter(`
+external_exporters:
+- host: exporter.example.net
+  scheme: https
+  tls:
+    server_name: exporter.internal
+    insecure_skip_verify: true
+`)
+			route, err := ee.ToRoute(tags)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(route.TLS).To(BeTrue())
+			Expect(route.ServerCertDomainSan).To(Equal("exporter.internal"))
+			Expect(route.TLSConfig).ToNot(BeNil())
+			Expect(route.TLSConfig.InsecureSkipVerify).To(BeTrue())
+		})
+	})
+
+	Context("Cache", func() {
+		It("is disabled by default", func() {
+			ee := loadExporter("external_exporters:\n- host: localhost\n")
+			Expect(ee.CacheTTL).To(BeZero())
+			Expect(ee.CacheMaxStale).To(BeZero())
+		})
+
+		It("gives stale results for cache ttl by default", func() {
+			ee := loadExporter("external_exporters:\n- host: localhost\n  cache_ttl: 5m\n")
+			Expect(ee.CacheTTL).To(Equal(5 * time.Minute))
+			Expect(ee.CacheMaxStale).To(Equal(5 * time.Minute))
+		})
+
+		It("sets max stale", func() {
+			ee := loadExporter("external_exporters:\n- host: localhost\n  cache_ttl: 5m\n  cache_max_stale: 1h\n")
+			Expect(ee.CacheMaxStale).To(Equal(time.Hour))
+		})
+	})
+
+	Context("Templates", func() {
+		It("renders host and metrics path from tags", func() {
+			ee := loadExporter(`
+external_exporters:
+- name: db-exporter
+  host: "{{ .AppName | replace \"app\" \"db\" | upper | lower }}.exporters.internal:9187"
+  metrics_path: "/metrics/{{ .AppID | hash }}"
+`)
+			Expect(ee.Host.IsTemplate()).To(BeTrue())
+			route, err := ee.ToRoute(tags)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(route.Address).To(Equal("mydb.exporters.internal:9187"))
+			Expect(route.Host).To(Equal("mydb.exporters.internal:9187"))
+			Expect(route.MetricsPath).To(Equal("/metrics/15df94ab41cf449c"))
+		})
+
+		It("renders header values from tags", func() {
+			ee := loadExporter(`
+external_exporters:
+- host: exporter.example.net
+  headers:
+    X-App: "{{ lower .AppName }}"
+`)
+			route, err := ee.ToRoute(models.Tags{AppName: "MyApp"})
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(route.Headers.Get("X-App")).To(Equal("myapp"))
+		})
+	})
+
+	Context("Selector", func() {
+		appTags := models.Tags{
+			ProcessType:      "web",
+			AppID:            "d245c244-1875-a718-1248-2547e141a45c",
+			AppName:          "orders-api",
+			SpaceName:        "rabbitmq-prod",
+			OrganizationName: "shop",
+		}
+
+		It("selects every apps when not set", func() {
+			ee := loadExporter("external_exporters:\n- host: localhost\n")
+			Expect(ee.Selector.Selects(appTags)).To(BeTrue())
+		})
+
+		DescribeTable("selection",
+			func(selectorYAML string, selected bool) {
+				ee := loadExporter("external_exporters:\n- host: localhost\n  selector: " + selectorYAML + "\n")
+				Expect(ee.Selector.Selects(appTags)).To(Equal(selected))
+			},
+			Entry("space glob", "{spaces: [rabbitmq-*]}", true),
+			Entry("space glob not matching", "{spaces: [redis-*]}", false),
+			Entry("one of organizations", "{organizations: [bank, shop]}", true),
+			Entry("app name", "{apps: [orders-*]}", true),
+			Entry("app guid", "{app_guids: [d245c244-1875-a718-1248-2547e141a45c]}", true),
+			Entry("other app guid", "{app_guids: [9a3a1a3e-8b8c-4f2c-a0e4-3c6b8a2e1f10]}", false),
+			Entry("all criteria matching", "{spaces: [rabbitmq-*], apps: [orders-api]}", true),
+			Entry("one criterion not matching", "{spaces: [rabbitmq-*], apps: [billing-*]}", false),
+			Entry("tag matcher", "{tags: {process_type: web}}", true),
+			Entry("tag matcher not matching", "{tags: {process_type: worker}}", false),
+		)
+	})
+
+	DescribeTable("invalid selectors",
+		func(configYAML string, expectedErr string) {
+			_, err := config.CheckConfig([]byte(configYAML))
+			Expect(err).To(MatchError(ContainSubstring(expectedErr)))
+		},
+		Entry("bad pattern", "external_exporters:\n- host: localhost\n  selector: {spaces: [\"rabbitmq-[\"]}\n", "external_exporters[0].selector.spaces: invalid pattern \"rabbitmq-[\" in selector"),
+		Entry("bad tag pattern", "external_exporters:\n- host: localhost\n  selector: {tags: {app_name: \"[\"}}\n", "external_exporters[0].selector.tags.app_name: invalid pattern"),
+		Entry("unknown tag", "external_exporters:\n- host: localhost\n  selector: {tags: {process: web}}\n", "external_exporters[0].selector.tags.process: unknown tag process in selector"),
+		Entry("unknown key", "external_exporters:\n- host: localhost\n  selector: {space: [prod]}\n", "field space not found"),
+	)
+
+	DescribeTable("invalid templates",
+		func(configYAML string, expectedKey string) {
+			_, err := config.CheckConfig([]byte(configYAML))
+			Expect(err).To(MatchError(ContainSubstring(expectedKey + ": invalid template")))
+		},
+		Entry("unknown tag in host", "external_exporters:\n- host: \"{{ .AppNam }}:9100\"\n", "external_exporters[0].host"),
+		Entry("unknown function in metrics path", "external_exporters:\n- host: localhost\n  metrics_path: \"/{{ sha1 .AppID }}\"\n", "external_exporters[0].metrics_path"),
+		Entry("unclosed action in header", "external_exporters:\n- host: localhost\n  headers:\n    X-App: \"{{ .AppName\"\n", "external_exporters[0].headers.X-App"),
+		Entry("error in second exporter", "external_exporters:\n- host: localhost\n- host: \"{{ .AppNam }}\"\n", "external_exporters[1].host"),
+	)
+
+	DescribeTable("invalid client settings",
+		func(configYAML string, expectedErr string) {
+			_, err := config.CheckConfig([]byte(configYAML))
+			Expect(err).To(MatchError(ContainSubstring(expectedErr)))
+		},
+		Entry("token and token file", "external_exporters:\n- host: localhost\n  bearer_token: a\n  bearer_token_file: /a\n", "external_exporters[0].bearer_token_file: only one of bearer_token and bearer_token_file"),
+		Entry("basic auth and token", "external_exporters:\n- host: localhost\n  bearer_token: a\n  basic_auth: {username: u}\n", "external_exporters[0].basic_auth: only one of basic_auth and bearer token"),
+		Entry("password and password file", "external_exporters:\n- host: localhost\n  basic_auth: {username: u, password: p, password_file: /p}\n", "external_exporters[0].basic_auth.password_file: only one of password and password_file"),
+		Entry("invalid ca", "external_exporters:\n- host: localhost\n  tls: {ca_certs: nope}\n", "external_exporters[0].tls.ca_certs: error while adding ca_certs"),
+		Entry("invalid key pair", "external_exporters:\n- host: localhost\n  tls: {cert_chain: nope, private_key: nope}\n", "external_exporters[0].tls.private_key: error loading key pair"),
+		Entry("invalid timeout", "external_exporters:\n- host: localhost\n  timeout: forever\n", "cannot unmarshal"),
+		Entry("negative cache ttl", "external_exporters:\n- host: localhost\n  cache_ttl: -1m\n", "external_exporters[0].cache_ttl: cache_ttl and cache_max_stale must not be negative"),
+	)
+
+	It("redacts credentials", func() {
+		c, err := config.CheckConfig([]byte(`
+external_exporters:
+- host: exporter.example.net
+  bearer_token: my-token
+  headers:
+    authorization: Bearer other
+    X-Scope: myscope
+`))
+		Expect(err).ShouldNot(HaveOccurred())
+		redacted := c.Redacted().ExternalExporters[0]
+		Expect(redacted.BearerToken).To(Equal("<redacted>"))
+		Expect(redacted.Headers["authorization"].Raw).To(Equal("<redacted>"))
+		Expect(redacted.Headers["X-Scope"].Raw).To(Equal("myscope"))
+		Expect(c.ExternalExporters[0].BearerToken).To(Equal("my-token"))
+	})
+})
@@ -0,0 +1,90 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	yaml3 "go.yaml.in/yaml/v3"
+)
+
+// keyPathRegex matches key path prefixing an error, e.g. `external_exporters[0].tls.private_key: `
+var keyPathRegex = regexp.MustCompile(`^([A-Za-z0-9_-]+(?:\[[0-9]+\])*(?:\.[A-Za-z0-9_-]+(?:\[[0-9]+\])*)*): `)
+
+var keyIndexRegex = regexp.MustCompile(`\[([0-9]+)\]`)
+
+// parseSource gives yaml node tree of config, it is nil when config can't be parsed
+// and is then only used to give location of keys in errors
+func parseSource(configYAML []byte) (*yaml3.Node, error) {
+	root := &yaml3.Node{}
+	if err := yaml3.Unmarshal(configYAML, root); err != nil {
+		return nil, err
+	}
+	return root, nil
+}
+
+// locate prefixes an error starting with a key path by line and column of this key in config,
+// e.g. `line 3:3: backends.private_key: ...`, the closest parent key is used when key is not written
+func (c *Config) locate(err error) error {
+	if err == nil || c.source == nil {
+		return err
+	}
+	match := keyPathRegex.FindStringSubmatch(err.Error())
+	if match == nil {
+		return err
+	}
+	n := findKey(c.source, match[1])
+	if n == nil {
+		return err
+	}
+	return fmt.Errorf("line %d:%d: %w", n.Line, n.Column, err)
+}
+
+// findKey gives node of the deepest key of path found in document,
+// keys are given for mappings and items for sequences
+func findKey(root *yaml3.Node, keyPath string) *yaml3.Node {
+	n := root
+	if n.Kind == yaml3.DocumentNode && len(n.Content) > 0 {
+		n = n.Content[0]
+	}
+	var found *yaml3.Node
+	for _, segment := range strings.Split(keyPath, ".") {
+		name := segment
+		if i := strings.Index(segment, "["); i >= 0 {
+			name = segment[:i]
+		}
+		key, value := mappingEntry(n, name)
+		if key == nil {
+			return found
+		}
+		found, n = key, value
+		for _, index := range keyIndexRegex.FindAllStringSubmatch(segment, -1) {
+			i, _ := strconv.Atoi(index[1])
+			if n.Kind != yaml3.SequenceNode || i >= len(n.Content) {
+				return found
+			}
+			found, n = n.Content[i], resolveAlias(n.Content[i])
+		}
+	}
+	return found
+}
+
+func mappingEntry(n *yaml3.Node, name string) (*yaml3.Node, *yaml3.Node) {
+	if n.Kind != yaml3.MappingNode {
+		return nil, nil
+	}
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if n.Content[i].Value == name {
+			return n.Content[i], resolveAlias(n.Content[i+1])
+		}
+	}
+	return nil, nil
+}
+
+func resolveAlias(n *yaml3.Node) *yaml3.Node {
+	if n.Kind == yaml3.AliasNode && n.Alias != nil {
+		return n.Alias
+	}
+	return n
+}
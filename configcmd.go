@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/orange-cloudfoundry/promfetcher/config"
+)
+
+// loadConfigToCheck parses config file strictly without opening any connection,
+// default config overridden by environment is given when no file is set
+func loadConfigToCheck(file *os.File) (*config.Config, error) {
+	if file == nil {
+		return config.CheckConfig(nil)
+	}
+	b, err := io.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+	c, err := config.CheckConfig(b)
+	if err != nil {
+		return nil, fmt.Errorf("invalid config %s: %s", file.Name(), err.Error())
+	}
+	return c, nil
+}
+
+func checkConfig(file *os.File, w io.Writer) error {
+	if file == nil {
+		return fmt.Errorf("no config file given, set one with --config")
+	}
+	c, err := loadConfigToCheck(file)
+	if err != nil {
+		return err
+	}
+	for _, warning := range c.Warnings() {
+		if _, err = fmt.Fprintf(w, "warning: %s\n", warning); err != nil {
+			return err
+		}
+	}
+	_, err = fmt.Fprintf(w, "config %s is valid\n", file.Name())
+	return err
+}
+
+func printConfig(file *os.File, w io.Writer) error {
+	c, err := loadConfigToCheck(file)
+	if err != nil {
+		return err
+	}
+	b, err := yaml.Marshal(c.Redacted())
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
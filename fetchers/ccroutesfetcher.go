@@ -0,0 +1,390 @@
+package fetchers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/orange-cloudfoundry/promfetcher/clients"
+	"github.com/orange-cloudfoundry/promfetcher/healthchecks"
+	"github.com/orange-cloudfoundry/promfetcher/metrics"
+	"github.com/orange-cloudfoundry/promfetcher/models"
+)
+
+const ccDefaultAppPort = 8080
+
+// ccDefaultStatsConcurrency is default number of processes stats requested at the same time
+const ccDefaultStatsConcurrency = 10
+
+type ccRelationship struct {
+	Data struct {
+		GUID string `json:"guid"`
+	} `json:"data"`
+}
+
+type ccApp struct {
+	GUID          string `json:"guid"`
+	Name          string `json:"name"`
+	State         string `json:"state"`
+	Relationships struct {
+		Space ccRelationship `json:"space"`
+	} `json:"relationships"`
+}
+
+type ccSpace struct {
+	GUID          string `json:"guid"`
+	Name          string `json:"name"`
+	Relationships struct {
+		Organization ccRelationship `json:"organization"`
+	} `json:"relationships"`
+}
+
+type ccOrganization struct {
+	GUID string `json:"guid"`
+	Name string `json:"name"`
+}
+
+type ccProcess struct {
+	GUID          string `json:"guid"`
+	Type          string `json:"type"`
+	Instances     int    `json:"instances"`
+	Relationships struct {
+		App ccRelationship `json:"app"`
+	} `json:"relationships"`
+}
+
+type ccInstancePort struct {
+	External             uint16 `json:"external"`
+	Internal             uint16 `json:"internal"`
+	ExternalTLSProxyPort uint16 `json:"external_tls_proxy_port"`
+}
+
+type ccProcessStats struct {
+	Resources []struct {
+		Index         int              `json:"index"`
+		State         string           `json:"state"`
+		Host          string           `json:"host"`
+		InstanceGUID  string           `json:"instance_guid"`
+		InstancePorts []ccInstancePort `json:"instance_ports"`
+	} `json:"resources"`
+}
+
+type ccRoute struct {
+	URL          string `json:"url"`
+	Destinations []struct {
+		App struct {
+			GUID    string `json:"guid"`
+			Process struct {
+				Type string `json:"type"`
+			} `json:"process"`
+		} `json:"app"`
+		Port *uint16 `json:"port"`
+	} `json:"destinations"`
+}
+
+// CCRoutesFetcher builds routing table by polling cloud controller v3 api instead of listening
+// to gorouter bus, routes and tags have the same shape than routes received from nats
+type CCRoutesFetcher struct {
+	client           *clients.CloudControllerClient
+	interval         time.Duration
+	statsConcurrency int
+
+	mu       sync.RWMutex
+	routes   models.Routes
+	lastPoll time.Time
+	lastErr  error
+}
+
+func NewCCRoutesFetcher(client *clients.CloudControllerClient, interval time.Duration, statsConcurrency int) *CCRoutesFetcher {
+	if statsConcurrency <= 0 {
+		statsConcurrency = ccDefaultStatsConcurrency
+	}
+	return &CCRoutesFetcher{
+		client:           client,
+		interval:         interval,
+		statsConcurrency: statsConcurrency,
+		routes:           make(models.Routes),
+	}
+}
+
+// Run polls cloud controller on each interval, ready is closed after first successful poll
+func (f *CCRoutesFetcher) Run(signals <-chan os.Signal, ready chan<- struct{}) error {
+	log.Info("cloud controller routes fetcher starting")
+	interval := f.interval
+	if interval <= 0 {
+		interval = 30 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	isReady := false
+	for {
+		err := f.Poll()
+		if err != nil {
+			log.Errorf("failed to fetch routes from cloud controller: %s", err.Error())
+		} else if !isReady {
+			isReady = true
+			close(ready)
+			log.Info("cloud controller routes fetcher started")
+		}
+		select {
+		case <-ticker.C:
+		case <-signals:
+			log.Info("exited")
+			return nil
+		}
+	}
+}
+
+func (f *CCRoutesFetcher) Routes() models.Routes {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.routes
+}
+
+// Poll builds a new routing table from cloud controller, current routing table is kept on error
+func (f *CCRoutesFetcher) Poll() error {
+	routes, err := f.fetchRoutes()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.lastErr = err
+	if err != nil {
+		return err
+	}
+	f.routes = routes
+	f.lastPoll = time.Now()
+	return nil
+}
+
+// HealthReport reports last poll state and routing table for detailed health report
+func (f *CCRoutesFetcher) HealthReport() healthchecks.ComponentReport {
+	f.mu.RLock()
+	lastPoll := f.lastPoll
+	lastErr := f.lastErr
+	f.mu.RUnlock()
+
+	report := healthchecks.ComponentReport{
+		Status: healthchecks.StatusUp,
+		Details: map[string]interface{}{
+			"routes": f.Routes().Len(),
+		},
+	}
+	if !lastPoll.IsZero() {
+		report.Details["last_poll_age_seconds"] = time.Since(lastPoll).Seconds()
+	}
+	if lastErr != nil {
+		report.Status = healthchecks.StatusDegraded
+		if lastPoll.IsZero() {
+			report.Status = healthchecks.StatusDown
+		}
+		report.Error = lastErr.Error()
+	}
+	return report
+}
+
+func (f *CCRoutesFetcher) fetchRoutes() (models.Routes, error) {
+	orgs := make(map[string]ccOrganization)
+	err := f.client.List("/v3/organizations?per_page=5000", func(raw json.RawMessage) error {
+		var org ccOrganization
+		err := json.Unmarshal(raw, &org)
+		orgs[org.GUID] = org
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	spaces := make(map[string]ccSpace)
+	err = f.client.List("/v3/spaces?per_page=5000", func(raw json.RawMessage) error {
+		var space ccSpace
+		err := json.Unmarshal(raw, &space)
+		spaces[space.GUID] = space
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	apps := make(map[string]ccApp)
+	err = f.client.List("/v3/apps?per_page=5000", func(raw json.RawMessage) error {
+		var app ccApp
+		err := json.Unmarshal(raw, &app)
+		if app.State == "STARTED" {
+			apps[app.GUID] = app
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// uris and container port of web process of each app, port of first destination
+	// explicitly set on web process is preferred to ports of destinations without process
+	uris := make(map[string][]models.Uri)
+	appPorts := make(map[string]uint16)
+	webProcessPorts := make(map[string]bool)
+	err = f.client.List("/v3/routes?per_page=5000", func(raw json.RawMessage) error {
+		var route ccRoute
+		err := json.Unmarshal(raw, &route)
+		for _, dest := range route.Destinations {
+			if dest.App.Process.Type != "" && dest.App.Process.Type != models.ProcessWeb {
+				continue
+			}
+			appGUID := dest.App.GUID
+			uris[appGUID] = append(uris[appGUID], models.Uri(route.URL))
+			if dest.Port == nil || webProcessPorts[appGUID] {
+				continue
+			}
+			if _, ok := appPorts[appGUID]; !ok || dest.App.Process.Type == models.ProcessWeb {
+				appPorts[appGUID] = *dest.Port
+				webProcessPorts[appGUID] = dest.App.Process.Type == models.ProcessWeb
+			}
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	processes := make([]ccProcess, 0)
+	err = f.client.List("/v3/processes?types=web&per_page=5000", func(raw json.RawMessage) error {
+		var process ccProcess
+		err := json.Unmarshal(raw, &process)
+		appGUID := process.Relationships.App.Data.GUID
+		if _, ok := apps[appGUID]; ok && process.Instances > 0 && len(uris[appGUID]) > 0 {
+			processes = append(processes, process)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	processesStats, err := f.fetchProcessesStats(processes)
+	if err != nil {
+		return nil, err
+	}
+
+	routes := make(models.Routes)
+	now := time.Now()
+	for i, process := range processes {
+		stats := processesStats[i]
+		if stats == nil {
+			continue
+		}
+		app := apps[process.Relationships.App.Data.GUID]
+		space := spaces[app.Relationships.Space.Data.GUID]
+		org := orgs[space.Relationships.Organization.Data.GUID]
+		containerPort, ok := appPorts[app.GUID]
+		if !ok {
+			containerPort = ccDefaultAppPort
+		}
+		for _, instance := range stats.Resources {
+			if instance.State != "RUNNING" || instance.Host == "" {
+				continue
+			}
+			port, useTLS, ok := externalPort(instance.InstancePorts, containerPort)
+			if !ok {
+				continue
+			}
+			route := &models.Route{
+				PrivateInstanceID: instance.InstanceGUID,
+				Tags: models.Tags{
+					ProcessType:       process.Type,
+					ProcessInstanceID: instance.InstanceGUID,
+					Component:         "cloud_controller",
+					InstanceID:        strconv.Itoa(instance.Index),
+					SpaceName:         space.Name,
+					OrganizationID:    org.GUID,
+					ProcessID:         process.GUID,
+					OrganizationName:  org.Name,
+					SourceID:          app.GUID,
+					AppID:             app.GUID,
+					AppName:           app.Name,
+					SpaceID:           space.GUID,
+				},
+				Address:  net.JoinHostPort(instance.Host, strconv.Itoa(int(port))),
+				TLS:      useTLS,
+				Host:     instance.Host,
+				LastSeen: now,
+			}
+			if useTLS {
+				route.ServerCertDomainSan = instance.InstanceGUID
+			}
+			for _, uri := range uris[app.GUID] {
+				routes.RegisterRoute(uri, route)
+			}
+		}
+	}
+	return routes, nil
+}
+
+// fetchProcessesStats gives stats of each process in the same order, at most statsConcurrency
+// requests are made at the same time to not overload cloud controller. Stats are nil for processes
+// cloud controller answers an error for, e.g. when app has been deleted since processes were listed,
+// poll only fails on authentication or transport errors
+func (f *CCRoutesFetcher) fetchProcessesStats(processes []ccProcess) ([]*ccProcessStats, error) {
+	processesStats := make([]*ccProcessStats, len(processes))
+	errs := make([]error, len(processes))
+	jobs := make(chan int, len(processes))
+	wg := &sync.WaitGroup{}
+	wg.Add(len(processes))
+	for w := 0; w < f.statsConcurrency; w++ {
+		go func(jobs <-chan int) {
+			for i := range jobs {
+				stats := &ccProcessStats{}
+				errs[i] = f.client.Get(fmt.Sprintf("/v3/processes/%s/stats", processes[i].GUID), stats)
+				if errs[i] == nil {
+					processesStats[i] = stats
+				}
+				wg.Done()
+			}
+		}(jobs)
+	}
+	for i := range processes {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	for i, err := range errs {
+		if err == nil {
+			continue
+		}
+		var statusErr *clients.StatusError
+		if !errors.As(err, &statusErr) ||
+			statusErr.StatusCode == http.StatusUnauthorized ||
+			statusErr.StatusCode == http.StatusForbidden {
+			return nil, err
+		}
+		log.Warnf("skipping process %s of app %s: %s", processes[i].GUID, processes[i].Relationships.App.Data.GUID, err.Error())
+		metrics.CCProcessStatsFailedTotal.Inc()
+	}
+	return processesStats, nil
+}
+
+// externalPort gives external port mapped to container port, tls proxy port is preferred
+// as gorouter does
+func externalPort(instancePorts []ccInstancePort, containerPort uint16) (uint16, bool, bool) {
+	if len(instancePorts) == 0 {
+		return 0, false, false
+	}
+	instancePort := instancePorts[0]
+	for _, p := range instancePorts {
+		if p.Internal == containerPort {
+			instancePort = p
+			break
+		}
+	}
+	if instancePort.ExternalTLSProxyPort != 0 {
+		return instancePort.ExternalTLSProxyPort, true, true
+	}
+	return instancePort.External, false, true
+}
@@ -0,0 +1,257 @@
+package fetchers_test
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/ghttp"
+
+	"github.com/orange-cloudfoundry/promfetcher/clients"
+	"github.com/orange-cloudfoundry/promfetcher/config"
+	"github.com/orange-cloudfoundry/promfetcher/fetchers"
+	"github.com/orange-cloudfoundry/promfetcher/healthchecks"
+	"github.com/orange-cloudfoundry/promfetcher/models"
+)
+
+type jsonMap map[string]interface{}
+
+func ccPage(next string, resources ...jsonMap) jsonMap {
+	pagination := jsonMap{"next": nil}
+	if next != "" {
+		pagination["next"] = jsonMap{"href": next}
+	}
+	return jsonMap{"pagination": pagination, "resources": resources}
+}
+
+func ccRelationship(name, guid string) jsonMap {
+	return jsonMap{name: jsonMap{"data": jsonMap{"guid": guid}}}
+}
+
+var _ = Describe("CCRoutesFetcher", func() {
+	var server *ghttp.Server
+	var routesFetcher *fetchers.CCRoutesFetcher
+	appGUID := "d245c244-1875-a718-1248-2547e141a45c"
+
+	BeforeEach(func() {
+		server = ghttp.NewServer()
+		server.RouteToHandler(http.MethodGet, "/", ghttp.RespondWithJSONEncoded(http.StatusOK, jsonMap{
+			"links": jsonMap{"uaa": jsonMap{"href": server.URL()}},
+		}))
+		server.RouteToHandler(http.MethodPost, "/oauth/token", ghttp.CombineHandlers(
+			ghttp.VerifyBasicAuth("promfetcher", "secret"),
+			ghttp.VerifyFormKV("grant_type", "client_credentials"),
+			ghttp.RespondWithJSONEncoded(http.StatusOK, jsonMap{"access_token": "my-token", "expires_in": 3600}),
+		))
+		server.RouteToHandler(http.MethodGet, "/v3/organizations", ghttp.CombineHandlers(
+			ghttp.VerifyHeaderKV("Authorization", "bearer my-token"),
+			func(w http.ResponseWriter, req *http.Request) {
+				if req.URL.Query().Get("page") == "2" {
+					ghttp.RespondWithJSONEncoded(http.StatusOK, ccPage("",
+						jsonMap{"guid": "org-2", "name": "other org"},
+					))(w, req)
+					return
+				}
+				ghttp.RespondWithJSONEncoded(http.StatusOK, ccPage(server.URL()+"/v3/organizations?page=2",
+					jsonMap{"guid": "org-1", "name": "my org"},
+				))(w, req)
+			},
+		))
+		server.RouteToHandler(http.MethodGet, "/v3/spaces", ghttp.RespondWithJSONEncoded(http.StatusOK, ccPage("",
+			jsonMap{"guid": "space-1", "name": "myspace", "relationships": ccRelationship("organization", "org-2")},
+		)))
+		server.RouteToHandler(http.MethodGet, "/v3/apps", ghttp.RespondWithJSONEncoded(http.StatusOK, ccPage("",
+			jsonMap{"guid": appGUID, "name": "myapp", "state": "STARTED", "relationships": ccRelationship("space", "space-1")},
+			jsonMap{"guid": "stopped-app", "name": "stopped", "state": "STOPPED", "relationships": ccRelationship("space", "space-1")},
+		)))
+		server.RouteToHandler(http.MethodGet, "/v3/routes", ghttp.RespondWithJSONEncoded(http.StatusOK, ccPage("",
+			jsonMap{
+				"url": "myapp.example.net",
+				"destinations": []jsonMap{
+					{"app": jsonMap{"guid": appGUID, "process": jsonMap{"type": "web"}}, "port": 8080},
+					{"app": jsonMap{"guid": "stopped-app", "process": jsonMap{"type": "web"}}, "port": 8080},
+				},
+			},
+		)))
+		server.RouteToHandler(http.MethodGet, "/v3/processes", ghttp.CombineHandlers(
+			ghttp.VerifyRequest(http.MethodGet, "/v3/processes", "types=web&per_page=5000"),
+			ghttp.RespondWithJSONEncoded(http.StatusOK, ccPage("",
+				jsonMap{"guid": "process-1", "type": "web", "instances": 2, "relationships": ccRelationship("app", appGUID)},
+				jsonMap{"guid": "process-2", "type": "web", "instances": 1, "relationships": ccRelationship("app", "stopped-app")},
+			)),
+		))
+		server.RouteToHandler(http.MethodGet, "/v3/processes/process-1/stats", ghttp.RespondWithJSONEncoded(http.StatusOK, jsonMap{
+			"resources": []jsonMap{
+				{
+					"index": 0, "state": "RUNNING", "host": "10.0.0.1", "instance_guid": "instance-0",
+					"instance_ports": []jsonMap{{"external": 61000, "internal": 8080, "external_tls_proxy_port": 61001}},
+				},
+				{
+					"index": 1, "state": "RUNNING", "host": "10.0.0.2", "instance_guid": "instance-1",
+					"instance_ports": []jsonMap{{"external": 61002, "internal": 8080}},
+				},
+				{"index": 2, "state": "CRASHED"},
+			},
+		}))
+
+		routesFetcher = fetchers.NewCCRoutesFetcher(clients.NewCloudControllerClient(config.CloudControllerConfig{
+			APIURL:       server.URL(),
+			ClientID:     "promfetcher",
+			ClientSecret: "secret",
+		}, nil), time.Hour, 2)
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("builds routing table from cloud controller", func() {
+		Expect(routesFetcher.Poll()).To(Succeed())
+
+		routes := routesFetcher.Routes().FindById(appGUID)
+		Expect(routes).To(HaveLen(2))
+		byInstance := make(map[string]*models.Route)
+		for _, route := range routes {
+			byInstance[route.Tags.InstanceID] = route
+		}
+		Expect(byInstance["0"].Address).To(Equal("10.0.0.1:61001"))
+		Expect(byInstance["0"].TLS).To(BeTrue())
+		Expect(byInstance["0"].ServerCertDomainSan).To(Equal("instance-0"))
+		Expect(byInstance["1"].Address).To(Equal("10.0.0.2:61002"))
+		Expect(byInstance["1"].TLS).To(BeFalse())
+		Expect(byInstance["1"].Tags).To(Equal(models.Tags{
+			ProcessType:       "web",
+			ProcessInstanceID: "instance-1",
+			Component:         "cloud_controller",
+			InstanceID:        "1",
+			SpaceName:         "myspace",
+			OrganizationID:    "org-2",
+			ProcessID:         "process-1",
+			OrganizationName:  "other org",
+			SourceID:          appGUID,
+			AppID:             appGUID,
+			AppName:           "myapp",
+			SpaceID:           "space-1",
+		}))
+
+		Expect(routesFetcher.Routes().Find("other org/myspace/myapp")).To(HaveLen(2))
+		Expect(routesFetcher.Routes().Find("myapp.example.net")).To(HaveLen(2))
+		Expect(routesFetcher.Routes().Len()).To(Equal(2))
+		report := routesFetcher.HealthReport()
+		Expect(report.Status).To(Equal(healthchecks.StatusUp))
+		Expect(report.Details).To(HaveKey("last_poll_age_seconds"))
+	})
+
+	It("requests stats of processes with a bounded concurrency", func() {
+		processes := make([]jsonMap, 0)
+		for i := 0; i < 6; i++ {
+			processes = append(processes, jsonMap{
+				"guid": fmt.Sprintf("process-%d", 10+i), "type": "web", "instances": 1, "relationships": ccRelationship("app", appGUID),
+			})
+		}
+		processes = append(processes, jsonMap{
+			"guid": "process-scaled-down", "type": "web", "instances": 0, "relationships": ccRelationship("app", appGUID),
+		})
+		server.RouteToHandler(http.MethodGet, "/v3/processes", ghttp.RespondWithJSONEncoded(http.StatusOK, ccPage("", processes...)))
+
+		inFlight := &atomic.Int32{}
+		maxInFlight := &atomic.Int32{}
+		requested := &sync.Map{}
+		server.RouteToHandler(http.MethodGet, regexp.MustCompile(`^/v3/processes/[^/]+/stats$`), func(w http.ResponseWriter, req *http.Request) {
+			requested.Store(req.URL.Path, true)
+			n := inFlight.Add(1)
+			defer inFlight.Add(-1)
+			for {
+				current := maxInFlight.Load()
+				if n <= current || maxInFlight.CompareAndSwap(current, n) {
+					break
+				}
+			}
+			time.Sleep(20 * time.Millisecond)
+			ghttp.RespondWithJSONEncoded(http.StatusOK, jsonMap{"resources": []jsonMap{}})(w, req)
+		})
+
+		Expect(routesFetcher.Poll()).To(Succeed())
+		Expect(maxInFlight.Load()).To(Equal(int32(2)))
+		_, ok := requested.Load("/v3/processes/process-15/stats")
+		Expect(ok).To(BeTrue())
+		_, ok = requested.Load("/v3/processes/process-scaled-down/stats")
+		Expect(ok).To(BeFalse())
+	})
+
+	It("skips processes which stats can't be retrieved", func() {
+		server.RouteToHandler(http.MethodGet, "/v3/processes", ghttp.RespondWithJSONEncoded(http.StatusOK, ccPage("",
+			jsonMap{"guid": "deleted-process", "type": "web", "instances": 1, "relationships": ccRelationship("app", appGUID)},
+			jsonMap{"guid": "process-1", "type": "web", "instances": 2, "relationships": ccRelationship("app", appGUID)},
+		)))
+		server.RouteToHandler(http.MethodGet, "/v3/processes/deleted-process/stats", ghttp.RespondWith(http.StatusNotFound, "not found"))
+
+		Expect(routesFetcher.Poll()).To(Succeed())
+		Expect(routesFetcher.Routes().FindById(appGUID)).To(HaveLen(2))
+	})
+
+	It("fails when cloud controller denies access to stats", func() {
+		server.RouteToHandler(http.MethodGet, "/v3/processes/process-1/stats", ghttp.RespondWith(http.StatusForbidden, "denied"))
+		Expect(routesFetcher.Poll()).To(MatchError(ContainSubstring("cloud controller answered 403")))
+	})
+
+	It("uses port of web process destination", func() {
+		server.RouteToHandler(http.MethodGet, "/v3/routes", ghttp.RespondWithJSONEncoded(http.StatusOK, ccPage("",
+			jsonMap{
+				"url": "myapp.example.net",
+				"destinations": []jsonMap{
+					{"app": jsonMap{"guid": appGUID, "process": jsonMap{"type": ""}}, "port": 9090},
+					{"app": jsonMap{"guid": appGUID, "process": jsonMap{"type": "web"}}, "port": 8080},
+				},
+			},
+			jsonMap{
+				"url": "myapp-admin.example.net",
+				"destinations": []jsonMap{
+					{"app": jsonMap{"guid": appGUID, "process": jsonMap{"type": "web"}}, "port": 9090},
+				},
+			},
+		)))
+		server.RouteToHandler(http.MethodGet, "/v3/processes/process-1/stats", ghttp.RespondWithJSONEncoded(http.StatusOK, jsonMap{
+			"resources": []jsonMap{
+				{
+					"index": 0, "state": "RUNNING", "host": "10.0.0.1", "instance_guid": "instance-0",
+					"instance_ports": []jsonMap{{"external": 62000, "internal": 9090}, {"external": 61000, "internal": 8080}},
+				},
+			},
+		}))
+
+		Expect(routesFetcher.Poll()).To(Succeed())
+		routes := routesFetcher.Routes().FindById(appGUID)
+		Expect(routes).To(HaveLen(1))
+		Expect(routes[0].Address).To(Equal("10.0.0.1:61000"))
+	})
+
+	It("keeps routing table when cloud controller fails", func() {
+		Expect(routesFetcher.Poll()).To(Succeed())
+
+		server.RouteToHandler(http.MethodGet, "/v3/apps", ghttp.RespondWith(http.StatusInternalServerError, "boom"))
+		Expect(routesFetcher.Poll()).To(MatchError(ContainSubstring("cloud controller answered 500")))
+		Expect(routesFetcher.Routes().Len()).To(Equal(2))
+
+		report := routesFetcher.HealthReport()
+		Expect(report.Status).To(Equal(healthchecks.StatusDegraded))
+		Expect(report.Error).To(ContainSubstring("boom"))
+	})
+
+	It("is ready after first poll", func() {
+		signals := make(chan os.Signal)
+		ready := make(chan struct{})
+		go func() {
+			defer GinkgoRecover()
+			Expect(routesFetcher.Run(signals, ready)).To(Succeed())
+		}()
+		Eventually(ready).Should(BeClosed())
+		signals <- os.Interrupt
+	})
+})
@@ -0,0 +1,231 @@
+package fetchers
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+
+	"github.com/orange-cloudfoundry/promfetcher/healthchecks"
+	"github.com/orange-cloudfoundry/promfetcher/models"
+)
+
+// RoutesFile is content of a routes file, it can be written in yaml or json
+type RoutesFile struct {
+	Apps []FileApp `yaml:"apps"`
+}
+
+type FileApp struct {
+	ID               string `yaml:"id"`
+	Name             string `yaml:"name"`
+	SpaceID          string `yaml:"space_id"`
+	SpaceName        string `yaml:"space_name"`
+	OrganizationID   string `yaml:"organization_id"`
+	OrganizationName string `yaml:"organization_name"`
+	// ProcessType is web when not set
+	ProcessType string         `yaml:"process_type"`
+	ProcessID   string         `yaml:"process_id"`
+	Uris        []string       `yaml:"uris"`
+	Instances   []FileInstance `yaml:"instances"`
+}
+
+// FileInstance is an instance of an app, its index is its position in list when not set.
+// Tags set on instance replace those given by app
+type FileInstance struct {
+	Address             string      `yaml:"address"`
+	TLS                 bool        `yaml:"tls"`
+	Index               *int        `yaml:"index"`
+	InstanceGUID        string      `yaml:"instance_guid"`
+	ServerCertDomainSan string      `yaml:"server_cert_domain_san"`
+	Tags                models.Tags `yaml:"tags"`
+}
+
+// FileRoutesFetcher builds routing table from a local file reloaded when it changes,
+// this let promfetcher run without cloud foundry, e.g. in local dev or in front of other workloads
+type FileRoutesFetcher struct {
+	path     string
+	interval time.Duration
+
+	mu      sync.RWMutex
+	routes  models.Routes
+	modTime time.Time
+	lastErr error
+}
+
+func NewFileRoutesFetcher(path string, interval time.Duration) *FileRoutesFetcher {
+	return &FileRoutesFetcher{
+		path:     path,
+		interval: interval,
+		routes:   make(models.Routes),
+	}
+}
+
+// Run loads file and checks on each interval if file has changed, an error is given
+// only when file can't be loaded at start
+func (f *FileRoutesFetcher) Run(signals <-chan os.Signal, ready chan<- struct{}) error {
+	log.Infof("file routes fetcher starting on %s", f.path)
+	if _, err := f.Reload(); err != nil {
+		return err
+	}
+	close(ready)
+	log.Info("file routes fetcher started")
+
+	interval := f.interval
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			reloaded, err := f.Reload()
+			if err != nil {
+				log.Errorf("failed to reload routes file, keeping previous routes: %s", err.Error())
+				continue
+			}
+			if reloaded {
+				log.Infof("routes file %s reloaded", f.path)
+			}
+		case <-signals:
+			log.Info("exited")
+			return nil
+		}
+	}
+}
+
+func (f *FileRoutesFetcher) Routes() models.Routes {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.routes
+}
+
+// Reload loads file again if it has been modified since last load, current routing table is kept on error
+func (f *FileRoutesFetcher) Reload() (bool, error) {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		f.setErr(err)
+		return false, err
+	}
+	f.mu.RLock()
+	modTime := f.modTime
+	f.mu.RUnlock()
+	if info.ModTime().Equal(modTime) {
+		return false, nil
+	}
+
+	routes, err := f.loadRoutes()
+	if err != nil {
+		f.setErr(err)
+		return false, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.routes = routes
+	f.modTime = info.ModTime()
+	f.lastErr = nil
+	return true, nil
+}
+
+// HealthReport reports last load state and routing table for detailed health report
+func (f *FileRoutesFetcher) HealthReport() healthchecks.ComponentReport {
+	f.mu.RLock()
+	lastErr := f.lastErr
+	f.mu.RUnlock()
+
+	report := healthchecks.ComponentReport{
+		Status: healthchecks.StatusUp,
+		Details: map[string]interface{}{
+			"routes": f.Routes().Len(),
+			"path":   f.path,
+		},
+	}
+	if lastErr != nil {
+		report.Status = healthchecks.StatusDegraded
+		report.Error = lastErr.Error()
+	}
+	return report
+}
+
+func (f *FileRoutesFetcher) setErr(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.lastErr = err
+}
+
+func (f *FileRoutesFetcher) loadRoutes() (models.Routes, error) {
+	b, err := os.ReadFile(f.path)
+	if err != nil {
+		return nil, err
+	}
+	var routesFile RoutesFile
+	// json is a subset of yaml
+	err = yaml.UnmarshalStrict(b, &routesFile)
+	if err != nil {
+		return nil, fmt.Errorf("error when loading routes file %s: %s", f.path, err.Error())
+	}
+
+	routes := make(models.Routes)
+	now := time.Now()
+	for _, app := range routesFile.Apps {
+		if app.ID == "" {
+			return nil, fmt.Errorf("id must be set on each app of routes file %s", f.path)
+		}
+		for i, instance := range app.Instances {
+			if instance.Address == "" {
+				return nil, fmt.Errorf("address must be set on each instance of app %s", app.ID)
+			}
+			index := i
+			if instance.Index != nil {
+				index = *instance.Index
+			}
+			host, _, err := net.SplitHostPort(instance.Address)
+			if err != nil {
+				host = instance.Address
+			}
+			processType := app.ProcessType
+			if processType == "" {
+				processType = models.ProcessWeb
+			}
+			route := &models.Route{
+				PrivateInstanceID: instance.InstanceGUID,
+				Tags: models.Tags{
+					ProcessType:       processType,
+					ProcessInstanceID: instance.InstanceGUID,
+					Component:         "file",
+					InstanceID:        strconv.Itoa(index),
+					SpaceName:         app.SpaceName,
+					OrganizationID:    app.OrganizationID,
+					ProcessID:         app.ProcessID,
+					OrganizationName:  app.OrganizationName,
+					SourceID:          app.ID,
+					AppID:             app.ID,
+					AppName:           app.Name,
+					SpaceID:           app.SpaceID,
+				}.Override(instance.Tags),
+				ServerCertDomainSan: instance.ServerCertDomainSan,
+				Address:             instance.Address,
+				TLS:                 instance.TLS,
+				Host:                host,
+				LastSeen:            now,
+			}
+			if route.PrivateInstanceID == "" {
+				// instances must be distinguishable to be registered on same uri
+				route.PrivateInstanceID = fmt.Sprintf("%s-%d", app.ID, index)
+			}
+			uris := app.Uris
+			if len(uris) == 0 {
+				uris = []string{app.ID}
+			}
+			for _, uri := range uris {
+				routes.RegisterRoute(models.Uri(uri), route)
+			}
+		}
+	}
+	return routes, nil
+}
@@ -0,0 +1,150 @@
+package fetchers_test
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/orange-cloudfoundry/promfetcher/fetchers"
+	"github.com/orange-cloudfoundry/promfetcher/healthchecks"
+	"github.com/orange-cloudfoundry/promfetcher/models"
+)
+
+var _ = Describe("FileRoutesFetcher", func() {
+	var path string
+	var routesFetcher *fetchers.FileRoutesFetcher
+	appGUID := "d245c244-1875-a718-1248-2547e141a45c"
+
+	writeFile := func(content string, modTime time.Time) {
+		Expect(os.WriteFile(path, []byte(content), 0600)).To(Succeed())
+		Expect(os.Chtimes(path, modTime, modTime)).To(Succeed())
+	}
+
+	BeforeEach(func() {
+		path = filepath.Join(GinkgoT().TempDir(), "routes.yml")
+		writeFile(`
+apps:
+- id: d245c244-1875-a718-1248-2547e141a45c
+  name: myapp
+  space_name: myspace
+  organization_name: my org
+  uris: [myapp.example.net]
+  instances:
+  - address: 10.0.0.1:8080
+  - address: 10.0.0.2:8443
+    tls: true
+    index: 5
+`, time.Now().Add(-time.Minute))
+		routesFetcher = fetchers.NewFileRoutesFetcher(path, time.Hour)
+	})
+
+	It("loads routes from file", func() {
+		reloaded, err := routesFetcher.Reload()
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(reloaded).To(BeTrue())
+
+		routes := routesFetcher.Routes().Find("my org/myspace/myapp")
+		Expect(routes).To(HaveLen(2))
+		for _, route := range routes {
+			Expect(route.Tags.AppID).To(Equal(appGUID))
+			if route.TLS {
+				Expect(route.Address).To(Equal("10.0.0.2:8443"))
+				Expect(route.Tags.InstanceID).To(Equal("5"))
+				continue
+			}
+			Expect(route.Address).To(Equal("10.0.0.1:8080"))
+			Expect(route.Host).To(Equal("10.0.0.1"))
+			Expect(route.Tags.InstanceID).To(Equal("0"))
+		}
+		Expect(routesFetcher.Routes().Find("myapp.example.net")).To(HaveLen(2))
+	})
+
+	It("sets process type and tags of instances", func() {
+		Expect(routesFetcher.Reload()).To(BeTrue())
+		for _, route := range routesFetcher.Routes().Find("my org/myspace/myapp") {
+			Expect(route.Tags.ProcessType).To(Equal("web"))
+		}
+
+		writeFile(`
+apps:
+- id: d245c244-1875-a718-1248-2547e141a45c
+  name: myapp
+  space_name: myspace
+  organization_name: my org
+  process_type: worker
+  process_id: process-1
+  instances:
+  - address: 10.0.0.1:8080
+    tags:
+      process_instance_id: instance-0
+      component: my-component
+`, time.Now())
+		Expect(routesFetcher.Reload()).To(BeTrue())
+		// routes of processes other than web are registered but not scraped
+		Expect(routesFetcher.Routes().Find("my org/myspace/myapp")).To(BeEmpty())
+		routes := routesFetcher.Routes()[models.Uri(appGUID)]
+		Expect(routes).To(HaveLen(1))
+		Expect(routes[0].Tags).To(Equal(models.Tags{
+			ProcessType:       "worker",
+			ProcessInstanceID: "instance-0",
+			Component:         "my-component",
+			InstanceID:        "0",
+			SpaceName:         "myspace",
+			ProcessID:         "process-1",
+			OrganizationName:  "my org",
+			SourceID:          appGUID,
+			AppID:             appGUID,
+			AppName:           "myapp",
+		}))
+	})
+
+	It("rejects unknown tags of instances", func() {
+		writeFile(`
+apps:
+- id: d245c244-1875-a718-1248-2547e141a45c
+  instances:
+  - address: 10.0.0.1:8080
+    tags:
+      unknown: value
+`, time.Now())
+		_, err := routesFetcher.Reload()
+		Expect(err).To(MatchError(ContainSubstring("unknown")))
+	})
+
+	It("reloads only when file changed", func() {
+		_, err := routesFetcher.Reload()
+		Expect(err).ShouldNot(HaveOccurred())
+
+		reloaded, err := routesFetcher.Reload()
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(reloaded).To(BeFalse())
+
+		writeFile(`{"apps": [{"id": "`+appGUID+`", "instances": [{"address": "10.0.0.3:8080"}]}]}`, time.Now())
+		reloaded, err = routesFetcher.Reload()
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(reloaded).To(BeTrue())
+
+		routes := routesFetcher.Routes().FindById(appGUID)
+		Expect(routes).To(HaveLen(1))
+		Expect(routes[0].Address).To(Equal("10.0.0.3:8080"))
+	})
+
+	It("keeps previous routes on invalid file", func() {
+		_, err := routesFetcher.Reload()
+		Expect(err).ShouldNot(HaveOccurred())
+
+		writeFile("apps:\n- name: no-id\n", time.Now())
+		_, err = routesFetcher.Reload()
+		Expect(err).To(MatchError(ContainSubstring("id must be set")))
+		Expect(routesFetcher.Routes().FindById(appGUID)).To(HaveLen(2))
+		Expect(routesFetcher.HealthReport().Status).To(Equal(healthchecks.StatusDegraded))
+	})
+
+	It("fails to start on missing file", func() {
+		routesFetcher = fetchers.NewFileRoutesFetcher(filepath.Join(filepath.Dir(path), "missing.yml"), time.Hour)
+		Expect(routesFetcher.Run(make(chan os.Signal), make(chan struct{}))).To(HaveOccurred())
+	})
+})
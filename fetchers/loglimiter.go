@@ -0,0 +1,42 @@
+package fetchers
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// logLimiter logs at most one error per interval, errors not logged are counted
+// and their number is given with next logged error
+type logLimiter struct {
+	mu         sync.Mutex
+	interval   time.Duration
+	last       time.Time
+	suppressed int
+}
+
+func newLogLimiter(interval time.Duration) *logLimiter {
+	return &logLimiter{interval: interval}
+}
+
+func (l *logLimiter) Errorf(format string, args ...interface{}) {
+	l.mu.Lock()
+	now := time.Now()
+	if now.Sub(l.last) < l.interval {
+		l.suppressed++
+		l.mu.Unlock()
+		return
+	}
+	suppressed := l.suppressed
+	l.suppressed = 0
+	l.last = now
+	l.mu.Unlock()
+
+	msg := fmt.Sprintf(format, args...)
+	if suppressed > 0 {
+		msg = fmt.Sprintf("%s (%d similar errors not logged)", msg, suppressed)
+	}
+	log.Error(msg)
+}
@@ -1,10 +1,15 @@
 package fetchers
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	dto "github.com/prometheus/client_model/go"
@@ -12,8 +17,10 @@ import (
 	"github.com/prometheus/common/model"
 	log "github.com/sirupsen/logrus"
 
+	"github.com/orange-cloudfoundry/promfetcher/caches"
 	"github.com/orange-cloudfoundry/promfetcher/config"
 	prom_errrors "github.com/orange-cloudfoundry/promfetcher/errors"
+	"github.com/orange-cloudfoundry/promfetcher/healthchecks"
 	"github.com/orange-cloudfoundry/promfetcher/metrics"
 	"github.com/orange-cloudfoundry/promfetcher/models"
 	"github.com/orange-cloudfoundry/promfetcher/scrapers"
@@ -23,21 +30,137 @@ func ptrString(v string) *string {
 	return &v
 }
 
-type MetricsFetcher struct {
+// exporterAddress gives exporter host with port of its scheme when no port is set
+func exporterAddress(ee *config.ExternalExporter) string {
+	if _, _, err := net.SplitHostPort(ee.Host.Raw); err == nil {
+		return ee.Host.Raw
+	}
+	if ee.IsTls {
+		return net.JoinHostPort(ee.Host.Raw, "443")
+	}
+	return net.JoinHostPort(ee.Host.Raw, "80")
+}
+
+// exporterRequestKey identifies request made to an external exporter from its resolved url and headers
+func exporterRequestKey(ee *config.ExternalExporter, route *models.Route) string {
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "%s\n%s://%s%s?%s\n", ee.Name, ee.Scheme, route.Address, route.MetricsPath, route.URLParams.Encode())
+	_ = route.Headers.Write(buf)
+	return buf.String()
+}
+
+// scrapeJob is a route to scrape, endpoint is set when metrics must be labelled with the scraped endpoint
+// and systemMetrics when metrics must be built by promfetcher instead of being scraped.
+// exporter and cacheKey are set for external exporters
+type scrapeJob struct {
+	route         *models.Route
+	endpoint      string
+	systemMetrics bool
+	uris          []models.Uri
+	exporter      *config.ExternalExporter
+	cacheKey      string
+}
+
+// countingReader counts bytes read from scrape response
+type countingReader struct {
+	reader io.Reader
+	size   int
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.size += n
+	return n, err
+}
+
+// scrapeConfig is the part of metrics fetcher swapped when config is reloaded,
+// a request uses the same scrape config from start to end
+type scrapeConfig struct {
 	scraper           *scrapers.Scraper
-	routesFetcher     RoutesFetch
 	externalExporters config.ExternalExporters
+	scrapeMetrics     config.ScrapeMetricsConfig
+	exporterCache     *caches.ExporterCache
+}
+
+type MetricsFetcher struct {
+	routesFetcher RoutesFetch
+	endpointCache *caches.EndpointCache
+	scrapeConfig  atomic.Pointer[scrapeConfig]
 }
 
-func NewMetricsFetcher(scraper *scrapers.Scraper, routesFetcher RoutesFetch, externalExporters config.ExternalExporters) *MetricsFetcher {
-	return &MetricsFetcher{
+func NewMetricsFetcher(scraper *scrapers.Scraper, routesFetcher RoutesFetch, externalExporters config.ExternalExporters, endpointCache *caches.EndpointCache, scrapeMetrics config.ScrapeMetricsConfig) *MetricsFetcher {
+	f := &MetricsFetcher{
+		routesFetcher: routesFetcher,
+		endpointCache: endpointCache,
+	}
+	f.Reload(scraper, externalExporters, scrapeMetrics)
+	return f
+}
+
+// Reload atomically swaps scraper, external exporters and scrape metrics config,
+// requests in progress finish with previous ones. Cached results of external exporters are dropped
+func (f *MetricsFetcher) Reload(scraper *scrapers.Scraper, externalExporters config.ExternalExporters, scrapeMetrics config.ScrapeMetricsConfig) {
+	f.scrapeConfig.Store(&scrapeConfig{
 		scraper:           scraper,
-		routesFetcher:     routesFetcher,
 		externalExporters: externalExporters,
+		scrapeMetrics:     scrapeMetrics,
+		exporterCache:     caches.NewExporterCache(),
+	})
+}
+
+// fetchLabels gives labels of fetch histograms, app labels are only set when enabled in config
+// to keep number of series bounded
+func (sc *scrapeConfig) fetchLabels(tags models.Tags) prometheus.Labels {
+	labels := prometheus.Labels{
+		"organization_name": "",
+		"space_name":        "",
+		"app_name":          "",
+	}
+	if sc.scrapeMetrics.OrganizationLabel {
+		labels["organization_name"] = tags.OrganizationName
 	}
+	if sc.scrapeMetrics.SpaceLabel {
+		labels["space_name"] = tags.SpaceName
+	}
+	if sc.scrapeMetrics.AppLabel {
+		labels["app_name"] = tags.AppName
+	}
+	return labels
+}
+
+// scrapeLabels gives labels of scrape histograms for a scraped route
+func (sc *scrapeConfig) scrapeLabels(route *models.Route) prometheus.Labels {
+	labels := sc.fetchLabels(route.Tags)
+	labels["source"] = "app"
+	if route.Tags.ProcessType == "external_exporter" {
+		labels["source"] = "external_exporter"
+	}
+	return labels
+}
+
+// ExporterCheckers gives a checker for each external exporter reporting if exporter accepts connections
+func (f *MetricsFetcher) ExporterCheckers() map[string]healthchecks.Checker {
+	sc := f.scrapeConfig.Load()
+	checkers := make(map[string]healthchecks.Checker)
+	for _, ee := range sc.externalExporters {
+		if ee.Host.IsTemplate() {
+			// host depends on app, there is no single address to check
+			continue
+		}
+		route := &models.Route{Address: exporterAddress(ee)}
+		checkers["external_exporter:"+ee.Name] = func() healthchecks.ComponentReport {
+			report := healthchecks.ReportFromError(sc.scraper.Probe(route))
+			report.Details = map[string]interface{}{
+				"address": route.Address,
+			}
+			return report
+		}
+	}
+	return checkers
 }
 
-func (f MetricsFetcher) Metrics(appIdOrPathOrName, metricPathDefault string, onlyAppMetrics bool, headers http.Header) (map[string]*dto.MetricFamily, error) {
+func (f *MetricsFetcher) Metrics(appIdOrPathOrName, metricPathDefault string, onlyAppMetrics bool, headers http.Header) (map[string]*dto.MetricFamily, error) {
+	sc := f.scrapeConfig.Load()
 
 	routes := f.routesFetcher.Routes().Find(appIdOrPathOrName)
 	if len(routes) == 0 {
@@ -47,14 +170,72 @@ func (f MetricsFetcher) Metrics(appIdOrPathOrName, metricPathDefault string, onl
 	for _, rte := range routes {
 		mapTagsRoute[rte.Tags.AppID] = rte.Tags
 	}
-	jobs := make(chan *models.Route, len(routes))
+	// a route path can target multiple apps, fetch is then not labelled by app
+	fetchTags := models.Tags{}
+	if len(mapTagsRoute) == 1 {
+		fetchTags = routes[0].Tags
+	}
+	start := time.Now()
+	defer func() {
+		metrics.FetchDuration.With(sc.fetchLabels(fetchTags)).Observe(time.Since(start).Seconds())
+	}()
+	endpointsByApp := make(map[string]models.AppEndpoints)
+	urisByApp := make(map[string]map[string][]models.Uri)
+	for appID := range mapTagsRoute {
+		endpointsByApp[appID] = f.endpointCache.Endpoints(appID)
+		if endpointsByApp[appID].SystemMetrics() {
+			urisByApp[appID] = f.routesFetcher.Routes().UrisByAddress(appID)
+		}
+	}
+
+	scrapeJobs := make([]scrapeJob, 0, len(routes))
+	instancesByApp := make(map[string]int)
+	for _, rte := range routes {
+		instancesByApp[rte.Tags.AppID]++
+		appEndpoints := endpointsByApp[rte.Tags.AppID]
+		endpoints := appEndpoints.Paths(metricPathDefault)
+		if appEndpoints.SystemMetrics() {
+			scrapeJobs = append(scrapeJobs, scrapeJob{
+				route:         rte,
+				systemMetrics: true,
+				uris:          urisByApp[rte.Tags.AppID][rte.Address],
+			})
+		}
+		if len(endpoints) == 0 {
+			// app only asking for system metrics without endpoint does not expose metrics
+			if !appEndpoints.OnlySystemMetrics() {
+				scrapeJobs = append(scrapeJobs, scrapeJob{route: rte})
+			}
+			continue
+		}
+		for _, endpoint := range endpoints {
+			rteEndpoint := *rte
+			rteEndpoint.MetricsPath = endpoint
+			job := scrapeJob{route: &rteEndpoint}
+			// endpoint label is only needed to distinguish metrics when app has multiple endpoints
+			if len(endpoints) > 1 {
+				job.endpoint = endpoint
+			}
+			scrapeJobs = append(scrapeJobs, job)
+		}
+	}
+
 	errFetch := &prom_errrors.ErrFetch{}
 	wg := &sync.WaitGroup{}
 
 	muWrite := sync.Mutex{}
 	metricsUnmerged := make([]map[string]*dto.MetricFamily, 0)
+	for appID, appEndpoints := range endpointsByApp {
+		if appEndpoints.SystemMetrics() {
+			metricsUnmerged = append(metricsUnmerged, f.appSystemMetrics(mapTagsRoute[appID], instancesByApp[appID]))
+		}
+	}
 
-	if !onlyAppMetrics && f.externalExporters != nil && len(f.externalExporters) > 0 {
+	if !onlyAppMetrics && len(sc.externalExporters) > 0 {
+		// apps sharing a route (e.g. blue/green) resolve to same exporter request when templates
+		// do not depend on app tags, it is scraped once and labelled with tags common to those apps
+		exporterJobs := make(map[string]*scrapeJob)
+		exporterKeys := make([]string, 0)
 		for _, tagRte := range mapTagsRoute {
 			tags := models.Tags{
 				ProcessType:      "external_exporter",
@@ -67,7 +248,10 @@ func (f MetricsFetcher) Metrics(appIdOrPathOrName, metricPathDefault string, onl
 				AppName:          tagRte.AppName,
 				SpaceID:          tagRte.SpaceID,
 			}
-			for _, ee := range f.externalExporters {
+			for _, ee := range sc.externalExporters {
+				if !ee.Selector.Selects(tagRte) {
+					continue
+				}
 				routeExternalExporter, err := ee.ToRoute(tags)
 				if err != nil {
 					err = fmt.Errorf("error when setting external exporters routes: %s", err.Error())
@@ -79,22 +263,44 @@ func (f MetricsFetcher) Metrics(appIdOrPathOrName, metricPathDefault string, onl
 						Warningf("error : %s", err.Error())
 					continue
 				}
-				routes = append(routes, routeExternalExporter)
+				key := exporterRequestKey(ee, routeExternalExporter)
+				if job, ok := exporterJobs[key]; ok {
+					job.route.Tags = job.route.Tags.Common(tags)
+					continue
+				}
+				exporterJobs[key] = &scrapeJob{route: routeExternalExporter, exporter: ee, cacheKey: key}
+				exporterKeys = append(exporterKeys, key)
 			}
 		}
+		for _, key := range exporterKeys {
+			scrapeJobs = append(scrapeJobs, *exporterJobs[key])
+		}
 	}
 
-	wg.Add(len(routes))
+	jobs := make(chan scrapeJob, len(scrapeJobs))
+	wg.Add(len(scrapeJobs))
 	for w := 1; w <= 5; w++ {
-		go func(jobs <-chan *models.Route, errFetch *prom_errrors.ErrFetch, headers http.Header) {
-			for j := range jobs {
-				if j.Tags.ProcessType == "external_exporter" {
-					headers = nil
+		go func(jobs <-chan scrapeJob, errFetch *prom_errrors.ErrFetch, headers http.Header) {
+			for job := range jobs {
+				j := job.route
+				if job.systemMetrics {
+					newMetrics := f.instanceSystemMetrics(sc.scraper, j, job.uris)
+					muWrite.Lock()
+					metricsUnmerged = append(metricsUnmerged, newMetrics)
+					muWrite.Unlock()
+					wg.Done()
+					continue
+				}
+				var newMetrics map[string]*dto.MetricFamily
+				var err error
+				if job.exporter != nil {
+					newMetrics, err = f.exporterMetric(sc, job, metricPathDefault)
+				} else {
+					newMetrics, err = f.metric(sc, j, metricPathDefault, headers)
 				}
-				newMetrics, err := f.Metric(j, metricPathDefault, headers)
 				if err != nil {
 					var errF *prom_errrors.ErrFetch
-					if errors.As(err, &errF) && len(f.externalExporters) == 0 {
+					if errors.As(err, &errF) && len(sc.externalExporters) == 0 {
 						muWrite.Lock()
 						*errFetch = *errF
 						muWrite.Unlock()
@@ -103,10 +309,13 @@ func (f MetricsFetcher) Metrics(appIdOrPathOrName, metricPathDefault string, onl
 					}
 					log.Debugf("Cannot get metric for instance %s for instance id %s (%s/%s/%s) : %s", j.Address, j.Tags.InstanceID, j.Tags.OrganizationName, j.Tags.SpaceName, j.Tags.AppName, err)
 					newMetrics = f.scrapeError(j, err)
-					metrics.MetricFetchFailedTotal.With(metrics.RouteToLabel(j)).Inc()
+					metrics.MetricFetchFailedTotal.With(metrics.RouteToLabelNoInstance(j)).Inc()
 				} else {
 					metrics.MetricFetchSuccessTotal.With(metrics.RouteToLabelNoInstance(j)).Inc()
 				}
+				if job.endpoint != "" {
+					f.addLabel(newMetrics, "endpoint", job.endpoint)
+				}
 				muWrite.Lock()
 				metricsUnmerged = append(metricsUnmerged, newMetrics)
 				muWrite.Unlock()
@@ -114,8 +323,8 @@ func (f MetricsFetcher) Metrics(appIdOrPathOrName, metricPathDefault string, onl
 			}
 		}(jobs, errFetch, headers)
 	}
-	for _, route := range routes {
-		jobs <- route
+	for _, job := range scrapeJobs {
+		jobs <- job
 	}
 	wg.Wait()
 	close(jobs)
@@ -141,18 +350,65 @@ func (f MetricsFetcher) Metrics(appIdOrPathOrName, metricPathDefault string, onl
 	return base, nil
 }
 
-func (f MetricsFetcher) Metric(route *models.Route, metricPathDefault string, headers http.Header) (map[string]*dto.MetricFamily, error) {
-	reader, err := f.scraper.Scrape(route, metricPathDefault, headers)
+func (f *MetricsFetcher) Metric(route *models.Route, metricPathDefault string, headers http.Header) (map[string]*dto.MetricFamily, error) {
+	return f.metric(f.scrapeConfig.Load(), route, metricPathDefault, headers)
+}
+
+func (f *MetricsFetcher) metric(sc *scrapeConfig, route *models.Route, metricPathDefault string, headers http.Header) (map[string]*dto.MetricFamily, error) {
+	metricsGroup, err := f.scrape(sc, route, metricPathDefault, headers)
+	if err != nil {
+		return nil, err
+	}
+	f.labelMetrics(route, metricsGroup)
+	return metricsGroup, nil
+}
+
+// exporterMetric gives metrics of an external exporter, from cache when it is enabled on exporter.
+// Headers received by promfetcher are never passed to external exporters
+func (f *MetricsFetcher) exporterMetric(sc *scrapeConfig, job scrapeJob, metricPathDefault string) (map[string]*dto.MetricFamily, error) {
+	if job.exporter.CacheTTL <= 0 {
+		return f.metric(sc, job.route, metricPathDefault, nil)
+	}
+	metricsGroup, err := sc.exporterCache.Get(job.exporter.Name, job.cacheKey, job.exporter.CacheTTL, job.exporter.CacheMaxStale, func() (map[string]*dto.MetricFamily, error) {
+		return f.scrape(sc, job.route, metricPathDefault, nil)
+	})
+	if err != nil {
+		return nil, err
+	}
+	f.labelMetrics(job.route, metricsGroup)
+	return metricsGroup, nil
+}
+
+// scrape gives metrics of a route without promfetcher labels
+func (f *MetricsFetcher) scrape(sc *scrapeConfig, route *models.Route, metricPathDefault string, headers http.Header) (map[string]*dto.MetricFamily, error) {
+	labels := sc.scrapeLabels(route)
+	start := time.Now()
+	defer func() {
+		metrics.ScrapeDuration.With(labels).Observe(time.Since(start).Seconds())
+	}()
+
+	reader, err := sc.scraper.Scrape(route, metricPathDefault, headers)
 	if err != nil {
 		return nil, err
 	}
 	defer reader.Close()
+	counter := &countingReader{reader: reader}
 	parser := expfmt.NewTextParser(model.UTF8Validation)
-	metricsGroup, err := parser.TextToMetricFamilies(reader)
+	metricsGroup, err := parser.TextToMetricFamilies(counter)
 	if err != nil {
 		return nil, err
 	}
+	samples := 0
+	for _, metricGroup := range metricsGroup {
+		samples += len(metricGroup.Metric)
+	}
+	metrics.ScrapeResponseSize.With(labels).Observe(float64(counter.size))
+	metrics.ScrapeSamples.With(labels).Observe(float64(samples))
+	return metricsGroup, nil
+}
 
+// labelMetrics sets app and instance labels from route on every metrics
+func (f *MetricsFetcher) labelMetrics(route *models.Route, metricsGroup map[string]*dto.MetricFamily) {
 	for _, metricGroup := range metricsGroup {
 		for _, metric := range metricGroup.Metric {
 			metric.Label = f.cleanMetricLabels(
@@ -206,10 +462,23 @@ func (f MetricsFetcher) Metric(route *models.Route, metricPathDefault string, he
 
 		}
 	}
-	return metricsGroup, nil
 }
 
-func (f MetricsFetcher) cleanMetricLabels(labels []*dto.LabelPair, names ...string) []*dto.LabelPair {
+func (f *MetricsFetcher) addLabel(metricsGroup map[string]*dto.MetricFamily, name, value string) {
+	for _, metricGroup := range metricsGroup {
+		for _, metric := range metricGroup.Metric {
+			metric.Label = append(
+				f.cleanMetricLabels(metric.Label, name),
+				&dto.LabelPair{
+					Name:  ptrString(name),
+					Value: ptrString(value),
+				},
+			)
+		}
+	}
+}
+
+func (f *MetricsFetcher) cleanMetricLabels(labels []*dto.LabelPair, names ...string) []*dto.LabelPair {
 	finalLabels := make([]*dto.LabelPair, 0)
 	for _, label := range labels {
 		toAdd := true
@@ -226,7 +495,7 @@ func (f MetricsFetcher) cleanMetricLabels(labels []*dto.LabelPair, names ...stri
 	return finalLabels
 }
 
-func (f MetricsFetcher) scrapeError(route *models.Route, err error) map[string]*dto.MetricFamily {
+func (f *MetricsFetcher) scrapeError(route *models.Route, err error) map[string]*dto.MetricFamily {
 	name := "promfetcher_scrape_error"
 	help := "Promfetcher scrap error on your instance"
 	metric := prometheus.NewCounter(prometheus.CounterOpts{
@@ -259,7 +528,7 @@ func (f MetricsFetcher) scrapeError(route *models.Route, err error) map[string]*
 	}
 }
 
-func (f MetricsFetcher) scrapeExternalExporterError(tags models.Tags, externalExporter *config.ExternalExporter, err error) map[string]*dto.MetricFamily {
+func (f *MetricsFetcher) scrapeExternalExporterError(tags models.Tags, externalExporter *config.ExternalExporter, err error) map[string]*dto.MetricFamily {
 	name := "promfetcher_scrape_external_exporter_error"
 	help := "Promfetcher scrap external exporter error on your instance"
 	metric := prometheus.NewCounter(prometheus.CounterOpts{
@@ -274,7 +543,7 @@ func (f MetricsFetcher) scrapeExternalExporterError(tags models.Tags, externalEx
 			"app_name":          tags.AppName,
 			"index":             tags.InstanceID,
 			"instance_id":       tags.InstanceID,
-			"instance":          externalExporter.Host,
+			"instance":          externalExporter.Host.Raw,
 			"name":              externalExporter.Name,
 			"error":             err.Error(),
 		},
@@ -0,0 +1,320 @@
+package fetchers_test
+
+import (
+	"net/http"
+	"net/url"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/ghttp"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/orange-cloudfoundry/promfetcher/caches"
+	"github.com/orange-cloudfoundry/promfetcher/clients"
+	"github.com/orange-cloudfoundry/promfetcher/config"
+	"github.com/orange-cloudfoundry/promfetcher/fetchers"
+	"github.com/orange-cloudfoundry/promfetcher/fetchers/fetchersfakes"
+	"github.com/orange-cloudfoundry/promfetcher/metrics"
+	"github.com/orange-cloudfoundry/promfetcher/models"
+	"github.com/orange-cloudfoundry/promfetcher/scrapers"
+	"github.com/orange-cloudfoundry/promfetcher/stores"
+)
+
+var _ = Describe("MetricsFetcher", func() {
+	var server *ghttp.Server
+	var scraper *scrapers.Scraper
+	var routesFetcher *fetchersfakes.FakeRoutesFetch
+	var endpointCache *caches.EndpointCache
+	var store *stores.MemoryStore
+
+	content := "# TYPE my_metric gauge\nmy_metric{code=\"200\"} 1\nmy_metric{code=\"500\"} 2\n"
+
+	histogram := func(vec *prometheus.HistogramVec, labels prometheus.Labels) *dto.Histogram {
+		m := &dto.Metric{}
+		Expect(vec.With(labels).(prometheus.Metric).Write(m)).To(Succeed())
+		return m.GetHistogram()
+	}
+
+	BeforeEach(func() {
+		c, err := config.DefaultConfig()
+		Expect(err).ShouldNot(HaveOccurred())
+		scraper = scrapers.NewScraper(clients.NewBackendFactory(*c))
+		store = stores.NewMemoryStore()
+		endpointCache = caches.NewEndpointCache(store)
+
+		server = ghttp.NewServer()
+		server.RouteToHandler(http.MethodGet, "/metrics", ghttp.RespondWith(http.StatusOK, content))
+		serverURL, err := url.Parse(server.URL())
+		Expect(err).ShouldNot(HaveOccurred())
+
+		routes := make(models.Routes)
+		routes.RegisterRoute("app.example.net", &models.Route{
+			Address: serverURL.Host,
+			Tags: models.Tags{
+				ProcessType:      "web",
+				AppID:            "9a3a1a3e-8b8c-4f2c-a0e4-3c6b8a2e1f10",
+				AppName:          "app-histograms",
+				SpaceName:        "space-histograms",
+				OrganizationName: "org-histograms",
+				InstanceID:       "0",
+			},
+		})
+		routesFetcher = &fetchersfakes.FakeRoutesFetch{}
+		routesFetcher.RoutesReturns(routes)
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	Context("System metrics", func() {
+		BeforeEach(func() {
+			Expect(store.CreateAppEndpoint(models.AppEndpoint{
+				GUID:          "binding-system",
+				AppGUID:       "9a3a1a3e-8b8c-4f2c-a0e4-3c6b8a2e1f10",
+				SystemMetrics: true,
+			})).To(Succeed())
+			Expect(endpointCache.Load()).To(Succeed())
+		})
+
+		It("builds instance metrics while routes are registered", func() {
+			serverURL, err := url.Parse(server.URL())
+			Expect(err).ShouldNot(HaveOccurred())
+			routes := routesFetcher.Routes()
+			tags := routes.Find("9a3a1a3e-8b8c-4f2c-a0e4-3c6b8a2e1f10")[0].Tags
+
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				for i := 0; i < 100; i++ {
+					routes.RegisterRoute("app.example.net", &models.Route{
+						Address:  serverURL.Host,
+						Tags:     tags,
+						LastSeen: time.Now(),
+					})
+				}
+			}()
+
+			metricsFetcher := fetchers.NewMetricsFetcher(scraper, routesFetcher, nil, endpointCache, config.ScrapeMetricsConfig{})
+			for i := 0; i < 10; i++ {
+				families, err := metricsFetcher.Metrics("9a3a1a3e-8b8c-4f2c-a0e4-3c6b8a2e1f10", "/metrics", false, http.Header{})
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(families).To(HaveKey("promfetcher_app_instance_up"))
+			}
+			<-done
+		})
+
+		It("does not scrape app only bound to system metrics", func() {
+			metricsFetcher := fetchers.NewMetricsFetcher(scraper, routesFetcher, nil, endpointCache, config.ScrapeMetricsConfig{})
+			families, err := metricsFetcher.Metrics("9a3a1a3e-8b8c-4f2c-a0e4-3c6b8a2e1f10", "/metrics", false, http.Header{})
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(families).To(HaveKey("promfetcher_app_instances"))
+			Expect(families).ToNot(HaveKey("my_metric"))
+		})
+
+		It("scrapes default path of app also bound without endpoint", func() {
+			Expect(store.CreateAppEndpoint(models.AppEndpoint{
+				GUID:    "binding-fetch",
+				AppGUID: "9a3a1a3e-8b8c-4f2c-a0e4-3c6b8a2e1f10",
+			})).To(Succeed())
+			Expect(endpointCache.Load()).To(Succeed())
+
+			metricsFetcher := fetchers.NewMetricsFetcher(scraper, routesFetcher, nil, endpointCache, config.ScrapeMetricsConfig{})
+			families, err := metricsFetcher.Metrics("9a3a1a3e-8b8c-4f2c-a0e4-3c6b8a2e1f10", "/metrics", false, http.Header{})
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(families).To(HaveKey("promfetcher_app_instances"))
+			Expect(families["my_metric"].Metric).To(HaveLen(2))
+		})
+	})
+
+	Context("Endpoints", func() {
+		BeforeEach(func() {
+			server.RouteToHandler(http.MethodGet, "/actuator/prometheus", ghttp.RespondWith(http.StatusOK, "# TYPE actuator_metric gauge\nactuator_metric 1\n"))
+		})
+
+		It("scrapes default path and custom endpoint of bindings", func() {
+			Expect(store.CreateAppEndpoint(models.AppEndpoint{
+				GUID:     "binding-custom",
+				AppGUID:  "9a3a1a3e-8b8c-4f2c-a0e4-3c6b8a2e1f10",
+				Endpoint: "/actuator/prometheus",
+			})).To(Succeed())
+			Expect(store.CreateAppEndpoint(models.AppEndpoint{
+				GUID:    "binding-default",
+				AppGUID: "9a3a1a3e-8b8c-4f2c-a0e4-3c6b8a2e1f10",
+			})).To(Succeed())
+			Expect(endpointCache.Load()).To(Succeed())
+
+			metricsFetcher := fetchers.NewMetricsFetcher(scraper, routesFetcher, nil, endpointCache, config.ScrapeMetricsConfig{})
+			families, err := metricsFetcher.Metrics("9a3a1a3e-8b8c-4f2c-a0e4-3c6b8a2e1f10", "/metrics", false, http.Header{})
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(families["my_metric"].Metric).To(HaveLen(2))
+			Expect(families["my_metric"].Metric[0].Label).To(ContainElement(HaveField("GetValue()", "/metrics")))
+			Expect(families["actuator_metric"].Metric[0].Label).To(ContainElement(HaveField("GetValue()", "/actuator/prometheus")))
+		})
+	})
+
+	Context("External exporters", func() {
+		var exporter *ghttp.Server
+
+		BeforeEach(func() {
+			exporter = ghttp.NewServer()
+			exporter.RouteToHandler(http.MethodGet, "/metrics", ghttp.RespondWith(http.StatusOK, "# TYPE exporter_metric gauge\nexporter_metric 1\n"))
+		})
+
+		AfterEach(func() {
+			exporter.Close()
+		})
+
+		loadExporters := func(selectorYAML string) config.ExternalExporters {
+			exporterURL, err := url.Parse(exporter.URL())
+			Expect(err).ShouldNot(HaveOccurred())
+			c, err := config.CheckConfig([]byte("external_exporters:\n- host: " + exporterURL.Host + "\n  selector: " + selectorYAML + "\n"))
+			Expect(err).ShouldNot(HaveOccurred())
+			return c.ExternalExporters
+		}
+
+		It("merges metrics of exporters selecting app", func() {
+			metricsFetcher := fetchers.NewMetricsFetcher(scraper, routesFetcher, loadExporters("{spaces: [space-*]}"), endpointCache, config.ScrapeMetricsConfig{})
+			families, err := metricsFetcher.Metrics("9a3a1a3e-8b8c-4f2c-a0e4-3c6b8a2e1f10", "/metrics", false, http.Header{})
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(families).To(HaveKey("exporter_metric"))
+			Expect(exporter.ReceivedRequests()).To(HaveLen(1))
+		})
+
+		It("does not scrape exporters not selecting app", func() {
+			metricsFetcher := fetchers.NewMetricsFetcher(scraper, routesFetcher, loadExporters("{spaces: [rabbitmq-*]}"), endpointCache, config.ScrapeMetricsConfig{})
+			families, err := metricsFetcher.Metrics("9a3a1a3e-8b8c-4f2c-a0e4-3c6b8a2e1f10", "/metrics", false, http.Header{})
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(families).To(HaveKey("my_metric"))
+			Expect(families).ToNot(HaveKey("exporter_metric"))
+			Expect(exporter.ReceivedRequests()).To(BeEmpty())
+		})
+
+		It("scrapes exporter once while its result is cached", func() {
+			exporterURL, err := url.Parse(exporter.URL())
+			Expect(err).ShouldNot(HaveOccurred())
+			c, err := config.CheckConfig([]byte("external_exporters:\n- host: " + exporterURL.Host + "\n  cache_ttl: 1m\n"))
+			Expect(err).ShouldNot(HaveOccurred())
+
+			metricsFetcher := fetchers.NewMetricsFetcher(scraper, routesFetcher, c.ExternalExporters, endpointCache, config.ScrapeMetricsConfig{})
+			for i := 0; i < 3; i++ {
+				families, err := metricsFetcher.Metrics("9a3a1a3e-8b8c-4f2c-a0e4-3c6b8a2e1f10", "/metrics", false, http.Header{})
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(families["exporter_metric"].Metric).To(HaveLen(1))
+				Expect(families["exporter_metric"].Metric[0].Label).To(ContainElement(HaveField("GetValue()", "app-histograms")))
+			}
+			Expect(exporter.ReceivedRequests()).To(HaveLen(1))
+
+			metricsFetcher.Reload(scraper, c.ExternalExporters, config.ScrapeMetricsConfig{})
+			_, err = metricsFetcher.Metrics("9a3a1a3e-8b8c-4f2c-a0e4-3c6b8a2e1f10", "/metrics", false, http.Header{})
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(exporter.ReceivedRequests()).To(HaveLen(2))
+		})
+
+		Context("when route is shared by apps", func() {
+			BeforeEach(func() {
+				serverURL, err := url.Parse(server.URL())
+				Expect(err).ShouldNot(HaveOccurred())
+				routes := routesFetcher.Routes()
+				routes.RegisterRoute("app.example.net", &models.Route{
+					PrivateInstanceID: "green-0",
+					Address:           serverURL.Host,
+					Tags: models.Tags{
+						ProcessType:      "web",
+						AppID:            "5b0a8e8c-3f57-4c4b-9d3e-2f0c0b8e7a21",
+						AppName:          "app-histograms-green",
+						SpaceName:        "space-histograms",
+						OrganizationName: "org-histograms",
+						InstanceID:       "0",
+					},
+				})
+			})
+
+			exporterLabels := func(family *dto.MetricFamily) map[string]string {
+				labels := make(map[string]string)
+				for _, label := range family.Metric[0].Label {
+					labels[label.GetName()] = label.GetValue()
+				}
+				return labels
+			}
+
+			It("scrapes exporter once and labels it with common tags", func() {
+				metricsFetcher := fetchers.NewMetricsFetcher(scraper, routesFetcher, loadExporters("{spaces: [space-*]}"), endpointCache, config.ScrapeMetricsConfig{})
+				families, err := metricsFetcher.Metrics("app.example.net", "/metrics", false, http.Header{})
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(exporter.ReceivedRequests()).To(HaveLen(1))
+				Expect(families["exporter_metric"].Metric).To(HaveLen(1))
+				Expect(exporterLabels(families["exporter_metric"])).To(SatisfyAll(
+					HaveKeyWithValue("space_name", "space-histograms"),
+					HaveKeyWithValue("organization_name", "org-histograms"),
+					HaveKeyWithValue("app_name", ""),
+					HaveKeyWithValue("app_id", ""),
+				))
+			})
+
+			It("scrapes exporter for each app when its request depends on app", func() {
+				exporterURL, err := url.Parse(exporter.URL())
+				Expect(err).ShouldNot(HaveOccurred())
+				c, err := config.CheckConfig([]byte("external_exporters:\n- host: " + exporterURL.Host + "\n  params:\n    app: [\"{{ .AppName }}\"]\n"))
+				Expect(err).ShouldNot(HaveOccurred())
+
+				metricsFetcher := fetchers.NewMetricsFetcher(scraper, routesFetcher, c.ExternalExporters, endpointCache, config.ScrapeMetricsConfig{})
+				families, err := metricsFetcher.Metrics("app.example.net", "/metrics", false, http.Header{})
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(exporter.ReceivedRequests()).To(HaveLen(2))
+				Expect(families["exporter_metric"].Metric).To(HaveLen(2))
+			})
+		})
+	})
+
+	Context("Scrape metrics", func() {
+		It("observes scrape and fetch with app labels when enabled", func() {
+			metricsFetcher := fetchers.NewMetricsFetcher(scraper, routesFetcher, nil, endpointCache, config.ScrapeMetricsConfig{
+				OrganizationLabel: true,
+				SpaceLabel:        true,
+				AppLabel:          true,
+			})
+			_, err := metricsFetcher.Metrics("9a3a1a3e-8b8c-4f2c-a0e4-3c6b8a2e1f10", "/metrics", false, http.Header{})
+			Expect(err).ShouldNot(HaveOccurred())
+
+			fetchLabels := prometheus.Labels{
+				"organization_name": "org-histograms",
+				"space_name":        "space-histograms",
+				"app_name":          "app-histograms",
+			}
+			scrapeLabels := prometheus.Labels{"source": "app"}
+			for k, v := range fetchLabels {
+				scrapeLabels[k] = v
+			}
+			Expect(histogram(metrics.ScrapeDuration, scrapeLabels).GetSampleCount()).To(Equal(uint64(1)))
+			Expect(histogram(metrics.ScrapeResponseSize, scrapeLabels).GetSampleSum()).To(Equal(float64(len(content))))
+			Expect(histogram(metrics.ScrapeSamples, scrapeLabels).GetSampleSum()).To(Equal(float64(2)))
+			Expect(histogram(metrics.FetchDuration, fetchLabels).GetSampleCount()).To(Equal(uint64(1)))
+		})
+
+		It("does not set app labels by default", func() {
+			noAppLabels := prometheus.Labels{"source": "app", "organization_name": "", "space_name": "", "app_name": ""}
+			before := histogram(metrics.ScrapeSamples, noAppLabels).GetSampleCount()
+
+			metricsFetcher := fetchers.NewMetricsFetcher(scraper, routesFetcher, nil, endpointCache, config.ScrapeMetricsConfig{})
+			_, err := metricsFetcher.Metrics("9a3a1a3e-8b8c-4f2c-a0e4-3c6b8a2e1f10", "/metrics", false, http.Header{})
+			Expect(err).ShouldNot(HaveOccurred())
+
+			Expect(histogram(metrics.ScrapeSamples, noAppLabels).GetSampleCount()).To(Equal(before + 1))
+		})
+
+		It("uses new scrape config after reload", func() {
+			metricsFetcher := fetchers.NewMetricsFetcher(scraper, routesFetcher, nil, endpointCache, config.ScrapeMetricsConfig{})
+			metricsFetcher.Reload(scraper, nil, config.ScrapeMetricsConfig{AppLabel: true})
+			appLabels := prometheus.Labels{"source": "app", "organization_name": "", "space_name": "", "app_name": "app-histograms"}
+			before := histogram(metrics.ScrapeSamples, appLabels).GetSampleCount()
+
+			_, err := metricsFetcher.Metrics("9a3a1a3e-8b8c-4f2c-a0e4-3c6b8a2e1f10", "/metrics", false, http.Header{})
+			Expect(err).ShouldNot(HaveOccurred())
+
+			Expect(histogram(metrics.ScrapeSamples, appLabels).GetSampleCount()).To(Equal(before + 1))
+		})
+	})
+})
@@ -4,7 +4,6 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"net/http"
 	"os"
 	"sync"
 	"time"
@@ -20,27 +19,40 @@ import (
 	"github.com/orange-cloudfoundry/promfetcher/mbus"
 	"github.com/orange-cloudfoundry/promfetcher/metrics"
 	"github.com/orange-cloudfoundry/promfetcher/models"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 //go:generate go run github.com/maxbrunsfeld/counterfeiter/v6 . RoutesFetch
 
+const metricsInterval = 10 * time.Second
+
+// messagesBatchSize is maximum number of pending route messages applied at once to routing table
+const messagesBatchSize = 500
+
 type RoutesFetch interface {
 	Run(signals <-chan os.Signal, ready chan<- struct{}) error
 	Routes() models.Routes
 }
 
 type RoutesFetcher struct {
-	mu              sync.Mutex
-	routes          *models.Routes
-	lastSuccessTime time.Time
-	healthCheck     *healthchecks.HealthCheck
+	mu           sync.Mutex
+	routes       *models.Routes
+	lastRegister time.Time
+	healthCheck  *healthchecks.HealthCheck
 
 	mbusClient       mbus.Client
-	subscription     *nats.Subscription
+	subscriptions    []*nats.Subscription
+	messages         chan *nats.Msg
+	subjectCounters  map[string]subjectCounters
+	invalidLogger    *logLimiter
 	reconnected      <-chan mbus.Signal
 	natsPendingLimit int
 	http2Enabled     bool
 
+	snapshotPath     string
+	snapshotInterval time.Duration
+	staleThreshold   time.Duration
+
 	params startMessageParams
 }
 
@@ -77,6 +89,14 @@ func NewRoutesFetcher(mbusClient mbus.Client, c *config.Config, reconnected <-ch
 		natsPendingLimit: c.NatsClientMessageBufferSize,
 		http2Enabled:     c.EnableHTTP2,
 		healthCheck:      healthCheck,
+		invalidLogger:    newLogLimiter(10 * time.Second),
+		subjectCounters: map[string]subjectCounters{
+			"router.register":   newSubjectCounters("router.register"),
+			"router.unregister": newSubjectCounters("router.unregister"),
+		},
+		snapshotPath:     c.RoutesSnapshot.Path,
+		snapshotInterval: c.RoutesSnapshot.Interval,
+		staleThreshold:   c.DropletStaleThreshold,
 	}
 }
 
@@ -86,6 +106,8 @@ func (f *RoutesFetcher) Run(signals <-chan os.Signal, ready chan<- struct{}) err
 	if f.mbusClient == nil {
 		return errors.New("subscriber: nil mbus client")
 	}
+	// routes from snapshot let apps be scraped before being announced again
+	provisional := f.loadSnapshot()
 	err := f.sendStartMessage()
 	if err != nil {
 		return err
@@ -94,46 +116,187 @@ func (f *RoutesFetcher) Run(signals <-chan os.Signal, ready chan<- struct{}) err
 	if err != nil {
 		return err
 	}
-	f.subscription, err = f.subscribeRoutes()
+	err = f.subscribeRoutes()
 	if err != nil {
 		return err
 	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go f.handleMessages(stop)
 	close(ready)
 
 	log.Info("subscriber-started")
 
+	metricsTicker := time.NewTicker(metricsInterval)
+	defer metricsTicker.Stop()
+
+	var snapshotTick <-chan time.Time
+	if f.snapshotPath != "" && f.snapshotInterval > 0 {
+		ticker := time.NewTicker(f.snapshotInterval)
+		defer ticker.Stop()
+		snapshotTick = ticker.C
+	}
+	var pruneProvisional <-chan time.Time
+	if provisional > 0 {
+		pruneProvisional = time.After(f.staleThreshold)
+	}
+
 	for {
 		select {
 		case <-f.reconnected:
+			metrics.NatsReconnectsTotal.Inc()
 			err := f.sendStartMessage()
 			if err != nil {
 				log.Errorf("failed-to-send-start-message: %s", err.Error())
 			}
+		case <-metricsTicker.C:
+			f.UpdateMetrics()
+		case <-snapshotTick:
+			f.saveSnapshot()
+		case <-pruneProvisional:
+			nb := f.routes.PruneProvisional()
+			log.Infof("%d routes from snapshot not announced again have been pruned", nb)
 		case <-signals:
+			f.saveSnapshot()
 			log.Info("exited")
 			return nil
 		}
 	}
 }
 
+// WaitStable waits until number of routes has not changed during window, this let gorouters
+// answer to router.start before promfetcher is considered as ready. It gives up waiting after maxWait
+// if routes keep changing, false is given only when stop is closed before.
+func WaitStable(routesFetcher RoutesFetch, window, maxWait time.Duration, stop <-chan struct{}) bool {
+	tick := time.Second
+	if window < tick {
+		tick = window
+	}
+	if tick <= 0 {
+		return true
+	}
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+
+	start := time.Now()
+	lastChange := start
+	lastLen := routesFetcher.Routes().Len()
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return false
+		}
+		now := time.Now()
+		if nb := routesFetcher.Routes().Len(); nb != lastLen {
+			lastLen = nb
+			lastChange = now
+		}
+		if now.Sub(lastChange) >= window {
+			log.Infof("routing table stable with %d routes", lastLen)
+			return true
+		}
+		if maxWait > 0 && now.Sub(start) >= maxWait {
+			log.Warnf("routing table still changing after %s, set ready with %d routes", maxWait, lastLen)
+			return true
+		}
+	}
+}
+
+// UpdateMetrics sets gauges about routing table and NATS subscription
+func (f *RoutesFetcher) UpdateMetrics() {
+	stats := f.Routes().Stats()
+	metrics.Routes.Reset()
+	for processType, nb := range stats.RoutesByProcessType {
+		metrics.Routes.WithLabelValues(processType).Set(float64(nb))
+	}
+	metrics.Apps.Set(float64(stats.Apps))
+	metrics.Instances.Set(float64(stats.Instances))
+
+	f.mu.Lock()
+	lastRegister := f.lastRegister
+	f.mu.Unlock()
+	if !lastRegister.IsZero() {
+		metrics.LastRouteRegisterAge.Set(time.Since(lastRegister).Seconds())
+	}
+
+	if len(f.subscriptions) == 0 {
+		return
+	}
+	if pending, err := f.Pending(); err == nil {
+		metrics.NatsPendingMessages.Set(float64(pending))
+	}
+	if dropped, err := f.Dropped(); err == nil {
+		metrics.NatsDroppedMessages.Set(float64(dropped))
+	}
+}
+
+// HealthReport reports subscription and routing table state for detailed health report
+func (f *RoutesFetcher) HealthReport() healthchecks.ComponentReport {
+	nbRoutes := f.Routes().Len()
+	report := healthchecks.ComponentReport{
+		Status: healthchecks.StatusUp,
+		Details: map[string]interface{}{
+			"routes": nbRoutes,
+		},
+	}
+	f.mu.Lock()
+	lastRegister := f.lastRegister
+	f.mu.Unlock()
+	if !lastRegister.IsZero() {
+		report.Details["last_registration_age_seconds"] = time.Since(lastRegister).Seconds()
+	}
+
+	pending, err := f.Pending()
+	if err != nil {
+		report.Status = healthchecks.StatusDown
+		report.Error = err.Error()
+		return report
+	}
+	dropped, err := f.Dropped()
+	if err != nil {
+		report.Status = healthchecks.StatusDown
+		report.Error = err.Error()
+		return report
+	}
+	report.Details["pending"] = pending
+	report.Details["dropped"] = dropped
+
+	if pending >= f.natsPendingLimit {
+		report.Status = healthchecks.StatusDegraded
+		report.Error = "too many pending messages, routes are registered too slowly"
+	} else if nbRoutes == 0 {
+		report.Status = healthchecks.StatusDegraded
+		report.Error = "routing table is empty"
+	}
+	return report
+}
+
+// Pending gives number of messages waiting to be handled on route subscriptions
 func (f *RoutesFetcher) Pending() (int, error) {
-	if f.subscription == nil {
+	if len(f.subscriptions) == 0 {
 		log.Error("failed-to-get-subscription")
 		return -1, errors.New("NATS subscription is nil, Subscriber must be invoked")
 	}
-
-	msgs, _, err := f.subscription.Pending()
-	return msgs, err
+	return len(f.messages), nil
 }
 
+// Dropped gives number of messages dropped on all route subscriptions because of pending limits
 func (f *RoutesFetcher) Dropped() (int, error) {
-	if f.subscription == nil {
+	if len(f.subscriptions) == 0 {
 		log.Error("failed-to-get-subscription")
 		return -1, errors.New("NATS subscription is nil, Subscriber must be invoked")
 	}
 
-	msgs, err := f.subscription.Dropped()
-	return msgs, err
+	total := 0
+	for _, subscription := range f.subscriptions {
+		msgs, err := subscription.Dropped()
+		if err != nil {
+			return -1, err
+		}
+		total += msgs
+	}
+	return total, nil
 }
 
 func (f *RoutesFetcher) subscribeToGreetMessage() error {
@@ -145,34 +308,116 @@ func (f *RoutesFetcher) subscribeToGreetMessage() error {
 	return err
 }
 
-func (f *RoutesFetcher) subscribeRoutes() (*nats.Subscription, error) {
-	natsSubscription, err := f.mbusClient.Subscribe("router.*", func(message *nats.Msg) {
-		msg, err := mbus.CreateMessage(message.Data)
+// subscribeRoutes subscribes to register and unregister subjects only, other router subjects
+// (e.g. router.start or router.greet) are not wanted here. Both subjects are delivered in the same channel
+// to apply register and unregister of a route in the order they were sent, pending messages are limited
+// by channel size
+func (f *RoutesFetcher) subscribeRoutes() error {
+	f.messages = make(chan *nats.Msg, f.natsPendingLimit)
+	for _, subject := range []string{"router.register", "router.unregister"} {
+		natsSubscription, err := f.mbusClient.ChanSubscribe(subject, f.messages)
 		if err != nil {
-			log.Errorf("validation-error: %s", err.Error())
-			log.Errorf("payload: %s", string(message.Data))
-			log.Errorf("subject: %s", message.Subject)
+			return err
+		}
+		f.subscriptions = append(f.subscriptions, natsSubscription)
+	}
+	return nil
+}
+
+// handleMessages applies route messages until stop is closed, messages pending are applied
+// by batch to not lock routing table for each of them
+func (f *RoutesFetcher) handleMessages(stop <-chan struct{}) {
+	batch := make([]*nats.Msg, 0, messagesBatchSize)
+	for {
+		select {
+		case message := <-f.messages:
+			batch = append(batch[:0], message)
+		case <-stop:
 			return
 		}
-		switch message.Subject {
-		case "router.register":
-			f.registerRoute(msg)
-		case "router.unregister":
-			f.unregisterRoute(msg)
-		default:
+	pending:
+		for len(batch) < messagesBatchSize {
+			select {
+			case message := <-f.messages:
+				batch = append(batch, message)
+			default:
+				break pending
+			}
 		}
-	})
+		f.applyMessages(batch)
+	}
+}
 
-	if err != nil {
-		return nil, err
+type subjectCounters struct {
+	received prometheus.Counter
+	decoded  prometheus.Counter
+	invalid  prometheus.Counter
+}
+
+func newSubjectCounters(subject string) subjectCounters {
+	return subjectCounters{
+		received: metrics.NatsMessagesReceivedTotal.WithLabelValues(subject),
+		decoded:  metrics.NatsMessagesDecodedTotal.WithLabelValues(subject),
+		invalid:  metrics.NatsMessagesInvalidTotal.WithLabelValues(subject),
 	}
+}
 
-	err = natsSubscription.SetPendingLimits(f.natsPendingLimit, f.natsPendingLimit*1024)
-	if err != nil {
-		return nil, fmt.Errorf("subscriber: SetPendingLimits: %s", err)
+// applyMessages decodes route messages in pooled messages to not allocate a new one on each message,
+// route-emitters send a lot of them, and applies them in order to routing table
+func (f *RoutesFetcher) applyMessages(messages []*nats.Msg) {
+	changes := make([]models.RouteChange, 0, len(messages))
+	decodedMsgs := make([]*mbus.Message, 0, len(messages))
+	defer func() {
+		for _, msg := range decodedMsgs {
+			mbus.ReleaseMessage(msg)
+		}
+	}()
+
+	registered, unregistered := 0, 0
+	for _, message := range messages {
+		counters, ok := f.subjectCounters[message.Subject]
+		if !ok {
+			continue
+		}
+		counters.received.Inc()
+		msg := mbus.AcquireMessage()
+		decodedMsgs = append(decodedMsgs, msg)
+		err := mbus.DecodeMessage(message.Data, msg)
+		if err != nil {
+			counters.invalid.Inc()
+			f.invalidLogger.Errorf("validation-error on subject %s: %s (payload: %s)", message.Subject, err.Error(), string(message.Data))
+			continue
+		}
+		counters.decoded.Inc()
+
+		unregister := message.Subject == "router.unregister"
+		route, ok := f.appRoute(msg, unregister)
+		if !ok {
+			continue
+		}
+		changes = append(changes, models.RouteChange{
+			Uris:       msg.Uris,
+			Route:      route,
+			Unregister: unregister,
+		})
+		if unregister {
+			unregistered++
+		} else {
+			registered++
+		}
+	}
+	if len(changes) == 0 {
+		return
 	}
 
-	return natsSubscription, nil
+	f.routes.Apply(changes)
+	if registered > 0 {
+		f.mu.Lock()
+		f.lastRegister = time.Now()
+		f.mu.Unlock()
+	}
+	metrics.RouteRegistrationsTotal.Add(float64(registered))
+	metrics.RouteUnregistrationsTotal.Add(float64(unregistered))
 }
 
 func (f *RoutesFetcher) startMessage() ([]byte, error) {
@@ -204,42 +449,24 @@ func (f *RoutesFetcher) sendStartMessage() error {
 	return f.mbusClient.Publish("router.start", message)
 }
 
-func (f *RoutesFetcher) registerRoute(msg *mbus.Message) {
+// appRoute gives route of a message, false is given when message is not about an app
+func (f *RoutesFetcher) appRoute(msg *mbus.Message, unregister bool) (*models.Route, bool) {
+	action := "register"
+	if unregister {
+		action = "unregister"
+	}
 	route, err := msg.MakeRoute(f.http2Enabled)
 	if err != nil {
-		log.Errorf("Unable to register route %s", err.Error())
+		log.Errorf("Unable to %s route %s", action, err.Error())
 		metrics.ScrapeRouteFailedTotal.With(map[string]string{}).Inc()
-		return
+		return nil, false
 	}
 
 	if route.Tags.AppID == "" {
-		log.Debugf("Dropped because it is not an app route (%s)", msg.Uris[0])
-		return
-	}
-
-	for _, uri := range msg.Uris {
-		f.routes.RegisterRoute(uri, route)
-	}
-	metrics.LatestScrapeRoute.With(map[string]string{}).Set(time.Since(f.lastSuccessTime).Seconds())
-}
-
-func (f *RoutesFetcher) unregisterRoute(msg *mbus.Message) {
-	endpoint, err := msg.MakeRoute(f.http2Enabled)
-	if err != nil {
-		log.Errorf("Unable to unregister route %s", err.Error())
-		metrics.ScrapeRouteFailedTotal.With(map[string]string{}).Inc()
-		return
-	}
-
-	if endpoint.Tags.AppID == "" {
-		log.Debugf("Dropped because it is not an app endpoint (%s)", msg.Uris[0])
-		return
+		log.Debugf("Dropped %s because it is not an app route (%v)", action, msg.Uris)
+		return nil, false
 	}
-
-	for _, uri := range msg.Uris {
-		f.routes.UnregisterRoute(uri, endpoint)
-	}
-	metrics.LatestScrapeRoute.With(map[string]string{}).Set(time.Since(f.lastSuccessTime).Seconds())
+	return route, true
 }
 
 func (f *RoutesFetcher) Routes() models.Routes {
@@ -248,16 +475,3 @@ func (f *RoutesFetcher) Routes() models.Routes {
 	}
 	return *f.routes
 }
-
-func (f *RoutesFetcher) RouteHandler(w http.ResponseWriter, req *http.Request) {
-	headers := &http.Header{}
-	auth := req.Header.Get("Authorization")
-	if auth != "" {
-		headers.Set("Authorization", auth)
-	}
-	headers.Set("Content-Type", "application/json")
-
-	routes := f.Routes().String()
-	w.WriteHeader(http.StatusOK)
-	_, _ = w.Write([]byte(routes))
-}
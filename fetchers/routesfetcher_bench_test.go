@@ -0,0 +1,48 @@
+package fetchers
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/nats-io/nats.go"
+
+	"github.com/orange-cloudfoundry/promfetcher/config"
+	"github.com/orange-cloudfoundry/promfetcher/healthchecks"
+)
+
+// BenchmarkRegisterMessages handles register messages as route-emitters send them,
+// i.e. the same routes announced again and again by batches
+func BenchmarkRegisterMessages(b *testing.B) {
+	c, err := config.DefaultConfig()
+	if err != nil {
+		b.Fatal(err)
+	}
+	f := NewRoutesFetcher(nil, c, nil, healthchecks.NewHealthCheck())
+	messages := make([]*nats.Msg, 1000)
+	for i := range messages {
+		messages[i] = &nats.Msg{
+			Subject: "router.register",
+			Data: []byte(fmt.Sprintf(`{"host":"10.0.%d.%d","port":61000,"tls_port":61001,"uris":["app%d.example.net","app%d.apps.internal"],`+
+				`"private_instance_id":"instance-%d","private_instance_index":"0","server_cert_domain_san":"instance-%d",`+
+				`"tags":{"app_id":"d245c244-1875-a718-1248-%012d","app_name":"app%d","process_type":"web","instance_id":"0",`+
+				`"organization_name":"my org","space_name":"myspace","component":"route-emitter"}}`,
+				i/250, i%250, i/2, i/2, i, i, i/2, i/2)),
+		}
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	batchSize := 100
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			start := (i * batchSize) % len(messages)
+			f.applyMessages(messages[start : start+batchSize])
+			i++
+		}
+	})
+	b.StopTimer()
+	if f.Routes().Len() == 0 {
+		b.Fatal("no route registered")
+	}
+}
@@ -0,0 +1,165 @@
+package fetchers_test
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/nats-io/nats.go"
+
+	"github.com/orange-cloudfoundry/promfetcher/config"
+	"github.com/orange-cloudfoundry/promfetcher/fetchers"
+	"github.com/orange-cloudfoundry/promfetcher/healthchecks"
+	"github.com/orange-cloudfoundry/promfetcher/mbus/mbusfakes"
+	"github.com/orange-cloudfoundry/promfetcher/metrics"
+	"github.com/orange-cloudfoundry/promfetcher/models"
+)
+
+var _ = Describe("RoutesFetcher", func() {
+	var routesFetcher *fetchers.RoutesFetcher
+
+	BeforeEach(func() {
+		c, err := config.DefaultConfig()
+		Expect(err).ShouldNot(HaveOccurred())
+		routesFetcher = fetchers.NewRoutesFetcher(nil, c, nil, healthchecks.NewHealthCheck())
+	})
+
+	registerRoute := func(i int) {
+		routesFetcher.Routes().RegisterRoute(models.Uri(fmt.Sprintf("app%d.example.net", i)), &models.Route{
+			Address: fmt.Sprintf("10.0.0.%d:61000", i),
+			Tags: models.Tags{
+				ProcessType: "web",
+				AppID:       "d245c244-1875-a718-1248-2547e141a45c",
+			},
+		})
+	}
+
+	Context("WaitStable", func() {
+		It("waits until number of routes stops changing", func() {
+			stop := make(chan struct{})
+			defer close(stop)
+			stable := make(chan bool)
+			go func() {
+				stable <- fetchers.WaitStable(routesFetcher, 100*time.Millisecond, 0, stop)
+			}()
+
+			for i := 0; i < 5; i++ {
+				registerRoute(i)
+				Consistently(stable, 40*time.Millisecond).ShouldNot(Receive())
+			}
+			Eventually(stable).Should(Receive(BeTrue()))
+			Expect(routesFetcher.Routes().Len()).To(Equal(5))
+		})
+
+		It("gives up waiting after max wait", func() {
+			stop := make(chan struct{})
+			defer close(stop)
+			done := make(chan struct{})
+			defer close(done)
+			go func() {
+				for i := 0; ; i++ {
+					select {
+					case <-done:
+						return
+					case <-time.After(10 * time.Millisecond):
+						registerRoute(i)
+					}
+				}
+			}()
+
+			Expect(fetchers.WaitStable(routesFetcher, 100*time.Millisecond, 200*time.Millisecond, stop)).To(BeTrue())
+		})
+
+		It("stops waiting when asked", func() {
+			stop := make(chan struct{})
+			close(stop)
+			Expect(fetchers.WaitStable(routesFetcher, time.Minute, 0, stop)).To(BeFalse())
+		})
+	})
+
+	Context("UpdateMetrics", func() {
+		gaugeValue := func(g prometheus.Gauge) float64 {
+			m := &dto.Metric{}
+			Expect(g.Write(m)).To(Succeed())
+			return m.GetGauge().GetValue()
+		}
+
+		It("sets gauges from routing table", func() {
+			for i := 0; i < 3; i++ {
+				registerRoute(i)
+			}
+			routesFetcher.Routes().RegisterRoute("worker.example.net", &models.Route{
+				Address: "10.0.1.1:61000",
+				Tags: models.Tags{
+					ProcessType: "worker",
+					AppID:       "e1b9d3a0-3e4d-4f5b-9c1f-6d5e3b0a7c21",
+				},
+			})
+
+			routesFetcher.UpdateMetrics()
+
+			Expect(gaugeValue(metrics.Routes.WithLabelValues("web"))).To(Equal(float64(3)))
+			Expect(gaugeValue(metrics.Routes.WithLabelValues("worker"))).To(Equal(float64(1)))
+			Expect(gaugeValue(metrics.Apps)).To(Equal(float64(2)))
+			Expect(gaugeValue(metrics.Instances)).To(Equal(float64(4)))
+		})
+	})
+
+	Context("Messages", func() {
+		var mbusClient *mbusfakes.FakeClient
+		var signals chan os.Signal
+		var runErr chan error
+
+		routeMessage := func(subject, host string) *nats.Msg {
+			return &nats.Msg{
+				Subject: subject,
+				Data: []byte(`{"host":"` + host + `","port":61000,"uris":["app.example.net"],"private_instance_id":"instance-0",` +
+					`"tags":{"app_id":"d245c244-1875-a718-1248-2547e141a45c","app_name":"app","process_type":"web","instance_id":"0"}}`),
+			}
+		}
+
+		BeforeEach(func() {
+			c, err := config.DefaultConfig()
+			Expect(err).ShouldNot(HaveOccurred())
+			mbusClient = &mbusfakes.FakeClient{}
+			routesFetcher = fetchers.NewRoutesFetcher(mbusClient, c, nil, healthchecks.NewHealthCheck())
+
+			signals = make(chan os.Signal)
+			ready := make(chan struct{})
+			runErr = make(chan error, 1)
+			go func() {
+				runErr <- routesFetcher.Run(signals, ready)
+			}()
+			Eventually(ready).Should(BeClosed())
+		})
+
+		AfterEach(func() {
+			signals <- os.Interrupt
+			Eventually(runErr).Should(Receive(BeNil()))
+		})
+
+		It("applies register and unregister messages in order they were sent", func() {
+			Expect(mbusClient.ChanSubscribeCallCount()).To(Equal(2))
+			registerSubject, messages := mbusClient.ChanSubscribeArgsForCall(0)
+			unregisterSubject, unregisterMessages := mbusClient.ChanSubscribeArgsForCall(1)
+			Expect([]string{registerSubject, unregisterSubject}).To(ConsistOf("router.register", "router.unregister"))
+			Expect(unregisterMessages).To(Equal(messages))
+
+			for i := 0; i < 100; i++ {
+				messages <- routeMessage("router.register", "10.0.0.1")
+				messages <- routeMessage("router.unregister", "10.0.0.1")
+			}
+			// last message is handled once other app route is there
+			messages <- routeMessage("router.register", "10.0.0.2")
+			Eventually(func() []*models.Route {
+				return routesFetcher.Routes().Find("app.example.net")
+			}).Should(HaveLen(1))
+			Expect(routesFetcher.Routes().Find("app.example.net")[0].Address).To(Equal("10.0.0.2:61000"))
+		})
+	})
+})
@@ -0,0 +1,67 @@
+package fetchers
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// loadSnapshot loads routing table saved on a previous run, loaded routes are provisional
+// until gorouters announce them again, it gives number of routes loaded
+func (f *RoutesFetcher) loadSnapshot() int {
+	if f.snapshotPath == "" {
+		return 0
+	}
+	b, err := os.ReadFile(f.snapshotPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0
+	}
+	if err != nil {
+		log.Warnf("Cannot read routes snapshot, starting with an empty routing table: %s", err.Error())
+		return 0
+	}
+	nb, err := f.routes.LoadSnapshot(b)
+	if err != nil {
+		log.Warnf("Cannot load routes snapshot, starting with an empty routing table: %s", err.Error())
+		return 0
+	}
+	log.Infof("%d routes loaded from snapshot %s", nb, f.snapshotPath)
+	return nb
+}
+
+// saveSnapshot writes routing table in a temporary file which replace the snapshot file
+// to never leave a partially written snapshot
+func (f *RoutesFetcher) saveSnapshot() {
+	if f.snapshotPath == "" {
+		return
+	}
+	err := f.writeSnapshot()
+	if err != nil {
+		log.Errorf("Cannot write routes snapshot: %s", err.Error())
+	}
+}
+
+func (f *RoutesFetcher) writeSnapshot() error {
+	b, err := f.routes.Snapshot()
+	if err != nil {
+		return err
+	}
+	tmpFile, err := os.CreateTemp(filepath.Dir(f.snapshotPath), filepath.Base(f.snapshotPath)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+	_, err = tmpFile.Write(b)
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpFile.Name(), f.snapshotPath)
+}
@@ -0,0 +1,89 @@
+package fetchers
+
+import (
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/orange-cloudfoundry/promfetcher/models"
+	"github.com/orange-cloudfoundry/promfetcher/scrapers"
+)
+
+// appSystemMetrics builds metrics for apps bound to system metrics plan from what promfetcher knows about the app
+func (f *MetricsFetcher) appSystemMetrics(tags models.Tags, nbInstances int) map[string]*dto.MetricFamily {
+	metricsGroup := map[string]*dto.MetricFamily{
+		"promfetcher_app_instances": gaugeFamily(
+			"promfetcher_app_instances",
+			"Number of app instances registered in routing table",
+			gaugeMetric(float64(nbInstances)),
+		),
+	}
+	f.labelMetrics(&models.Route{Tags: tags}, metricsGroup)
+	return metricsGroup
+}
+
+// instanceSystemMetrics builds metrics for an app instance of an app bound to system metrics plan
+// from its routes registration and by checking if instance is reachable
+func (f *MetricsFetcher) instanceSystemMetrics(scraper *scrapers.Scraper, route *models.Route, uris []models.Uri) map[string]*dto.MetricFamily {
+	routesInfo := make([]*dto.Metric, len(uris))
+	for i, uri := range uris {
+		routesInfo[i] = gaugeMetric(1, &dto.LabelPair{
+			Name:  ptrString("uri"),
+			Value: ptrString(uri.String()),
+		})
+	}
+	tls := 0.0
+	if route.TLS {
+		tls = 1
+	}
+	up := 1.0
+	if err := scraper.Probe(route); err != nil {
+		up = 0
+	}
+
+	metricsGroup := map[string]*dto.MetricFamily{
+		"promfetcher_app_instance_route_info": gaugeFamily(
+			"promfetcher_app_instance_route_info",
+			"Routes registered for app instance",
+			routesInfo...,
+		),
+		"promfetcher_app_instance_tls": gaugeFamily(
+			"promfetcher_app_instance_tls",
+			"Whether app instance is reached with tls (1 for tls)",
+			gaugeMetric(tls),
+		),
+		"promfetcher_app_instance_last_seen_timestamp_seconds": gaugeFamily(
+			"promfetcher_app_instance_last_seen_timestamp_seconds",
+			"Last time app instance routes has been registered, in seconds since epoch",
+			gaugeMetric(float64(route.LastSeen.Unix())),
+		),
+		"promfetcher_app_instance_up": gaugeFamily(
+			"promfetcher_app_instance_up",
+			"Whether app instance is reachable by promfetcher (1 for reachable)",
+			gaugeMetric(up),
+		),
+	}
+	if len(routesInfo) == 0 {
+		delete(metricsGroup, "promfetcher_app_instance_route_info")
+	}
+	if route.LastSeen.IsZero() {
+		delete(metricsGroup, "promfetcher_app_instance_last_seen_timestamp_seconds")
+	}
+	f.labelMetrics(route, metricsGroup)
+	return metricsGroup
+}
+
+func gaugeFamily(name, help string, metrics ...*dto.Metric) *dto.MetricFamily {
+	metricType := dto.MetricType_GAUGE
+	return &dto.MetricFamily{
+		Name:   ptrString(name),
+		Help:   ptrString(help),
+		Type:   &metricType,
+		Metric: metrics,
+	}
+}
+
+func gaugeMetric(value float64, labels ...*dto.LabelPair) *dto.Metric {
+	return &dto.Metric{
+		Label: labels,
+		Gauge: &dto.Gauge{Value: &value},
+	}
+}
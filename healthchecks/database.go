@@ -0,0 +1,97 @@
+package healthchecks
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const ComponentDatabase = "database"
+
+const dbMinBackoff = time.Second
+
+// Pinger is a connection which can be checked, e.g. *sql.DB
+type Pinger interface {
+	Ping() error
+}
+
+// DBMonitor pings database periodically and tracks it as a degraded component in health check
+// instead of exiting, sql pool reconnects by itself so ping is only retried with a backoff until database is back
+type DBMonitor struct {
+	db          Pinger
+	healthCheck *HealthCheck
+	interval    time.Duration
+	onRecovered func() error
+}
+
+// NewDBMonitor creates a monitor pinging database on each interval, onRecovered is called
+// when database is back after an outage and can be nil, database stays degraded when it fails
+// and onRecovered is retried on next check
+func NewDBMonitor(db Pinger, healthCheck *HealthCheck, interval time.Duration, onRecovered func() error) *DBMonitor {
+	return &DBMonitor{
+		db:          db,
+		healthCheck: healthCheck,
+		interval:    interval,
+		onRecovered: onRecovered,
+	}
+}
+
+// Check pings database and set health of database component, returns true when database is up
+func (m *DBMonitor) Check() bool {
+	err := m.db.Ping()
+	wasDegraded := m.healthCheck.DegradedComponents()[ComponentDatabase] != nil
+	if err != nil {
+		if !wasDegraded {
+			log.Errorf("Error when pinging database, running in degraded mode: %s", err.Error())
+		}
+		m.healthCheck.SetComponentDegraded(ComponentDatabase, err)
+		return false
+	}
+	if wasDegraded {
+		if m.onRecovered != nil {
+			if err := m.onRecovered(); err != nil {
+				log.Errorf("Database is reachable but still degraded: %s", err.Error())
+				m.healthCheck.SetComponentDegraded(ComponentDatabase, err)
+				return false
+			}
+		}
+		log.Info("Database is reachable again")
+		m.healthCheck.SetComponentHealthy(ComponentDatabase)
+	}
+	return true
+}
+
+// Run checks database until stop is closed, when database is down it is checked again
+// with an exponential backoff starting at one second and capped at interval
+func (m *DBMonitor) Run(stop <-chan struct{}) {
+	backoff := m.minBackoff()
+	for {
+		wait := m.interval
+		if !m.Check() {
+			wait = backoff
+			backoff *= 2
+			if backoff > m.interval {
+				backoff = m.interval
+			}
+		} else {
+			backoff = m.minBackoff()
+		}
+		select {
+		case <-time.After(wait):
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (m *DBMonitor) minBackoff() time.Duration {
+	if m.interval < dbMinBackoff {
+		return m.interval
+	}
+	return dbMinBackoff
+}
+
+// Report pings database for detailed report
+func (m *DBMonitor) Report() ComponentReport {
+	return ReportFromError(m.db.Ping())
+}
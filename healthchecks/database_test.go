@@ -0,0 +1,116 @@
+package healthchecks_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/orange-cloudfoundry/promfetcher/healthchecks"
+)
+
+type fakePinger struct {
+	mu    sync.Mutex
+	err   error
+	pings int
+}
+
+func (p *fakePinger) Ping() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.pings++
+	return p.err
+}
+
+func (p *fakePinger) SetErr(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.err = err
+}
+
+func (p *fakePinger) Pings() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.pings
+}
+
+var _ = Describe("DBMonitor", func() {
+	var pinger *fakePinger
+	var healthCheck *healthchecks.HealthCheck
+	var recovered int
+	var monitor *healthchecks.DBMonitor
+
+	BeforeEach(func() {
+		pinger = &fakePinger{}
+		healthCheck = healthchecks.NewHealthCheck()
+		healthCheck.SetHealth(healthchecks.Healthy)
+		recovered = 0
+		monitor = healthchecks.NewDBMonitor(pinger, healthCheck, time.Hour, func() error {
+			recovered++
+			return nil
+		})
+	})
+
+	It("marks database as degraded without making promfetcher unhealthy", func() {
+		pinger.SetErr(errors.New("connection refused"))
+		Expect(monitor.Check()).To(BeFalse())
+
+		Expect(healthCheck.Health()).To(Equal(healthchecks.Healthy))
+		Expect(healthCheck.DegradedComponents()).To(HaveKeyWithValue(
+			healthchecks.ComponentDatabase, MatchError("connection refused"),
+		))
+
+		rec := httptest.NewRecorder()
+		healthCheck.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		Expect(rec.Code).To(Equal(http.StatusOK))
+		Expect(rec.Body.String()).To(Equal("degraded database: connection refused\nok\n"))
+	})
+
+	It("marks database as healthy again when it recovers", func() {
+		Expect(monitor.Check()).To(BeTrue())
+		Expect(recovered).To(Equal(0))
+
+		pinger.SetErr(errors.New("connection refused"))
+		monitor.Check()
+		pinger.SetErr(nil)
+		Expect(monitor.Check()).To(BeTrue())
+
+		Expect(healthCheck.DegradedComponents()).To(BeEmpty())
+		Expect(recovered).To(Equal(1))
+	})
+
+	It("stays degraded until recovery succeeds", func() {
+		recoverErr := errors.New("migration failed")
+		monitor = healthchecks.NewDBMonitor(pinger, healthCheck, time.Hour, func() error {
+			recovered++
+			return recoverErr
+		})
+		healthCheck.SetComponentDegraded(healthchecks.ComponentDatabase, errors.New("connection refused"))
+
+		Expect(monitor.Check()).To(BeFalse())
+		Expect(healthCheck.DegradedComponents()).To(HaveKeyWithValue(
+			healthchecks.ComponentDatabase, MatchError("migration failed"),
+		))
+
+		recoverErr = nil
+		Expect(monitor.Check()).To(BeTrue())
+		Expect(healthCheck.DegradedComponents()).To(BeEmpty())
+		Expect(recovered).To(Equal(2))
+	})
+
+	It("retries with backoff while database is down", func() {
+		pinger.SetErr(errors.New("connection refused"))
+		monitor = healthchecks.NewDBMonitor(pinger, healthCheck, 20*time.Millisecond, nil)
+		stop := make(chan struct{})
+		defer close(stop)
+		go monitor.Run(stop)
+
+		Eventually(pinger.Pings).Should(BeNumerically(">=", 3))
+		pinger.SetErr(nil)
+		Eventually(healthCheck.DegradedComponents).Should(BeEmpty())
+	})
+})
@@ -0,0 +1,137 @@
+package healthchecks
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// DetailsCacheTTL is how long checkers results are reused in detailed report,
+// checkers reach external services and must not be run on each request
+const DetailsCacheTTL = 5 * time.Second
+
+type ComponentStatus string
+
+const (
+	StatusUp       ComponentStatus = "up"
+	StatusDegraded ComponentStatus = "degraded"
+	StatusDown     ComponentStatus = "down"
+)
+
+// ComponentReport is health of a component given in detailed report
+type ComponentReport struct {
+	Status  ComponentStatus        `json:"status"`
+	Error   string                 `json:"error,omitempty"`
+	Details map[string]interface{} `json:"details,omitempty"`
+}
+
+// Checker gives current health of a component
+type Checker func() ComponentReport
+
+type DetailsReport struct {
+	Status     string                     `json:"status"`
+	Components map[string]ComponentReport `json:"components"`
+}
+
+// RegisterChecker adds a component in detailed report
+func (h *HealthCheck) RegisterChecker(component string, checker Checker) {
+	h.mu.Lock()
+	h.checkers[component] = checker
+	h.mu.Unlock()
+	h.invalidateReports()
+}
+
+// UnregisterChecker removes a component from detailed report
+func (h *HealthCheck) UnregisterChecker(component string) {
+	h.mu.Lock()
+	delete(h.checkers, component)
+	h.mu.Unlock()
+	h.invalidateReports()
+}
+
+func (h *HealthCheck) invalidateReports() {
+	h.detailsMu.Lock()
+	defer h.detailsMu.Unlock()
+	h.reports = nil
+}
+
+// Details gives reports of checkers, components set as degraded without checker are also reported.
+// Checkers results are reused during DetailsCacheTTL
+func (h *HealthCheck) Details() DetailsReport {
+	report := DetailsReport{
+		Status:     h.String(),
+		Components: make(map[string]ComponentReport),
+	}
+	for component, componentReport := range h.checkerReports() {
+		report.Components[component] = componentReport
+	}
+	for component, reason := range h.DegradedComponents() {
+		if _, ok := report.Components[component]; ok {
+			continue
+		}
+		report.Components[component] = ComponentReport{
+			Status: StatusDegraded,
+			Error:  reason.Error(),
+		}
+	}
+	return report
+}
+
+// checkerReports runs all checkers concurrently when their cached results are expired,
+// concurrent requests wait for the same run
+func (h *HealthCheck) checkerReports() map[string]ComponentReport {
+	h.detailsMu.Lock()
+	defer h.detailsMu.Unlock()
+	if h.reports != nil && time.Since(h.reportsAt) < DetailsCacheTTL {
+		return h.reports
+	}
+
+	h.mu.RLock()
+	checkers := make(map[string]Checker, len(h.checkers))
+	for component, checker := range h.checkers {
+		checkers[component] = checker
+	}
+	h.mu.RUnlock()
+
+	reports := make(map[string]ComponentReport, len(checkers))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for component, checker := range checkers {
+		wg.Add(1)
+		go func(component string, checker Checker) {
+			defer wg.Done()
+			componentReport := checker()
+			mu.Lock()
+			reports[component] = componentReport
+			mu.Unlock()
+		}(component, checker)
+	}
+	wg.Wait()
+
+	h.reports = reports
+	h.reportsAt = time.Now()
+	return reports
+}
+
+// ServeDetails answers detailed report in json, status code follows readiness
+func (h *HealthCheck) ServeDetails(rw http.ResponseWriter, r *http.Request) {
+	rw.Header().Set("Cache-Control", "private, max-age=0")
+	rw.Header().Set("Expires", "0")
+	rw.Header().Set("Content-Type", "application/json")
+
+	report := h.Details()
+	if h.Health() != Healthy {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_ = json.NewEncoder(rw).Encode(report)
+	r.Close = true
+}
+
+// ReportFromError gives a report down with error or up when error is nil
+func ReportFromError(err error) ComponentReport {
+	if err != nil {
+		return ComponentReport{Status: StatusDown, Error: err.Error()}
+	}
+	return ComponentReport{Status: StatusUp}
+}
@@ -0,0 +1,99 @@
+package healthchecks_test
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/orange-cloudfoundry/promfetcher/healthchecks"
+)
+
+var _ = Describe("Details", func() {
+	var healthCheck *healthchecks.HealthCheck
+
+	BeforeEach(func() {
+		healthCheck = healthchecks.NewHealthCheck()
+		healthCheck.RegisterChecker("routes", func() healthchecks.ComponentReport {
+			return healthchecks.ComponentReport{
+				Status:  healthchecks.StatusUp,
+				Details: map[string]interface{}{"routes": 2},
+			}
+		})
+		healthCheck.RegisterChecker(healthchecks.ComponentDatabase, func() healthchecks.ComponentReport {
+			return healthchecks.ReportFromError(errors.New("connection refused"))
+		})
+		healthCheck.SetComponentDegraded("other", errors.New("not working"))
+	})
+
+	It("gives status of each component in json", func() {
+		healthCheck.SetHealth(healthchecks.Healthy)
+		healthCheck.SetComponentDegraded(healthchecks.ComponentDatabase, errors.New("connection refused"))
+
+		rec := httptest.NewRecorder()
+		healthCheck.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/health/details", nil))
+		Expect(rec.Code).To(Equal(http.StatusOK))
+		Expect(rec.Header().Get("Content-Type")).To(Equal("application/json"))
+
+		var report healthchecks.DetailsReport
+		Expect(json.Unmarshal(rec.Body.Bytes(), &report)).To(Succeed())
+		Expect(report.Status).To(Equal("Healthy"))
+		Expect(report.Components).To(HaveLen(3))
+		Expect(report.Components["routes"].Status).To(Equal(healthchecks.StatusUp))
+		Expect(report.Components["routes"].Details).To(HaveKeyWithValue("routes", BeNumerically("==", 2)))
+		Expect(report.Components[healthchecks.ComponentDatabase]).To(Equal(healthchecks.ComponentReport{
+			Status: healthchecks.StatusDown,
+			Error:  "connection refused",
+		}))
+		Expect(report.Components["other"]).To(Equal(healthchecks.ComponentReport{
+			Status: healthchecks.StatusDegraded,
+			Error:  "not working",
+		}))
+	})
+
+	It("answers 503 when not ready", func() {
+		rec := httptest.NewRecorder()
+		healthCheck.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/health/details", nil))
+		Expect(rec.Code).To(Equal(http.StatusServiceUnavailable))
+
+		var report healthchecks.DetailsReport
+		Expect(json.Unmarshal(rec.Body.Bytes(), &report)).To(Succeed())
+		Expect(report.Status).To(Equal("Initializing"))
+	})
+
+	It("reuses checkers results between requests", func() {
+		calls := 0
+		healthCheck.RegisterChecker("exporter", func() healthchecks.ComponentReport {
+			calls++
+			return healthchecks.ComponentReport{Status: healthchecks.StatusUp}
+		})
+		for i := 0; i < 3; i++ {
+			rec := httptest.NewRecorder()
+			healthCheck.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/health/details", nil))
+			Expect(rec.Body.String()).To(ContainSubstring(`"exporter"`))
+		}
+		Expect(calls).To(Equal(1))
+
+		healthCheck.SetComponentDegraded("other", errors.New("still not working"))
+		Expect(healthCheck.Details().Components["other"].Error).To(Equal("still not working"))
+		Expect(calls).To(Equal(1))
+	})
+
+	It("runs checkers again when components change", func() {
+		healthCheck.Details()
+		healthCheck.RegisterChecker("exporter", func() healthchecks.ComponentReport {
+			return healthchecks.ComponentReport{Status: healthchecks.StatusUp}
+		})
+		Expect(healthCheck.Details().Components).To(HaveKey("exporter"))
+	})
+
+	It("does not report unregistered components", func() {
+		healthCheck.UnregisterChecker("routes")
+		report := healthCheck.Details()
+		Expect(report.Components).ToNot(HaveKey("routes"))
+		Expect(report.Components).To(HaveLen(2))
+	})
+})
@@ -1,8 +1,11 @@
 package healthchecks
 
 import (
+	"fmt"
 	"net/http"
+	"sort"
 	"sync"
+	"time"
 )
 
 type Status uint64
@@ -16,12 +19,21 @@ const (
 type HealthCheck struct {
 	mu     sync.RWMutex // to lock health r/w
 	health Status
+	// components which are not working but let promfetcher still running, e.g. database
+	degraded map[string]error
+	checkers map[string]Checker
+
+	detailsMu sync.Mutex // to run checkers once at a time
+	reports   map[string]ComponentReport
+	reportsAt time.Time
 }
 
 func NewHealthCheck() *HealthCheck {
 	return &HealthCheck{
-		mu:     sync.RWMutex{},
-		health: Initializing,
+		mu:       sync.RWMutex{},
+		health:   Initializing,
+		degraded: make(map[string]error),
+		checkers: make(map[string]Checker),
 	}
 }
 
@@ -44,6 +56,31 @@ func (h *HealthCheck) SetHealth(s Status) {
 
 }
 
+// SetComponentDegraded marks a component as degraded for given reason
+func (h *HealthCheck) SetComponentDegraded(component string, reason error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.degraded[component] = reason
+}
+
+// SetComponentHealthy removes degraded state of a component
+func (h *HealthCheck) SetComponentHealthy(component string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.degraded, component)
+}
+
+// DegradedComponents gives degraded components with reason of their degradation
+func (h *HealthCheck) DegradedComponents() map[string]error {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	degraded := make(map[string]error, len(h.degraded))
+	for component, reason := range h.degraded {
+		degraded[component] = reason
+	}
+	return degraded
+}
+
 func (h *HealthCheck) String() string {
 	switch h.Health() {
 	case Initializing:
@@ -57,6 +94,34 @@ func (h *HealthCheck) String() string {
 	}
 }
 
+// Handler serves liveness on /health/live, readiness on /health/ready and a json report on /health/details,
+// readiness is also served on any other path
+func (h *HealthCheck) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health/live", h.ServeLiveness)
+	mux.HandleFunc("/health/details", h.ServeDetails)
+	mux.Handle("/health/ready", h)
+	mux.Handle("/", h)
+	return mux
+}
+
+// ServeLiveness answers ok while promfetcher is running, even when it is not ready yet
+func (h *HealthCheck) ServeLiveness(rw http.ResponseWriter, r *http.Request) {
+	rw.Header().Set("Cache-Control", "private, max-age=0")
+	rw.Header().Set("Expires", "0")
+
+	if h.Health() == Degraded {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+		r.Close = true
+		return
+	}
+
+	rw.WriteHeader(http.StatusOK)
+	_, _ = rw.Write([]byte("ok\n"))
+	r.Close = true
+}
+
+// ServeHTTP answers ok only when promfetcher is ready
 func (h *HealthCheck) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 
 	rw.Header().Set("Cache-Control", "private, max-age=0")
@@ -69,6 +134,16 @@ func (h *HealthCheck) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 	}
 
 	rw.WriteHeader(http.StatusOK)
+	// promfetcher still serves metrics when components are degraded
+	degraded := h.DegradedComponents()
+	components := make([]string, 0, len(degraded))
+	for component := range degraded {
+		components = append(components, component)
+	}
+	sort.Strings(components)
+	for _, component := range components {
+		_, _ = fmt.Fprintf(rw, "degraded %s: %s\n", component, degraded[component])
+	}
 	_, _ = rw.Write([]byte("ok\n"))
 	r.Close = true
 }
@@ -0,0 +1,45 @@
+package healthchecks_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/orange-cloudfoundry/promfetcher/healthchecks"
+)
+
+var _ = Describe("HealthCheck", func() {
+	var healthCheck *healthchecks.HealthCheck
+
+	BeforeEach(func() {
+		healthCheck = healthchecks.NewHealthCheck()
+	})
+
+	statusCode := func(path string) int {
+		rec := httptest.NewRecorder()
+		healthCheck.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec.Code
+	}
+
+	It("is live but not ready while initializing", func() {
+		Expect(statusCode("/health/live")).To(Equal(http.StatusOK))
+		Expect(statusCode("/health/ready")).To(Equal(http.StatusServiceUnavailable))
+		Expect(statusCode("/")).To(Equal(http.StatusServiceUnavailable))
+	})
+
+	It("is live and ready when healthy", func() {
+		healthCheck.SetHealth(healthchecks.Healthy)
+		Expect(statusCode("/health/live")).To(Equal(http.StatusOK))
+		Expect(statusCode("/health/ready")).To(Equal(http.StatusOK))
+		Expect(statusCode("/")).To(Equal(http.StatusOK))
+	})
+
+	It("is neither live nor ready when degraded", func() {
+		healthCheck.SetHealth(healthchecks.Degraded)
+		healthCheck.SetHealth(healthchecks.Healthy)
+		Expect(statusCode("/health/live")).To(Equal(http.StatusServiceUnavailable))
+		Expect(statusCode("/health/ready")).To(Equal(http.StatusServiceUnavailable))
+	})
+})
@@ -0,0 +1,33 @@
+package healthchecks
+
+import (
+	"github.com/nats-io/nats.go"
+)
+
+const ComponentNats = "nats"
+
+// NatsChecker reports nats connection state and server currently connected to
+func NatsChecker(conn *nats.Conn) Checker {
+	return func() ComponentReport {
+		status := conn.Status()
+		report := ComponentReport{
+			Status: StatusUp,
+			Details: map[string]interface{}{
+				"state":  status.String(),
+				"server": conn.ConnectedUrlRedacted(),
+			},
+		}
+		switch status {
+		case nats.CONNECTED:
+			return report
+		case nats.CLOSED:
+			report.Status = StatusDown
+		default:
+			report.Status = StatusDegraded
+		}
+		if err := conn.LastError(); err != nil {
+			report.Error = err.Error()
+		}
+		return report
+	}
+}
@@ -15,50 +15,127 @@ import (
 
 	"github.com/alecthomas/kingpin/v2"
 	"github.com/gorilla/mux"
-	"github.com/jinzhu/gorm"
 	"github.com/prometheus/common/version"
 	log "github.com/sirupsen/logrus"
 
 	"github.com/orange-cloudfoundry/promfetcher/api"
+	"github.com/orange-cloudfoundry/promfetcher/caches"
 	"github.com/orange-cloudfoundry/promfetcher/clients"
 	"github.com/orange-cloudfoundry/promfetcher/config"
 	"github.com/orange-cloudfoundry/promfetcher/fetchers"
 	"github.com/orange-cloudfoundry/promfetcher/healthchecks"
 	"github.com/orange-cloudfoundry/promfetcher/mbus"
+	"github.com/orange-cloudfoundry/promfetcher/migrations"
 	"github.com/orange-cloudfoundry/promfetcher/scrapers"
 	"github.com/orange-cloudfoundry/promfetcher/userdocs"
 )
 
+const dbCheckInterval = 30 * time.Second
+
 var (
 	configFile = kingpin.Flag("config", "Configuration File").Short('c').File()
+
+	serveCmd = kingpin.Command("serve", "Run promfetcher (default)").Default()
+
+	migrateCmd       = kingpin.Command("migrate", "Manage database schema migrations")
+	migrateUpCmd     = migrateCmd.Command("up", "Apply pending migrations (default)").Default()
+	migrateUpTo      = migrateUpCmd.Flag("to", "Apply migrations until this version").Int()
+	migrateDownCmd   = migrateCmd.Command("down", "Roll back applied migrations")
+	migrateDownSteps = migrateDownCmd.Flag("steps", "Number of migrations to roll back").Default("1").Int()
+	migrateStatusCmd = migrateCmd.Command("status", "Show migrations status")
+
+	checkConfigCmd = kingpin.Command("check-config", "Validate configuration file without connecting to any service")
+	printConfigCmd = kingpin.Command("print-config", "Print effective configuration with defaults and secrets redacted")
 )
 
 func main() {
 	kingpin.Version(version.Print("promfetcher"))
 	kingpin.HelpFlag.Short('h')
-	kingpin.Parse()
+	cmd := kingpin.Parse()
 
-	c, err := config.DefaultConfig()
-	if err != nil {
-		log.Fatal("Error loading config: ", err.Error())
+	// config commands must not open connections made when loading config
+	switch cmd {
+	case checkConfigCmd.FullCommand():
+		if err := checkConfig(*configFile, os.Stdout); err != nil {
+			log.Fatal(err.Error())
+		}
+		return
+	case printConfigCmd.FullCommand():
+		if err := printConfig(*configFile, os.Stdout); err != nil {
+			log.Fatal(err.Error())
+		}
+		return
 	}
 
+	var c *config.Config
+	var err error
 	if *configFile != nil {
 		c, err = config.InitConfigFromFile(*configFile)
-		if err != nil {
-			log.Fatal("Error loading config: ", err.Error())
+	} else {
+		c, err = config.InitConfig(nil)
+	}
+	if err != nil {
+		log.Fatal("Error loading config: ", err.Error())
+	}
+	if err = c.Logging.Apply(); err != nil {
+		log.Fatal("Error setting logging: ", err.Error())
+	}
+	for _, warning := range c.Warnings() {
+		log.Warn(warning)
+	}
+
+	switch cmd {
+	case migrateUpCmd.FullCommand():
+		err = migrateUp(c, *migrateUpTo)
+	case migrateDownCmd.FullCommand():
+		err = migrateDown(c, *migrateDownSteps)
+	case migrateStatusCmd.FullCommand():
+		err = migrateStatus(c, os.Stdout)
+	case serveCmd.FullCommand():
+		serve(c)
+	}
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+}
+
+func serve(c *config.Config) {
+	var err error
+	healthCheck := healthchecks.NewHealthCheck()
+
+	// database may be down at start, migrations are then applied by database monitor once it is back
+	migrate := func() error {
+		if !c.DbAutoMigrate {
+			return nil
+		}
+		if err := migrations.Up(c.DB); err != nil {
+			return fmt.Errorf("error migrating database: %s", err.Error())
+		}
+		return nil
+	}
+	if c.DB != nil {
+		if err = migrate(); err != nil {
+			log.Errorf("%s, migrations will be retried when database is reachable", err.Error())
+			healthCheck.SetComponentDegraded(healthchecks.ComponentDatabase, err)
 		}
 	}
 
 	backendFactory := clients.NewBackendFactory(*c)
-	scraper := scrapers.NewScraper(backendFactory, c.DB)
+	scraper := scrapers.NewScraper(backendFactory)
 
-	natsReconnected := make(chan mbus.Signal)
-	natsClient := mbus.Connect(c, natsReconnected)
+	endpointCache := caches.NewEndpointCache(c.Store)
+	if err = endpointCache.Load(); err != nil {
+		log.Errorf("Error loading endpoints, bound endpoints will be loaded on next refresh: %s", err.Error())
+	}
 
-	healthCheck := healthchecks.NewHealthCheck()
-	routeFetcher := fetchers.NewRoutesFetcher(natsClient, c, natsReconnected, healthCheck)
-	metricsFetcher := fetchers.NewMetricsFetcher(scraper, routeFetcher, c.ExternalExporters)
+	routeFetcher := newRoutesFetcher(c, healthCheck)
+	metricsFetcher := fetchers.NewMetricsFetcher(scraper, routeFetcher, c.ExternalExporters, endpointCache, c.ScrapeMetrics)
+
+	configPath := ""
+	if *configFile != nil {
+		configPath = (*configFile).Name()
+	}
+	reloader := newConfigReloader(configPath, metricsFetcher, healthCheck)
 
 	rtr := mux.NewRouter()
 	api.Register(
@@ -66,13 +143,16 @@ func main() {
 		api.NewBroker(
 			c.Broker,
 			c.BaseURL,
-			c.DB,
+			c.Store,
+			routeFetcher,
+			endpointCache,
 		),
 		userdocs.NewUserDoc(c.BaseURL),
 	)
+	api.RegisterAdmin(rtr, c.Admin, reloader.Reload)
 
-	if !c.NotExitWhenConnFailed {
-		go checkDbConnection(c.DB)
+	if c.NotExitWhenConnFailed {
+		log.Warn("not_exit_when_conn_failed is deprecated, promfetcher does not exit anymore when database is unreachable")
 	}
 
 	srvSignal := make(chan os.Signal, 1)
@@ -88,6 +168,33 @@ func main() {
 	}()
 
 	srvCtx, cancel := context.WithCancel(context.Background())
+	go endpointCache.Run(c.EndpointCacheRefresh, srvCtx.Done())
+	if c.DB != nil {
+		dbMonitor := healthchecks.NewDBMonitor(c.DB.DB(), healthCheck, dbCheckInterval, func() error {
+			if err := migrate(); err != nil {
+				return err
+			}
+			if err := endpointCache.Load(); err != nil {
+				log.Errorf("failed to refresh endpoint cache: %s", err.Error())
+			}
+			return nil
+		})
+		healthCheck.RegisterChecker(healthchecks.ComponentDatabase, dbMonitor.Report)
+		go dbMonitor.Run(srvCtx.Done())
+	}
+
+	reloadSignal := make(chan os.Signal, 1)
+	signal.Notify(reloadSignal, syscall.SIGHUP)
+	go func() {
+		for {
+			select {
+			case <-reloadSignal:
+				_ = reloader.Reload()
+			case <-srvCtx.Done():
+				return
+			}
+		}
+	}()
 
 	go func() {
 		sig := <-srvSignal
@@ -110,7 +217,7 @@ func main() {
 	}()
 
 	go func() {
-		if err = http.ListenAndServe(fmt.Sprintf("0.0.0.0:%d", c.HealthCheckPort), healthCheck); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		if err = http.ListenAndServe(fmt.Sprintf("0.0.0.0:%d", c.HealthCheckPort), healthCheck.Handler()); err != nil && !errors.Is(err, http.ErrServerClosed) {
 			log.Fatalf("listen healthcheck: %s\n", err)
 		}
 	}()
@@ -121,8 +228,17 @@ func main() {
 		}
 	}(srv)
 
-	<-ready
-	healthCheck.SetHealth(healthchecks.Healthy)
+	go func() {
+		// route source may never be ready, e.g. cloud controller is unreachable
+		select {
+		case <-ready:
+		case <-srvCtx.Done():
+			return
+		}
+		if fetchers.WaitStable(routeFetcher, c.ReadinessStableWindow, c.ReadinessMaxWait, srvCtx.Done()) {
+			healthCheck.SetHealth(healthchecks.Healthy)
+		}
+	}()
 
 	<-srvCtx.Done()
 
@@ -138,6 +254,28 @@ func main() {
 	log.Info("server gracefully shutdown")
 }
 
+// newRoutesFetcher creates routes fetcher of route source set in config and registers its health checkers
+func newRoutesFetcher(c *config.Config, healthCheck *healthchecks.HealthCheck) fetchers.RoutesFetch {
+	switch c.RouteSource.Type {
+	case "cloud_controller":
+		ccClient := clients.NewCloudControllerClient(c.RouteSource.CloudController, c.CAPool)
+		routesFetcher := fetchers.NewCCRoutesFetcher(ccClient, c.RouteSource.CloudController.PollInterval, c.RouteSource.CloudController.StatsConcurrency)
+		healthCheck.RegisterChecker("routes", routesFetcher.HealthReport)
+		return routesFetcher
+	case "file":
+		routesFetcher := fetchers.NewFileRoutesFetcher(c.RouteSource.File.Path, c.RouteSource.File.PollInterval)
+		healthCheck.RegisterChecker("routes", routesFetcher.HealthReport)
+		return routesFetcher
+	}
+
+	natsReconnected := make(chan mbus.Signal)
+	natsClient := mbus.Connect(c, natsReconnected)
+	routesFetcher := fetchers.NewRoutesFetcher(natsClient, c, natsReconnected, healthCheck)
+	healthCheck.RegisterChecker(healthchecks.ComponentNats, healthchecks.NatsChecker(natsClient))
+	healthCheck.RegisterChecker("routes", routesFetcher.HealthReport)
+	return routesFetcher
+}
+
 func makeListener(c *config.Config) (net.Listener, error) {
 	listenAddr := fmt.Sprintf("0.0.0.0:%d", c.Port)
 	if !c.EnableSSL {
@@ -168,17 +306,3 @@ func makeListener(c *config.Config) (net.Listener, error) {
 	}
 	return tls.NewListener(listener, tlsConfig), nil
 }
-
-func checkDbConnection(db *gorm.DB) {
-	if db == nil {
-		return
-	}
-	for {
-		err := db.DB().Ping()
-		if err != nil {
-			db.Close()
-			log.Fatalf("Error when pinging database: %s", err.Error())
-		}
-		time.Sleep(5 * time.Minute)
-	}
-}
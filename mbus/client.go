@@ -18,6 +18,7 @@ type Signal struct{}
 //go:generate go run github.com/maxbrunsfeld/counterfeiter/v6 . Client
 type Client interface {
 	Subscribe(subj string, cb nats.MsgHandler) (*nats.Subscription, error)
+	ChanSubscribe(subj string, ch chan *nats.Msg) (*nats.Subscription, error)
 	Publish(subj string, data []byte) error
 }
 
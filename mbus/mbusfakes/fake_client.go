@@ -9,6 +9,20 @@ import (
 )
 
 type FakeClient struct {
+	ChanSubscribeStub        func(string, chan *nats.Msg) (*nats.Subscription, error)
+	chanSubscribeMutex       sync.RWMutex
+	chanSubscribeArgsForCall []struct {
+		arg1 string
+		arg2 chan *nats.Msg
+	}
+	chanSubscribeReturns struct {
+		result1 *nats.Subscription
+		result2 error
+	}
+	chanSubscribeReturnsOnCall map[int]struct {
+		result1 *nats.Subscription
+		result2 error
+	}
 	PublishStub        func(string, []byte) error
 	publishMutex       sync.RWMutex
 	publishArgsForCall []struct {
@@ -39,6 +53,71 @@ type FakeClient struct {
 	invocationsMutex sync.RWMutex
 }
 
+func (fake *FakeClient) ChanSubscribe(arg1 string, arg2 chan *nats.Msg) (*nats.Subscription, error) {
+	fake.chanSubscribeMutex.Lock()
+	ret, specificReturn := fake.chanSubscribeReturnsOnCall[len(fake.chanSubscribeArgsForCall)]
+	fake.chanSubscribeArgsForCall = append(fake.chanSubscribeArgsForCall, struct {
+		arg1 string
+		arg2 chan *nats.Msg
+	}{arg1, arg2})
+	stub := fake.ChanSubscribeStub
+	fakeReturns := fake.chanSubscribeReturns
+	fake.recordInvocation("ChanSubscribe", []interface{}{arg1, arg2})
+	fake.chanSubscribeMutex.Unlock()
+	if stub != nil {
+		return stub(arg1, arg2)
+	}
+	if specificReturn {
+		return ret.result1, ret.result2
+	}
+	return fakeReturns.result1, fakeReturns.result2
+}
+
+func (fake *FakeClient) ChanSubscribeCallCount() int {
+	fake.chanSubscribeMutex.RLock()
+	defer fake.chanSubscribeMutex.RUnlock()
+	return len(fake.chanSubscribeArgsForCall)
+}
+
+func (fake *FakeClient) ChanSubscribeCalls(stub func(string, chan *nats.Msg) (*nats.Subscription, error)) {
+	fake.chanSubscribeMutex.Lock()
+	defer fake.chanSubscribeMutex.Unlock()
+	fake.ChanSubscribeStub = stub
+}
+
+func (fake *FakeClient) ChanSubscribeArgsForCall(i int) (string, chan *nats.Msg) {
+	fake.chanSubscribeMutex.RLock()
+	defer fake.chanSubscribeMutex.RUnlock()
+	argsForCall := fake.chanSubscribeArgsForCall[i]
+	return argsForCall.arg1, argsForCall.arg2
+}
+
+func (fake *FakeClient) ChanSubscribeReturns(result1 *nats.Subscription, result2 error) {
+	fake.chanSubscribeMutex.Lock()
+	defer fake.chanSubscribeMutex.Unlock()
+	fake.ChanSubscribeStub = nil
+	fake.chanSubscribeReturns = struct {
+		result1 *nats.Subscription
+		result2 error
+	}{result1, result2}
+}
+
+func (fake *FakeClient) ChanSubscribeReturnsOnCall(i int, result1 *nats.Subscription, result2 error) {
+	fake.chanSubscribeMutex.Lock()
+	defer fake.chanSubscribeMutex.Unlock()
+	fake.ChanSubscribeStub = nil
+	if fake.chanSubscribeReturnsOnCall == nil {
+		fake.chanSubscribeReturnsOnCall = make(map[int]struct {
+			result1 *nats.Subscription
+			result2 error
+		})
+	}
+	fake.chanSubscribeReturnsOnCall[i] = struct {
+		result1 *nats.Subscription
+		result2 error
+	}{result1, result2}
+}
+
 func (fake *FakeClient) Publish(arg1 string, arg2 []byte) error {
 	var arg2Copy []byte
 	if arg2 != nil {
@@ -174,10 +253,6 @@ func (fake *FakeClient) SubscribeReturnsOnCall(i int, result1 *nats.Subscription
 func (fake *FakeClient) Invocations() map[string][][]interface{} {
 	fake.invocationsMutex.RLock()
 	defer fake.invocationsMutex.RUnlock()
-	fake.publishMutex.RLock()
-	defer fake.publishMutex.RUnlock()
-	fake.subscribeMutex.RLock()
-	defer fake.subscribeMutex.RUnlock()
 	copiedInvocations := map[string][][]interface{}{}
 	for key, value := range fake.invocations {
 		copiedInvocations[key] = value
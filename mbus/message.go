@@ -5,6 +5,8 @@ import (
 	"errors"
 	"fmt"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/orange-cloudfoundry/promfetcher/models"
 )
@@ -41,6 +43,7 @@ func (m *Message) MakeRoute(http2Enabled bool) (*models.Route, error) {
 		TLS:                 useTLS,
 		TTL:                 m.StaleThresholdInSeconds,
 		Host:                m.Host,
+		LastSeen:            time.Now(),
 	}, nil
 }
 
@@ -57,16 +60,43 @@ func (m *Message) port() (uint16, bool, error) {
 	return m.Port, false, nil
 }
 
-func CreateMessage(data []byte) (*Message, error) {
-	var msg Message
-	jsonErr := json.Unmarshal(data, &msg)
-	if jsonErr != nil {
-		return nil, jsonErr
-	}
+var messagePool = sync.Pool{
+	New: func() interface{} {
+		return &Message{}
+	},
+}
+
+// AcquireMessage gives a message from pool to decode into with DecodeMessage,
+// message must be given back with ReleaseMessage when not used anymore
+func AcquireMessage() *Message {
+	return messagePool.Get().(*Message)
+}
+
+// ReleaseMessage resets message and gives it back to pool, uris slice is kept to be reused
+func ReleaseMessage(msg *Message) {
+	uris := msg.Uris[:0]
+	*msg = Message{}
+	msg.Uris = uris
+	messagePool.Put(msg)
+}
 
+// DecodeMessage decodes data in an empty message and validates it
+func DecodeMessage(data []byte, msg *Message) error {
+	err := json.Unmarshal(data, msg)
+	if err != nil {
+		return err
+	}
 	if !msg.ValidateMessage() {
-		return nil, errors.New("unable to validate message. route_service_url must be https")
+		return errors.New("unable to validate message. route_service_url must be https")
 	}
+	return nil
+}
 
+func CreateMessage(data []byte) (*Message, error) {
+	var msg Message
+	err := DecodeMessage(data, &msg)
+	if err != nil {
+		return nil, err
+	}
 	return &msg, nil
 }
@@ -0,0 +1,37 @@
+package mbus_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/orange-cloudfoundry/promfetcher/mbus"
+	"github.com/orange-cloudfoundry/promfetcher/models"
+)
+
+var _ = Describe("Message", func() {
+	It("decodes in a pooled message", func() {
+		msg := mbus.AcquireMessage()
+		err := mbus.DecodeMessage([]byte(`{"host":"10.0.0.1","port":61000,"uris":["app.example.net"],"tags":{"app_id":"my-app"}}`), msg)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(msg.Host).To(Equal("10.0.0.1"))
+		Expect(msg.Uris).To(Equal([]models.Uri{"app.example.net"}))
+		Expect(msg.Tags.AppID).To(Equal("my-app"))
+
+		mbus.ReleaseMessage(msg)
+		Expect(msg.Host).To(BeEmpty())
+		Expect(msg.Uris).To(BeEmpty())
+		Expect(msg.Tags).To(Equal(models.Tags{}))
+
+		err = mbus.DecodeMessage([]byte(`{"host":"10.0.0.2","tls_port":61001}`), msg)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(msg.Uris).To(BeEmpty())
+		Expect(msg.Tags.AppID).To(BeEmpty())
+	})
+
+	It("rejects invalid messages", func() {
+		msg := mbus.AcquireMessage()
+		defer mbus.ReleaseMessage(msg)
+		Expect(mbus.DecodeMessage([]byte(`{"host":`), msg)).To(HaveOccurred())
+		Expect(mbus.DecodeMessage([]byte(`{"route_service_url":"http://insecure"}`), msg)).To(MatchError(ContainSubstring("must be https")))
+	})
+})
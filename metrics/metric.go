@@ -5,13 +5,19 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 )
 
+// FetchLabels are labels of fetch histograms, they are empty when not enabled in config
+var FetchLabels = []string{"organization_name", "space_name", "app_name"}
+
+// ScrapeLabels are labels of scrape histograms, source is app or external_exporter
+var ScrapeLabels = append([]string{"source"}, FetchLabels...)
+
 var (
 	MetricFetchFailedTotal = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "promfetch_metric_fetch_failed_total",
 			Help: "Number of non fetched metrics without be an normal error.",
 		},
-		[]string{"organization_id", "space_id", "app_id", "organization_name", "space_name", "app_name", "index", "instance_id"},
+		[]string{"organization_id", "space_id", "app_id", "organization_name", "space_name", "app_name"},
 	)
 	MetricFetchSuccessTotal = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
@@ -20,13 +26,6 @@ var (
 		},
 		[]string{"organization_id", "space_id", "app_id", "organization_name", "space_name", "app_name"},
 	)
-	LatestScrapeRoute = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "promfetch_latest_time_scrape_route",
-			Help: "Last time that route has been scraped in seconds.",
-		},
-		[]string{},
-	)
 	ScrapeRouteFailedTotal = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "promfetch_scrape_route_failed_total",
@@ -34,21 +33,150 @@ var (
 		},
 		[]string{},
 	)
+	ScrapeDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "promfetch_scrape_duration_seconds",
+			Help:    "Duration of scrape of an app instance or an external exporter in seconds.",
+			Buckets: []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30},
+		},
+		ScrapeLabels,
+	)
+	ScrapeResponseSize = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "promfetch_scrape_response_size_bytes",
+			Help:    "Size of uncompressed scrape response of an app instance or an external exporter in bytes.",
+			Buckets: prometheus.ExponentialBuckets(1024, 4, 8),
+		},
+		ScrapeLabels,
+	)
+	ScrapeSamples = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "promfetch_scrape_samples",
+			Help:    "Number of samples scraped from an app instance or an external exporter.",
+			Buckets: prometheus.ExponentialBuckets(10, 4, 8),
+		},
+		ScrapeLabels,
+	)
+	FetchDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "promfetch_fetch_duration_seconds",
+			Help:    "Duration of a metrics request including scrape of all instances and external exporters in seconds.",
+			Buckets: []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60},
+		},
+		FetchLabels,
+	)
+	ConfigReloadsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "promfetch_config_reloads_total",
+			Help: "Number of config reloads by result (success or failure).",
+		},
+		[]string{"result"},
+	)
+	ConfigLastReloadSuccessful = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "promfetch_config_last_reload_successful",
+			Help: "Whether last config reload succeeded (1 for success).",
+		},
+	)
+	ExporterCacheRequestsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "promfetch_external_exporter_cache_requests_total",
+			Help: "Number of external exporter results asked to cache by exporter name and result (hit, stale or miss).",
+		},
+		[]string{"name", "result"},
+	)
+	ExporterCacheAge = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "promfetch_external_exporter_cache_age_seconds",
+			Help:    "Age of external exporter results given from cache in seconds.",
+			Buckets: []float64{1, 5, 15, 30, 60, 120, 300, 600, 1800, 3600},
+		},
+		[]string{"name"},
+	)
+	Routes = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "promfetch_routes",
+			Help: "Number of routes in routing table by process type.",
+		},
+		[]string{"process_type"},
+	)
+	Apps = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "promfetch_apps",
+			Help: "Number of apps in routing table.",
+		},
+	)
+	Instances = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "promfetch_instances",
+			Help: "Number of app instances in routing table.",
+		},
+	)
+	RouteRegistrationsTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "promfetch_route_registrations_total",
+			Help: "Number of routes registered from NATS.",
+		},
+	)
+	RouteUnregistrationsTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "promfetch_route_unregistrations_total",
+			Help: "Number of routes unregistered from NATS.",
+		},
+	)
+	LastRouteRegisterAge = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "promfetch_last_route_register_age_seconds",
+			Help: "Time since last register message received from NATS in seconds.",
+		},
+	)
+	NatsPendingMessages = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "promfetch_nats_pending_messages",
+			Help: "Number of messages received from NATS waiting to be handled.",
+		},
+	)
+	NatsDroppedMessages = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "promfetch_nats_dropped_messages",
+			Help: "Number of messages dropped because too many messages were pending since start.",
+		},
+	)
+	NatsReconnectsTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "promfetch_nats_reconnects_total",
+			Help: "Number of reconnections to NATS.",
+		},
+	)
+	CCProcessStatsFailedTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "promfetch_cc_process_stats_failed_total",
+			Help: "Number of processes skipped when polling cloud controller because their stats can't be retrieved.",
+		},
+	)
+	NatsMessagesReceivedTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "promfetch_nats_messages_received_total",
+			Help: "Number of messages received from NATS by subject.",
+		},
+		[]string{"subject"},
+	)
+	NatsMessagesDecodedTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "promfetch_nats_messages_decoded_total",
+			Help: "Number of messages received from NATS successfully decoded by subject.",
+		},
+		[]string{"subject"},
+	)
+	NatsMessagesInvalidTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "promfetch_nats_messages_invalid_total",
+			Help: "Number of messages received from NATS which can't be decoded by subject.",
+		},
+		[]string{"subject"},
+	)
 )
 
-func RouteToLabel(route *models.Route) prometheus.Labels {
-	return map[string]string{
-		"organization_id":   route.Tags.OrganizationID,
-		"space_id":          route.Tags.SpaceID,
-		"app_id":            route.Tags.AppID,
-		"organization_name": route.Tags.OrganizationName,
-		"space_name":        route.Tags.SpaceName,
-		"app_name":          route.Tags.AppName,
-		"index":             route.Tags.InstanceID,
-		"instance_id":       route.Tags.InstanceID,
-	}
-}
-
 func RouteToLabelNoInstance(route *models.Route) prometheus.Labels {
 	return map[string]string{
 		"organization_id":   route.Tags.OrganizationID,
@@ -62,7 +190,27 @@ func RouteToLabelNoInstance(route *models.Route) prometheus.Labels {
 
 func init() {
 	prometheus.MustRegister(MetricFetchFailedTotal)
-	prometheus.MustRegister(LatestScrapeRoute)
 	prometheus.MustRegister(ScrapeRouteFailedTotal)
 	prometheus.MustRegister(MetricFetchSuccessTotal)
+	prometheus.MustRegister(NatsMessagesReceivedTotal)
+	prometheus.MustRegister(NatsMessagesDecodedTotal)
+	prometheus.MustRegister(NatsMessagesInvalidTotal)
+	prometheus.MustRegister(Routes)
+	prometheus.MustRegister(Apps)
+	prometheus.MustRegister(Instances)
+	prometheus.MustRegister(RouteRegistrationsTotal)
+	prometheus.MustRegister(RouteUnregistrationsTotal)
+	prometheus.MustRegister(LastRouteRegisterAge)
+	prometheus.MustRegister(NatsPendingMessages)
+	prometheus.MustRegister(NatsDroppedMessages)
+	prometheus.MustRegister(NatsReconnectsTotal)
+	prometheus.MustRegister(CCProcessStatsFailedTotal)
+	prometheus.MustRegister(ScrapeDuration)
+	prometheus.MustRegister(ScrapeResponseSize)
+	prometheus.MustRegister(ScrapeSamples)
+	prometheus.MustRegister(FetchDuration)
+	prometheus.MustRegister(ConfigReloadsTotal)
+	prometheus.MustRegister(ConfigLastReloadSuccessful)
+	prometheus.MustRegister(ExporterCacheRequestsTotal)
+	prometheus.MustRegister(ExporterCacheAge)
 }
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"text/tabwriter"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/orange-cloudfoundry/promfetcher/config"
+	"github.com/orange-cloudfoundry/promfetcher/migrations"
+)
+
+func migrateUp(c *config.Config, to int) error {
+	if c.DB == nil {
+		return fmt.Errorf("no db_conn set, nothing to migrate")
+	}
+	if to == 0 {
+		to = migrations.LatestVersion()
+	}
+	err := migrations.UpTo(c.DB, to)
+	if err != nil {
+		return err
+	}
+	return logVersion(c)
+}
+
+func migrateDown(c *config.Config, steps int) error {
+	if c.DB == nil {
+		return fmt.Errorf("no db_conn set, nothing to migrate")
+	}
+	err := migrations.Down(c.DB, steps)
+	if err != nil {
+		return err
+	}
+	return logVersion(c)
+}
+
+func migrateStatus(c *config.Config, w io.Writer) error {
+	if c.DB == nil {
+		return fmt.Errorf("no db_conn set, nothing to migrate")
+	}
+	status, err := migrations.Status(c.DB)
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "VERSION\tNAME\tAPPLIED AT")
+	for _, s := range status {
+		appliedAt := "pending"
+		if s.Applied {
+			appliedAt = s.AppliedAt.Format("2006-01-02 15:04:05")
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\n", s.Version, s.Name, appliedAt)
+	}
+	return tw.Flush()
+}
+
+func logVersion(c *config.Config) error {
+	version, err := migrations.Version(c.DB)
+	if err != nil {
+		return err
+	}
+	log.Infof("database schema is at version %d", version)
+	return nil
+}
@@ -0,0 +1,92 @@
+package migrations
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/jinzhu/gorm"
+	log "github.com/sirupsen/logrus"
+)
+
+// lockName is name of mysql lock taken while migrating
+const lockName = "promfetcher_migrations"
+
+// lockKey is key of postgres advisory lock taken while migrating, it is an arbitrary number
+const lockKey = 7251442301
+
+// lockTimeoutSeconds is maximum time to wait for migrations of another instance
+const lockTimeoutSeconds = 3600
+
+// withLock runs fn on a single connection holding a database lock, so instances started together
+// don't run migrations at the same time. Sqlite databases are local files which have no such lock
+func withLock(db *gorm.DB, fn func(db *gorm.DB) error) error {
+	ctx := context.Background()
+	conn, err := db.DB().Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("error when getting connection for migrations: %s", err.Error())
+	}
+	defer conn.Close()
+	dialect := db.Dialect().GetName()
+	lockedDB, err := gorm.Open(dialect, connDB{ctx: ctx, conn: conn})
+	if err != nil {
+		return err
+	}
+
+	switch dialect {
+	case "mysql":
+		var locked sql.NullInt64
+		err = conn.QueryRowContext(ctx, "SELECT GET_LOCK(?, ?)", lockName, lockTimeoutSeconds).Scan(&locked)
+		if err != nil {
+			return fmt.Errorf("error when locking migrations: %s", err.Error())
+		}
+		if !locked.Valid || locked.Int64 != 1 {
+			return fmt.Errorf("timeout when waiting for migrations of another instance")
+		}
+		defer unlock(ctx, conn, "SELECT RELEASE_LOCK(?)", lockName)
+	case "postgres":
+		_, err = conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", lockKey)
+		if err != nil {
+			return fmt.Errorf("error when locking migrations: %s", err.Error())
+		}
+		defer unlock(ctx, conn, "SELECT pg_advisory_unlock($1)", lockKey)
+	}
+	return fn(lockedDB)
+}
+
+// unlock releases lock, connection goes back to pool so lock must not be kept with it
+func unlock(ctx context.Context, conn *sql.Conn, query string, arg interface{}) {
+	if _, err := conn.ExecContext(ctx, query, arg); err != nil {
+		log.Errorf("error when unlocking migrations: %s", err.Error())
+	}
+}
+
+// connDB lets gorm use a single connection, session locks are then held for its queries
+type connDB struct {
+	ctx  context.Context
+	conn *sql.Conn
+}
+
+func (c connDB) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return c.conn.ExecContext(c.ctx, query, args...)
+}
+
+func (c connDB) Prepare(query string) (*sql.Stmt, error) {
+	return c.conn.PrepareContext(c.ctx, query)
+}
+
+func (c connDB) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return c.conn.QueryContext(c.ctx, query, args...)
+}
+
+func (c connDB) QueryRow(query string, args ...interface{}) *sql.Row {
+	return c.conn.QueryRowContext(c.ctx, query, args...)
+}
+
+func (c connDB) Begin() (*sql.Tx, error) {
+	return c.conn.BeginTx(c.ctx, nil)
+}
+
+func (c connDB) BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error) {
+	return c.conn.BeginTx(ctx, opts)
+}
@@ -0,0 +1,195 @@
+package migrations
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	log "github.com/sirupsen/logrus"
+)
+
+// Migration is a versioned change of database schema, structs used in migrations
+// must be frozen in this package and never be models which will change over time
+type Migration struct {
+	Version int
+	Name    string
+	Up      func(tx *gorm.DB) error
+	Down    func(tx *gorm.DB) error
+}
+
+// SchemaMigration is a migration applied on database
+type SchemaMigration struct {
+	Version   int `gorm:"primary_key;auto_increment:false"`
+	Name      string
+	AppliedAt time.Time
+}
+
+func (SchemaMigration) TableName() string {
+	return "schema_migrations"
+}
+
+type MigrationStatus struct {
+	Migration
+	Applied   bool
+	AppliedAt time.Time
+}
+
+// Migrations gives all known migrations ordered by version
+func Migrations() []Migration {
+	sorted := make([]Migration, len(migrations))
+	copy(sorted, migrations)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Version < sorted[j].Version
+	})
+	return sorted
+}
+
+// LatestVersion gives version of the latest known migration
+func LatestVersion() int {
+	all := Migrations()
+	if len(all) == 0 {
+		return 0
+	}
+	return all[len(all)-1].Version
+}
+
+// Version gives current schema version of database, 0 when no migration has been applied
+func Version(db *gorm.DB) (int, error) {
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return 0, err
+	}
+	version := 0
+	for v := range applied {
+		if v > version {
+			version = v
+		}
+	}
+	return version, nil
+}
+
+// Status gives all known migrations and if they have been applied on database
+func Status(db *gorm.DB) ([]MigrationStatus, error) {
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return nil, err
+	}
+	status := make([]MigrationStatus, 0)
+	for _, migration := range Migrations() {
+		schemaMigration, ok := applied[migration.Version]
+		status = append(status, MigrationStatus{
+			Migration: migration,
+			Applied:   ok,
+			AppliedAt: schemaMigration.AppliedAt,
+		})
+	}
+	return status, nil
+}
+
+// Up applies all pending migrations
+func Up(db *gorm.DB) error {
+	return UpTo(db, LatestVersion())
+}
+
+// UpTo applies pending migrations until given version included
+func UpTo(db *gorm.DB, version int) error {
+	return withLock(db, func(db *gorm.DB) error {
+		return upTo(db, version)
+	})
+}
+
+func upTo(db *gorm.DB, version int) error {
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return err
+	}
+	for _, migration := range Migrations() {
+		if migration.Version > version {
+			break
+		}
+		if _, ok := applied[migration.Version]; ok {
+			continue
+		}
+		log.Infof("applying migration %d (%s)", migration.Version, migration.Name)
+		err := run(db, migration, migration.Up, func(tx *gorm.DB) error {
+			return tx.Create(&SchemaMigration{
+				Version:   migration.Version,
+				Name:      migration.Name,
+				AppliedAt: time.Now(),
+			}).Error
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Down rolls back given number of applied migrations, latest first
+func Down(db *gorm.DB, steps int) error {
+	return withLock(db, func(db *gorm.DB) error {
+		return down(db, steps)
+	})
+}
+
+func down(db *gorm.DB, steps int) error {
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return err
+	}
+	all := Migrations()
+	for i := len(all) - 1; i >= 0 && steps > 0; i-- {
+		migration := all[i]
+		if _, ok := applied[migration.Version]; !ok {
+			continue
+		}
+		log.Infof("rolling back migration %d (%s)", migration.Version, migration.Name)
+		err := run(db, migration, migration.Down, func(tx *gorm.DB) error {
+			return tx.Delete(SchemaMigration{}, "version = ?", migration.Version).Error
+		})
+		if err != nil {
+			return err
+		}
+		steps--
+	}
+	return nil
+}
+
+// run executes a migration step and record it in a transaction,
+// note that some databases (i.e. mysql) commit implicitly on schema changes
+func run(db *gorm.DB, migration Migration, step func(tx *gorm.DB) error, record func(tx *gorm.DB) error) error {
+	tx := db.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+	err := step(tx)
+	if err == nil {
+		err = record(tx)
+	}
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("error on migration %d (%s): %s", migration.Version, migration.Name, err.Error())
+	}
+	return tx.Commit().Error
+}
+
+func appliedMigrations(db *gorm.DB) (map[int]SchemaMigration, error) {
+	if !db.HasTable(&SchemaMigration{}) {
+		err := db.CreateTable(&SchemaMigration{}).Error
+		// table may have been created meanwhile by an instance reading migrations without lock
+		if err != nil && !db.HasTable(&SchemaMigration{}) {
+			return nil, fmt.Errorf("error when creating schema migrations table: %s", err.Error())
+		}
+	}
+	var schemaMigrations []SchemaMigration
+	err := db.Find(&schemaMigrations).Error
+	if err != nil {
+		return nil, fmt.Errorf("error when getting applied migrations: %s", err.Error())
+	}
+	applied := make(map[int]SchemaMigration)
+	for _, schemaMigration := range schemaMigrations {
+		applied[schemaMigration.Version] = schemaMigration
+	}
+	return applied, nil
+}
@@ -0,0 +1,107 @@
+package migrations_test
+
+import (
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/orange-cloudfoundry/promfetcher/migrations"
+	"github.com/orange-cloudfoundry/promfetcher/models"
+)
+
+var _ = Describe("Migrations", func() {
+	var db *gorm.DB
+	var err error
+
+	BeforeEach(func() {
+		db, err = gorm.Open("sqlite3", "file::memory:?cache=shared")
+		Expect(err).ShouldNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(db.Close()).ShouldNot(HaveOccurred())
+	})
+
+	It("applies all migrations", func() {
+		Expect(migrations.Up(db)).To(Succeed())
+		Expect(migrations.Version(db)).To(Equal(migrations.LatestVersion()))
+
+		Expect(db.HasTable(&models.AppEndpoint{})).To(BeTrue())
+		Expect(db.HasTable(&models.ServiceInstance{})).To(BeTrue())
+		Expect(db.Dialect().HasIndex("app_endpoints", "idx_app_endpoints_app_guid")).To(BeTrue())
+
+		Expect(db.Create(&models.AppEndpoint{
+			GUID:          "binding-1",
+			AppGUID:       "d245c244-1875-a718-1248-2547e141a45c",
+			InstanceGUID:  "a758f25d-2d01-419e-b63b-de3aabcd9e15",
+			Endpoint:      "/metrics",
+			SystemMetrics: true,
+		}).Error).To(Succeed())
+		var appEndpoint models.AppEndpoint
+		Expect(db.First(&appEndpoint, "guid = ?", "binding-1").Error).To(Succeed())
+		Expect(appEndpoint.SystemMetrics).To(BeTrue())
+		Expect(appEndpoint.InstanceGUID).To(Equal("a758f25d-2d01-419e-b63b-de3aabcd9e15"))
+	})
+
+	It("is idempotent", func() {
+		Expect(migrations.Up(db)).To(Succeed())
+		Expect(migrations.Up(db)).To(Succeed())
+		Expect(migrations.Version(db)).To(Equal(migrations.LatestVersion()))
+	})
+
+	It("runs migrations on the connection holding lock", func() {
+		db.DB().SetMaxOpenConns(1)
+		Expect(migrations.Up(db)).To(Succeed())
+		Expect(migrations.Down(db, 1)).To(Succeed())
+		Expect(migrations.Version(db)).To(Equal(migrations.LatestVersion() - 1))
+	})
+
+	It("applies migrations until given version", func() {
+		Expect(migrations.UpTo(db, 1)).To(Succeed())
+		Expect(migrations.Version(db)).To(Equal(1))
+		Expect(db.HasTable(&models.ServiceInstance{})).To(BeFalse())
+
+		status, err := migrations.Status(db)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(status).To(HaveLen(len(migrations.Migrations())))
+		Expect(status[0].Applied).To(BeTrue())
+		Expect(status[1].Applied).To(BeFalse())
+	})
+
+	It("rolls back migrations", func() {
+		Expect(migrations.Up(db)).To(Succeed())
+		Expect(migrations.Down(db, 2)).To(Succeed())
+		Expect(migrations.Version(db)).To(Equal(migrations.LatestVersion() - 2))
+		Expect(db.HasTable(&models.ServiceInstance{})).To(BeFalse())
+		Expect(db.Dialect().HasColumn("app_endpoints", "instance_guid")).To(BeFalse())
+
+		Expect(migrations.Up(db)).To(Succeed())
+		Expect(db.Dialect().HasColumn("app_endpoints", "instance_guid")).To(BeTrue())
+
+		Expect(migrations.Down(db, len(migrations.Migrations()))).To(Succeed())
+		Expect(migrations.Version(db)).To(Equal(0))
+		Expect(db.HasTable("app_endpoints")).To(BeFalse())
+	})
+
+	It("keeps data of a schema created by previous auto migration", func() {
+		type legacyAppEndpoint struct {
+			GUID     string `gorm:"primary_key"`
+			AppGUID  string
+			Endpoint string
+		}
+		Expect(db.Table("app_endpoints").CreateTable(&legacyAppEndpoint{}).Error).To(Succeed())
+		Expect(db.Table("app_endpoints").Create(&legacyAppEndpoint{
+			GUID:     "binding-1",
+			AppGUID:  "d245c244-1875-a718-1248-2547e141a45c",
+			Endpoint: "/metrics",
+		}).Error).To(Succeed())
+
+		Expect(migrations.Up(db)).To(Succeed())
+
+		var appEndpoint models.AppEndpoint
+		Expect(db.First(&appEndpoint, "guid = ?", "binding-1").Error).To(Succeed())
+		Expect(appEndpoint.Endpoint).To(Equal("/metrics"))
+		Expect(appEndpoint.Inherited).To(BeFalse())
+	})
+})
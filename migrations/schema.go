@@ -0,0 +1,127 @@
+package migrations
+
+import (
+	"fmt"
+
+	"github.com/jinzhu/gorm"
+)
+
+var migrations = []Migration{
+	{
+		Version: 1,
+		Name:    "create_app_endpoints",
+		// table may already exist when created by auto migration of previous releases
+		Up: func(tx *gorm.DB) error {
+			if tx.HasTable(&appEndpointV1{}) {
+				return nil
+			}
+			return tx.CreateTable(&appEndpointV1{}).Error
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.DropTableIfExists(&appEndpointV1{}).Error
+		},
+	},
+	{
+		Version: 2,
+		Name:    "add_app_endpoints_app_guid_index",
+		Up: func(tx *gorm.DB) error {
+			return addIndex(tx, &appEndpointV1{}, "idx_app_endpoints_app_guid", "app_guid")
+		},
+		Down: func(tx *gorm.DB) error {
+			return removeIndex(tx, &appEndpointV1{}, "idx_app_endpoints_app_guid")
+		},
+	},
+	{
+		Version: 3,
+		Name:    "create_service_instances",
+		Up: func(tx *gorm.DB) error {
+			if tx.HasTable(&serviceInstanceV3{}) {
+				return nil
+			}
+			return tx.CreateTable(&serviceInstanceV3{}).Error
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.DropTableIfExists(&serviceInstanceV3{}).Error
+		},
+	},
+	{
+		Version: 4,
+		Name:    "add_app_endpoints_binding_columns",
+		Up: func(tx *gorm.DB) error {
+			for _, column := range []struct{ name, definition string }{
+				{"instance_guid", "varchar(255)"},
+				{"inherited", "boolean NOT NULL DEFAULT false"},
+				{"system_metrics", "boolean NOT NULL DEFAULT false"},
+			} {
+				err := addColumn(tx, "app_endpoints", column.name, column.definition)
+				if err != nil {
+					return err
+				}
+			}
+			return addIndex(tx, &appEndpointV1{}, "idx_app_endpoints_instance_guid", "instance_guid")
+		},
+		Down: func(tx *gorm.DB) error {
+			err := removeIndex(tx, &appEndpointV1{}, "idx_app_endpoints_instance_guid")
+			if err != nil {
+				return err
+			}
+			for _, column := range []string{"instance_guid", "inherited", "system_metrics"} {
+				if !tx.Dialect().HasColumn("app_endpoints", column) {
+					continue
+				}
+				err = tx.Model(&appEndpointV1{}).DropColumn(column).Error
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+}
+
+type appEndpointV1 struct {
+	GUID     string `gorm:"primary_key"`
+	AppGUID  string
+	Endpoint string
+}
+
+func (appEndpointV1) TableName() string {
+	return "app_endpoints"
+}
+
+type serviceInstanceV3 struct {
+	GUID       string `gorm:"primary_key"`
+	ServiceID  string
+	PlanID     string
+	Parameters string `gorm:"type:text"`
+}
+
+func (serviceInstanceV3) TableName() string {
+	return "service_instances"
+}
+
+func addColumn(tx *gorm.DB, table, column, definition string) error {
+	if tx.Dialect().HasColumn(table, column) {
+		return nil
+	}
+	return tx.Exec(fmt.Sprintf(
+		"ALTER TABLE %s ADD %s %s",
+		tx.Dialect().Quote(table), tx.Dialect().Quote(column), definition,
+	)).Error
+}
+
+func addIndex(tx *gorm.DB, model interface{}, indexName string, columns ...string) error {
+	scope := tx.NewScope(model)
+	if tx.Dialect().HasIndex(scope.TableName(), indexName) {
+		return nil
+	}
+	return tx.Model(model).AddIndex(indexName, columns...).Error
+}
+
+func removeIndex(tx *gorm.DB, model interface{}, indexName string) error {
+	scope := tx.NewScope(model)
+	if !tx.Dialect().HasIndex(scope.TableName(), indexName) {
+		return nil
+	}
+	return tx.Model(model).RemoveIndex(indexName).Error
+}
@@ -1,7 +1,60 @@
 package models
 
+import "sort"
+
 type AppEndpoint struct {
-	GUID     string `gorm:"primary_key"`
-	AppGUID  string
-	Endpoint string
+	GUID         string `gorm:"primary_key" json:"guid"`
+	AppGUID      string `json:"app_guid"`
+	InstanceGUID string `json:"instance_guid"`
+	Endpoint     string `json:"endpoint"`
+	// Inherited is true when endpoint comes from service instance parameters
+	Inherited bool `json:"inherited"`
+	// SystemMetrics is true when binding asks for system metrics built by promfetcher
+	SystemMetrics bool `json:"system_metrics"`
+}
+
+type AppEndpoints []AppEndpoint
+
+// Paths gives sorted distinct endpoints paths set by bindings, a binding without endpoint asks for default path
+// unless it only asks for system metrics
+func (a AppEndpoints) Paths(defaultPath string) []string {
+	paths := make([]string, 0)
+	exist := make(map[string]bool)
+	for _, appEndpoint := range a {
+		endpoint := appEndpoint.Endpoint
+		if endpoint == "" {
+			if appEndpoint.SystemMetrics {
+				continue
+			}
+			endpoint = defaultPath
+		}
+		if exist[endpoint] {
+			continue
+		}
+		exist[endpoint] = true
+		paths = append(paths, endpoint)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// SystemMetrics is true when one of the bindings asks for system metrics
+func (a AppEndpoints) SystemMetrics() bool {
+	for _, appEndpoint := range a {
+		if appEndpoint.SystemMetrics {
+			return true
+		}
+	}
+	return false
+}
+
+// OnlySystemMetrics is true when app has bindings and all of them ask for system metrics,
+// app is then not scraped on default path
+func (a AppEndpoints) OnlySystemMetrics() bool {
+	for _, appEndpoint := range a {
+		if !appEndpoint.SystemMetrics {
+			return false
+		}
+	}
+	return len(a) > 0
 }
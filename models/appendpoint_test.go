@@ -0,0 +1,35 @@
+package models_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/orange-cloudfoundry/promfetcher/models"
+)
+
+var _ = Describe("AppEndpoints", func() {
+	It("gives default path for bindings without endpoint", func() {
+		appEndpoints := models.AppEndpoints{
+			{GUID: "binding-1", Endpoint: "/actuator/prometheus"},
+			{GUID: "binding-2"},
+		}
+		Expect(appEndpoints.Paths("/metrics")).To(Equal([]string{"/actuator/prometheus", "/metrics"}))
+	})
+
+	It("does not give default path for system metrics bindings without endpoint", func() {
+		appEndpoints := models.AppEndpoints{
+			{GUID: "binding-1", Endpoint: "/actuator/prometheus"},
+			{GUID: "binding-2", SystemMetrics: true},
+		}
+		Expect(appEndpoints.Paths("/metrics")).To(Equal([]string{"/actuator/prometheus"}))
+		Expect(appEndpoints.OnlySystemMetrics()).To(BeFalse())
+	})
+
+	It("gives distinct paths", func() {
+		appEndpoints := models.AppEndpoints{
+			{GUID: "binding-1", Endpoint: "/metrics"},
+			{GUID: "binding-2"},
+		}
+		Expect(appEndpoints.Paths("/metrics")).To(Equal([]string{"/metrics"}))
+	})
+})
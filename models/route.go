@@ -1,11 +1,15 @@
 package models
 
 import (
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
+	"net/http"
 	"net/url"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 
@@ -19,18 +23,66 @@ var mu = sync.RWMutex{}
 type Routes map[Uri][]*Route
 
 type Tags struct {
-	ProcessType       string `json:"process_type"`
-	ProcessInstanceID string `json:"process_instance_id"`
-	Component         string `json:"component"`
-	InstanceID        string `json:"instance_id"`
-	SpaceName         string `json:"space_name"`
-	OrganizationID    string `json:"organization_id"`
-	ProcessID         string `json:"process_id"`
-	OrganizationName  string `json:"organization_name"`
-	SourceID          string `json:"source_id"`
-	AppID             string `json:"app_id"`
-	AppName           string `json:"app_name"`
-	SpaceID           string `json:"space_id"`
+	ProcessType       string `json:"process_type" yaml:"process_type"`
+	ProcessInstanceID string `json:"process_instance_id" yaml:"process_instance_id"`
+	Component         string `json:"component" yaml:"component"`
+	InstanceID        string `json:"instance_id" yaml:"instance_id"`
+	SpaceName         string `json:"space_name" yaml:"space_name"`
+	OrganizationID    string `json:"organization_id" yaml:"organization_id"`
+	ProcessID         string `json:"process_id" yaml:"process_id"`
+	OrganizationName  string `json:"organization_name" yaml:"organization_name"`
+	SourceID          string `json:"source_id" yaml:"source_id"`
+	AppID             string `json:"app_id" yaml:"app_id"`
+	AppName           string `json:"app_name" yaml:"app_name"`
+	SpaceID           string `json:"space_id" yaml:"space_id"`
+}
+
+// Common gives tags having same value in both tags, others are left empty
+func (t Tags) Common(other Tags) Tags {
+	common := func(a, b string) string {
+		if a == b {
+			return a
+		}
+		return ""
+	}
+	return Tags{
+		ProcessType:       common(t.ProcessType, other.ProcessType),
+		ProcessInstanceID: common(t.ProcessInstanceID, other.ProcessInstanceID),
+		Component:         common(t.Component, other.Component),
+		InstanceID:        common(t.InstanceID, other.InstanceID),
+		SpaceName:         common(t.SpaceName, other.SpaceName),
+		OrganizationID:    common(t.OrganizationID, other.OrganizationID),
+		ProcessID:         common(t.ProcessID, other.ProcessID),
+		OrganizationName:  common(t.OrganizationName, other.OrganizationName),
+		SourceID:          common(t.SourceID, other.SourceID),
+		AppID:             common(t.AppID, other.AppID),
+		AppName:           common(t.AppName, other.AppName),
+		SpaceID:           common(t.SpaceID, other.SpaceID),
+	}
+}
+
+// Override gives tags where values set in other replace those of t
+func (t Tags) Override(other Tags) Tags {
+	override := func(a, b string) string {
+		if b != "" {
+			return b
+		}
+		return a
+	}
+	return Tags{
+		ProcessType:       override(t.ProcessType, other.ProcessType),
+		ProcessInstanceID: override(t.ProcessInstanceID, other.ProcessInstanceID),
+		Component:         override(t.Component, other.Component),
+		InstanceID:        override(t.InstanceID, other.InstanceID),
+		SpaceName:         override(t.SpaceName, other.SpaceName),
+		OrganizationID:    override(t.OrganizationID, other.OrganizationID),
+		ProcessID:         override(t.ProcessID, other.ProcessID),
+		OrganizationName:  override(t.OrganizationName, other.OrganizationName),
+		SourceID:          override(t.SourceID, other.SourceID),
+		AppID:             override(t.AppID, other.AppID),
+		AppName:           override(t.AppName, other.AppName),
+		SpaceID:           override(t.SpaceID, other.SpaceID),
+	}
 }
 
 type Route struct {
@@ -44,6 +96,13 @@ type Route struct {
 	URLParams           url.Values `json:"-"`
 	MetricsPath         string     `json:"-"`
 	Host                string     `json:"host"`
+	LastSeen            time.Time  `json:"last_seen"`
+	Provisional         bool       `json:"provisional"`
+
+	// client settings of external exporters, backends settings are used when not set
+	Headers   http.Header   `json:"-"`
+	Timeout   time.Duration `json:"-"`
+	TLSConfig *tls.Config   `json:"-"`
 }
 
 func (rts Routes) FindByOrgSpaceName(org, space, name string) []*Route {
@@ -58,7 +117,6 @@ func (rts Routes) FindByOrgSpaceName(org, space, name string) []*Route {
 				log.Debugf("Route is nil for %s", string(u))
 				continue
 			}
-			route.URL = string(u)
 			if route.Tags.ProcessType != ProcessWeb {
 				continue
 			}
@@ -71,7 +129,7 @@ func (rts Routes) FindByOrgSpaceName(org, space, name string) []*Route {
 				continue
 			}
 			exist[route.Address] = true
-			finalRoutes = append(finalRoutes, route)
+			finalRoutes = append(finalRoutes, route.copyWithURL(u))
 		}
 	}
 	return finalRoutes
@@ -89,7 +147,6 @@ func (rts Routes) FindById(appId string) []*Route {
 				log.Debugf("Route is nil for %s", string(u))
 				continue
 			}
-			route.URL = string(u)
 			if route.Tags.ProcessType != ProcessWeb {
 				continue
 			}
@@ -100,24 +157,61 @@ func (rts Routes) FindById(appId string) []*Route {
 				continue
 			}
 			exist[route.Address] = true
-			finalRoutes = append(finalRoutes, route)
+			finalRoutes = append(finalRoutes, route.copyWithURL(u))
 		}
 	}
 	return finalRoutes
 }
 
+// UrisByAddress gives uris registered for each instance address of an app
+func (rts Routes) UrisByAddress(appId string) map[string][]Uri {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	uris := make(map[string][]Uri)
+	for u, routes := range rts {
+		for _, route := range routes {
+			if route == nil || route.Tags.AppID != appId {
+				continue
+			}
+			uris[route.Address] = append(uris[route.Address], u)
+		}
+	}
+	for address := range uris {
+		sort.Slice(uris[address], func(i, j int) bool {
+			return uris[address][i] < uris[address][j]
+		})
+	}
+	return uris
+}
+
 func (rts Routes) FindByRouteName(routeName string) []*Route {
 	mu.RLock()
 	defer mu.RUnlock()
 
 	routeKey := Uri(routeName).RouteKey()
-	finalRoutes, ok := rts[routeKey]
+	routes, ok := rts[routeKey]
 	if !ok {
 		return []*Route{}
 	}
+	finalRoutes := make([]*Route, len(routes))
+	for i, route := range routes {
+		finalRoutes[i] = route.copyWithURL("")
+	}
 	return finalRoutes
 }
 
+// copyWithURL gives a copy of route, routes found are given as copies to be read
+// by scrapes without holding lock while routing table is changed
+func (r *Route) copyWithURL(u Uri) *Route {
+	route := *r
+	if u != "" {
+		route.URL = string(u)
+	}
+	return &route
+}
+
+// Find gives copies of routes of an app found by its id, org/space/name or route name
 func (rts Routes) Find(appIdOrPathOrName string) []*Route {
 	tmpContent, err := url.PathUnescape(appIdOrPathOrName)
 	if err == nil {
@@ -135,10 +229,38 @@ func (rts Routes) Find(appIdOrPathOrName string) []*Route {
 	return rts.FindByRouteName(appIdOrPathOrName)
 }
 
+// RouteChange is a route to register or to unregister for uris
+type RouteChange struct {
+	Uris       []Uri
+	Route      *Route
+	Unregister bool
+}
+
+// Apply registers and unregisters routes in given order taking lock once,
+// route-emitters announce all their routes at once
+func (rts Routes) Apply(changes []RouteChange) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	for _, change := range changes {
+		for _, uri := range change.Uris {
+			if change.Unregister {
+				rts.unregisterRoute(uri, change.Route)
+				continue
+			}
+			rts.registerRoute(uri, change.Route)
+		}
+	}
+}
+
 func (rts Routes) RegisterRoute(uri Uri, route *Route) {
 	mu.Lock()
 	defer mu.Unlock()
 
+	rts.registerRoute(uri, route)
+}
+
+func (rts Routes) registerRoute(uri Uri, route *Route) {
 	if route == nil {
 		log.Warn("Cannot register nil route")
 		return
@@ -158,6 +280,11 @@ func (rts Routes) RegisterRoute(uri Uri, route *Route) {
 					rts[routekey] = routes
 					break
 				}
+				// registered route is replaced instead of changed, it may be read without lock
+				seen := *r
+				seen.LastSeen = route.LastSeen
+				seen.Provisional = r.Provisional && route.Provisional
+				routes[idx] = &seen
 			}
 		}
 		if !found {
@@ -177,6 +304,10 @@ func (rts Routes) UnregisterRoute(uri Uri, route *Route) {
 	mu.Lock()
 	defer mu.Unlock()
 
+	rts.unregisterRoute(uri, route)
+}
+
+func (rts Routes) unregisterRoute(uri Uri, route *Route) {
 	if route == nil {
 		log.Warn("Cannot unregister nil route")
 		return
@@ -202,6 +333,103 @@ func (rts Routes) UnregisterRoute(uri Uri, route *Route) {
 	}
 }
 
+// Len gives number of routes registered for all uris
+func (rts Routes) Len() int {
+	mu.RLock()
+	defer mu.RUnlock()
+	nb := 0
+	for _, routes := range rts {
+		nb += len(routes)
+	}
+	return nb
+}
+
+// RoutesStats are numbers about routing table
+type RoutesStats struct {
+	RoutesByProcessType map[string]int
+	Apps                int
+	Instances           int
+}
+
+// Stats counts routes by process type, apps and instances (an instance being registered on several uris)
+func (rts Routes) Stats() RoutesStats {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	stats := RoutesStats{
+		RoutesByProcessType: make(map[string]int),
+	}
+	apps := make(map[string]bool)
+	instances := make(map[string]bool)
+	for _, routes := range rts {
+		for _, route := range routes {
+			if route == nil {
+				continue
+			}
+			stats.RoutesByProcessType[route.Tags.ProcessType]++
+			apps[route.Tags.AppID] = true
+			instances[route.Tags.AppID+"/"+route.Address] = true
+		}
+	}
+	stats.Apps = len(apps)
+	stats.Instances = len(instances)
+	return stats
+}
+
+// Snapshot gives routing table as json to be loaded later with LoadSnapshot
+func (rts Routes) Snapshot() ([]byte, error) {
+	mu.RLock()
+	defer mu.RUnlock()
+	return json.Marshal(map[Uri][]*Route(rts))
+}
+
+// LoadSnapshot registers routes from a snapshot as provisional routes, they stay provisional
+// until they are registered again through NATS, it gives number of routes loaded
+func (rts Routes) LoadSnapshot(data []byte) (int, error) {
+	var snapshot map[Uri][]*Route
+	err := json.Unmarshal(data, &snapshot)
+	if err != nil {
+		return 0, err
+	}
+	nb := 0
+	for uri, routes := range snapshot {
+		for _, route := range routes {
+			if route == nil {
+				continue
+			}
+			route.Provisional = true
+			rts.RegisterRoute(uri, route)
+			nb++
+		}
+	}
+	return nb, nil
+}
+
+// PruneProvisional removes routes which were never registered again through NATS,
+// it gives number of routes removed
+func (rts Routes) PruneProvisional() int {
+	mu.Lock()
+	defer mu.Unlock()
+
+	nb := 0
+	for uri, routes := range rts {
+		confirmed := make([]*Route, 0, len(routes))
+		for _, route := range routes {
+			if route == nil || route.Provisional {
+				nb++
+				continue
+			}
+			confirmed = append(confirmed, route)
+		}
+		if len(confirmed) == 0 {
+			delete(rts, uri)
+			continue
+		}
+		rts[uri] = confirmed
+	}
+	return nb
+}
+
 func (rts Routes) String() string {
 	mu.RLock()
 	defer mu.RUnlock()
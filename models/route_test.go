@@ -86,9 +86,71 @@ var _ = Describe("Route", func() {
 			rts := routes.Find("unknown")
 			Expect(len(rts)).To(Equal(0))
 		})
+		It("gives uris of each instance of an app", func() {
+			routes["route4"] = []*models.Route{{
+				Address: "test1.cf.internal",
+				Tags: models.Tags{
+					ProcessType: "web",
+					AppID:       "a758f25d-2d01-419e-b63b-de3aabcd9e15",
+				},
+			}}
+			uris := routes.UrisByAddress("a758f25d-2d01-419e-b63b-de3aabcd9e15")
+			Expect(uris).To(Equal(map[string][]models.Uri{
+				"test1.cf.internal": {"route1", "route4"},
+			}))
+		})
 		It("does not find route with bad org/space/app", func() {
 			rts := routes.FindByOrgSpaceName("myorg2", "myspace2", "test2")
 			Expect(len(rts)).To(Equal(0))
 		})
 	})
+
+	Context("Snapshot", func() {
+		It("reloads routes as provisional until registered again", func() {
+			snapshot, err := routes.Snapshot()
+			Expect(err).ShouldNot(HaveOccurred())
+
+			loaded := make(models.Routes)
+			nb, err := loaded.LoadSnapshot(snapshot)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(nb).To(Equal(3))
+
+			rts := loaded.FindById("a758f25d-2d01-419e-b63b-de3aabcd9e15")
+			Expect(rts).To(HaveLen(1))
+			Expect(rts[0].Provisional).To(BeTrue())
+			Expect(rts[0].Tags.AppName).To(Equal("test1"))
+
+			loaded.RegisterRoute("route1", &models.Route{
+				Address: "test1.cf.internal",
+				Tags:    routes["route1"][0].Tags,
+			})
+			Expect(rts[0].Provisional).To(BeTrue())
+			rts = loaded.FindById("a758f25d-2d01-419e-b63b-de3aabcd9e15")
+			Expect(rts[0].Provisional).To(BeFalse())
+
+			Expect(loaded.PruneProvisional()).To(Equal(2))
+			Expect(loaded).To(HaveLen(1))
+			Expect(loaded.Find("route1")).To(HaveLen(1))
+		})
+		It("fails on invalid snapshot", func() {
+			_, err := make(models.Routes).LoadSnapshot([]byte("{"))
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("Tags", func() {
+		It("keeps only common tags", func() {
+			blue := models.Tags{OrganizationName: "myorg1", SpaceName: "myspace1", AppName: "app-blue", AppID: "a758f25d-2d01-419e-b63b-de3aabcd9e15"}
+			green := models.Tags{OrganizationName: "myorg1", SpaceName: "myspace1", AppName: "app-green", AppID: "bc6ee4b9-7e34-4a4f-9bc5-a1b8bc0ec5a3"}
+			Expect(blue.Common(green)).To(Equal(models.Tags{OrganizationName: "myorg1", SpaceName: "myspace1"}))
+			Expect(blue.Common(blue)).To(Equal(blue))
+		})
+		It("overrides only set tags", func() {
+			tags := models.Tags{OrganizationName: "myorg1", SpaceName: "myspace1", ProcessType: "web"}
+			Expect(tags.Override(models.Tags{ProcessType: "worker", Component: "my-component"})).To(Equal(models.Tags{
+				OrganizationName: "myorg1", SpaceName: "myspace1", ProcessType: "worker", Component: "my-component",
+			}))
+			Expect(tags.Override(models.Tags{})).To(Equal(tags))
+		})
+	})
 })
@@ -0,0 +1,9 @@
+package models
+
+type ServiceInstance struct {
+	GUID      string `gorm:"primary_key" json:"guid"`
+	ServiceID string `json:"service_id"`
+	PlanID    string `json:"plan_id"`
+	// Parameters are instance parameters in json, they are used as default for bindings
+	Parameters string `json:"parameters"`
+}
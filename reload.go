@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/orange-cloudfoundry/promfetcher/clients"
+	"github.com/orange-cloudfoundry/promfetcher/config"
+	"github.com/orange-cloudfoundry/promfetcher/fetchers"
+	"github.com/orange-cloudfoundry/promfetcher/healthchecks"
+	"github.com/orange-cloudfoundry/promfetcher/metrics"
+	"github.com/orange-cloudfoundry/promfetcher/scrapers"
+)
+
+// configReloader reads config file again and swaps what can change without a restart:
+// logging, backend tls and connections settings, external exporters and scrape metrics labels,
+// routing table and nats subscription are kept
+type configReloader struct {
+	mu               sync.Mutex
+	path             string
+	metricsFetcher   *fetchers.MetricsFetcher
+	healthCheck      *healthchecks.HealthCheck
+	exporterCheckers []string
+}
+
+func newConfigReloader(path string, metricsFetcher *fetchers.MetricsFetcher, healthCheck *healthchecks.HealthCheck) *configReloader {
+	r := &configReloader{
+		path:           path,
+		metricsFetcher: metricsFetcher,
+		healthCheck:    healthCheck,
+	}
+	r.registerExporterCheckers()
+	metrics.ConfigLastReloadSuccessful.Set(1)
+	return r
+}
+
+// Reload loads config file, current config is kept when new one is invalid
+func (r *configReloader) Reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	err := r.reload()
+	if err != nil {
+		metrics.ConfigReloadsTotal.WithLabelValues("failure").Inc()
+		metrics.ConfigLastReloadSuccessful.Set(0)
+		log.Errorf("failed to reload config, keeping current config: %s", err.Error())
+		return err
+	}
+	metrics.ConfigReloadsTotal.WithLabelValues("success").Inc()
+	metrics.ConfigLastReloadSuccessful.Set(1)
+	log.Infof("config reloaded from %s", r.path)
+	return nil
+}
+
+func (r *configReloader) reload() error {
+	if r.path == "" {
+		return fmt.Errorf("no config file given at start")
+	}
+	c, err := config.LoadConfigFromFile(r.path)
+	if err != nil {
+		return err
+	}
+	err = c.Logging.Apply()
+	if err != nil {
+		return err
+	}
+	scraper := scrapers.NewScraper(clients.NewBackendFactory(*c))
+	r.metricsFetcher.Reload(scraper, c.ExternalExporters, c.ScrapeMetrics)
+	r.registerExporterCheckers()
+	return nil
+}
+
+// registerExporterCheckers replaces checkers of previous external exporters in health check
+func (r *configReloader) registerExporterCheckers() {
+	for _, component := range r.exporterCheckers {
+		r.healthCheck.UnregisterChecker(component)
+	}
+	r.exporterCheckers = r.exporterCheckers[:0]
+	for component, checker := range r.metricsFetcher.ExporterCheckers() {
+		r.healthCheck.RegisterChecker(component, checker)
+		r.exporterCheckers = append(r.exporterCheckers, component)
+	}
+}
@@ -8,7 +8,6 @@ import (
 	"net/http"
 	"time"
 
-	"github.com/jinzhu/gorm"
 	"github.com/orange-cloudfoundry/promfetcher/clients"
 	"github.com/orange-cloudfoundry/promfetcher/errors"
 	"github.com/orange-cloudfoundry/promfetcher/models"
@@ -16,12 +15,11 @@ import (
 
 type Scraper struct {
 	backendFactory *clients.BackendFactory
-	db             *gorm.DB
 	outboundIp     string
 }
 
-func NewScraper(backendFactory *clients.BackendFactory, db *gorm.DB) *Scraper {
-	return &Scraper{backendFactory: backendFactory, db: db}
+func NewScraper(backendFactory *clients.BackendFactory) *Scraper {
+	return &Scraper{backendFactory: backendFactory}
 
 }
 
@@ -42,6 +40,15 @@ func (s *Scraper) GetOutboundIP() string {
 	return s.outboundIp
 }
 
+// Probe checks that an app instance accepts connections
+func (s Scraper) Probe(route *models.Route) error {
+	conn, err := net.DialTimeout("tcp", route.Address, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
 func (s Scraper) Scrape(route *models.Route, metricPathDefault string, headers http.Header) (io.ReadCloser, error) {
 	scheme := "http"
 	if route.TLS {
@@ -51,13 +58,6 @@ func (s Scraper) Scrape(route *models.Route, metricPathDefault string, headers h
 	if route.MetricsPath != "" {
 		endpoint = route.MetricsPath
 	}
-	if s.db != nil && route.MetricsPath == "" {
-		var appEndpoint models.AppEndpoint
-		s.db.First(&appEndpoint, "app_guid = ?", route.Tags.AppID)
-		if appEndpoint.GUID != "" {
-			endpoint = appEndpoint.Endpoint
-		}
-	}
 	req, err := http.NewRequest("GET", fmt.Sprintf("%s://%s%s", scheme, route.Address, endpoint), nil)
 	if err != nil {
 		return nil, err
@@ -67,8 +67,11 @@ func (s Scraper) Scrape(route *models.Route, metricPathDefault string, headers h
 			req.Header[k] = v
 		}
 	}
+	for k, v := range route.Headers {
+		req.Header[k] = v
+	}
 	req.Header.Add("Accept-Encoding", "gzip")
-	req.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", fmt.Sprintf("%f", (30*time.Second).Seconds()))
+	req.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", fmt.Sprintf("%f", clients.ScrapeTimeout(route).Seconds()))
 	req.Header.Set("X-Forwarded-Proto", scheme)
 	req.Header.Set("X-Promfetcher-Scrapping", "true")
 	req.Header.Set("X-Forwarded-For", s.GetOutboundIP())
@@ -1,12 +1,13 @@
 package scrapers_test
 
 import (
+	"crypto/tls"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
+	"time"
 
-	"github.com/jinzhu/gorm"
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
 	"github.com/onsi/gomega/ghttp"
@@ -17,30 +18,16 @@ import (
 )
 
 var _ = Describe("Scraper", func() {
-	var db *gorm.DB
 	var err error
 	var scraper *scrapers.Scraper
 	var server *ghttp.Server
 
 	BeforeEach(func() {
-		db, err = gorm.Open("sqlite3", "file::memory:?cache=shared")
-		Expect(err).ShouldNot(HaveOccurred())
-
-		db.AutoMigrate(&models.AppEndpoint{})
-		Expect(err).ShouldNot(HaveOccurred())
-
-		app := models.AppEndpoint{
-			AppGUID:  "d245c244-1875-a718-1248-2547e141a45c",
-			Endpoint: "/metrics",
-		}
-
-		db.Create(&app)
-
 		c, err := config.DefaultConfig()
 		Expect(err).ShouldNot(HaveOccurred())
 
 		backendFactory := clients.NewBackendFactory(*c)
-		scraper = scrapers.NewScraper(backendFactory, db)
+		scraper = scrapers.NewScraper(backendFactory)
 
 		server = ghttp.NewServer()
 	})
@@ -81,6 +68,49 @@ var _ = Describe("Scraper", func() {
 		})
 	})
 
+	Context("Scrape with route client settings", func() {
+		It("sends route headers and uses route tls and timeout", func() {
+			tlsServer := ghttp.NewTLSServer()
+			defer tlsServer.Close()
+			tlsServer.AppendHandlers(
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("GET", "/metrics"),
+					ghttp.VerifyHeaderKV("Authorization", "Bearer my-token"),
+					ghttp.VerifyHeaderKV("X-Prometheus-Scrape-Timeout-Seconds", "5.000000"),
+					ghttp.RespondWith(http.StatusOK, "test_scrape 1"),
+				),
+			)
+			serverURL, err := url.Parse(tlsServer.URL())
+			Expect(err).ToNot(HaveOccurred())
+
+			route := &models.Route{
+				Address:     serverURL.Host,
+				TLS:         true,
+				MetricsPath: "/metrics",
+				Headers:     http.Header{"Authorization": []string{"Bearer my-token"}},
+				Timeout:     5 * time.Second,
+				TLSConfig:   &tls.Config{InsecureSkipVerify: true},
+			}
+
+			resp, err := scraper.Scrape(route, "", nil)
+			Expect(err).ShouldNot(HaveOccurred())
+			defer resp.Close()
+			Expect(tlsServer.ReceivedRequests()).To(HaveLen(1))
+		})
+	})
+
+	Context("Probe", func() {
+		It("succeeds on reachable instance", func() {
+			serverURL, err := url.Parse(server.URL())
+			Expect(err).ToNot(HaveOccurred())
+			Expect(scraper.Probe(&models.Route{Address: serverURL.Host})).To(Succeed())
+		})
+
+		It("fails on unreachable instance", func() {
+			Expect(scraper.Probe(&models.Route{Address: "127.0.0.1:1"})).ToNot(Succeed())
+		})
+	})
+
 	Context("GetOutboundIP", func() {
 		It("gets local ip", func() {
 			ip := scraper.GetOutboundIP()
@@ -0,0 +1,140 @@
+package stores
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/orange-cloudfoundry/promfetcher/models"
+)
+
+// FileStore stores in memory and persists everything in a local json file after each change
+type FileStore struct {
+	*MemoryStore
+	muFile sync.Mutex
+	path   string
+}
+
+type fileContent struct {
+	ServiceInstances map[string]models.ServiceInstance `json:"service_instances"`
+	AppEndpoints     map[string]models.AppEndpoint     `json:"app_endpoints"`
+}
+
+// NewFileStore creates a file store loaded from given path, file is created on first change if not exists
+func NewFileStore(path string) (*FileStore, error) {
+	s := &FileStore{
+		MemoryStore: NewMemoryStore(),
+		path:        path,
+	}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error when reading store file: %s", err.Error())
+	}
+	var content fileContent
+	err = json.Unmarshal(b, &content)
+	if err != nil {
+		return nil, fmt.Errorf("error when loading store file %s: %s", path, err.Error())
+	}
+	if content.AppEndpoints != nil {
+		s.appEndpoints = content.AppEndpoints
+	}
+	if content.ServiceInstances != nil {
+		s.serviceInstances = content.ServiceInstances
+	}
+	return s, nil
+}
+
+func (s *FileStore) CreateAppEndpoint(appEndpoint models.AppEndpoint) error {
+	return s.change(func(next *MemoryStore) error {
+		return next.CreateAppEndpoint(appEndpoint)
+	})
+}
+
+func (s *FileStore) DeleteAppEndpoint(bindingGUID string) error {
+	return s.change(func(next *MemoryStore) error {
+		return next.DeleteAppEndpoint(bindingGUID)
+	})
+}
+
+func (s *FileStore) DeleteInstanceAppEndpoints(instanceGUID string) error {
+	return s.change(func(next *MemoryStore) error {
+		return next.DeleteInstanceAppEndpoints(instanceGUID)
+	})
+}
+
+func (s *FileStore) UpdateInstanceAppEndpoints(instanceGUID string, inheritedEndpoint string, systemMetrics bool) error {
+	return s.change(func(next *MemoryStore) error {
+		return next.UpdateInstanceAppEndpoints(instanceGUID, inheritedEndpoint, systemMetrics)
+	})
+}
+
+func (s *FileStore) SaveServiceInstance(instance models.ServiceInstance) error {
+	return s.change(func(next *MemoryStore) error {
+		return next.SaveServiceInstance(instance)
+	})
+}
+
+func (s *FileStore) DeleteServiceInstance(instanceGUID string) error {
+	return s.change(func(next *MemoryStore) error {
+		return next.DeleteServiceInstance(instanceGUID)
+	})
+}
+
+// change applies a change on a copy of store content, copy replaces store content only once persisted
+// to not keep in memory a change which would be lost on restart
+func (s *FileStore) change(apply func(next *MemoryStore) error) error {
+	s.muFile.Lock()
+	defer s.muFile.Unlock()
+
+	next := s.MemoryStore.clone()
+	if err := apply(next); err != nil {
+		return err
+	}
+	if err := s.persist(next); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.appEndpoints = next.appEndpoints
+	s.serviceInstances = next.serviceInstances
+	s.mu.Unlock()
+	return nil
+}
+
+// persist writes content in a temporary file which replace the store file
+// to never leave a partially written file
+func (s *FileStore) persist(content *MemoryStore) error {
+	b, err := json.Marshal(fileContent{
+		ServiceInstances: content.serviceInstances,
+		AppEndpoints:     content.appEndpoints,
+	})
+	if err != nil {
+		return err
+	}
+
+	tmpFile, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("error when writing store file: %s", err.Error())
+	}
+	defer os.Remove(tmpFile.Name())
+	_, err = tmpFile.Write(b)
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("error when writing store file: %s", err.Error())
+	}
+	err = os.Rename(tmpFile.Name(), s.path)
+	if err != nil {
+		return fmt.Errorf("error when writing store file: %s", err.Error())
+	}
+	return nil
+}
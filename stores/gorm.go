@@ -0,0 +1,85 @@
+package stores
+
+import (
+	"github.com/jinzhu/gorm"
+
+	"github.com/orange-cloudfoundry/promfetcher/models"
+)
+
+// GormStore stores in a sql database, schema must have been migrated
+type GormStore struct {
+	db *gorm.DB
+}
+
+func NewGormStore(db *gorm.DB) *GormStore {
+	return &GormStore{db: db}
+}
+
+func (s *GormStore) AppEndpoints() (models.AppEndpoints, error) {
+	appEndpoints := make(models.AppEndpoints, 0)
+	err := s.db.Order("endpoint").Find(&appEndpoints).Error
+	return appEndpoints, err
+}
+
+func (s *GormStore) AppEndpointsByApp(appGUID string) (models.AppEndpoints, error) {
+	appEndpoints := make(models.AppEndpoints, 0)
+	err := s.db.Order("endpoint").Find(&appEndpoints, "app_guid = ?", appGUID).Error
+	return appEndpoints, err
+}
+
+func (s *GormStore) AppEndpoint(bindingGUID string) (models.AppEndpoint, error) {
+	var appEndpoint models.AppEndpoint
+	err := s.db.First(&appEndpoint, "guid = ?", bindingGUID).Error
+	if gorm.IsRecordNotFoundError(err) {
+		return appEndpoint, ErrNotFound
+	}
+	return appEndpoint, err
+}
+
+func (s *GormStore) CreateAppEndpoint(appEndpoint models.AppEndpoint) error {
+	return s.db.Create(&appEndpoint).Error
+}
+
+func (s *GormStore) DeleteAppEndpoint(bindingGUID string) error {
+	return s.db.Delete(models.AppEndpoint{}, "guid = ?", bindingGUID).Error
+}
+
+func (s *GormStore) DeleteInstanceAppEndpoints(instanceGUID string) error {
+	return s.db.Delete(models.AppEndpoint{}, "instance_guid = ?", instanceGUID).Error
+}
+
+func (s *GormStore) UpdateInstanceAppEndpoints(instanceGUID string, inheritedEndpoint string, systemMetrics bool) error {
+	err := s.db.Model(models.AppEndpoint{}).
+		Where("instance_guid = ? AND inherited = ?", instanceGUID, true).
+		Update("endpoint", inheritedEndpoint).Error
+	if err != nil {
+		return err
+	}
+	return s.db.Model(models.AppEndpoint{}).
+		Where("instance_guid = ?", instanceGUID).
+		Update("system_metrics", systemMetrics).Error
+}
+
+func (s *GormStore) ServiceInstance(instanceGUID string) (models.ServiceInstance, error) {
+	var instance models.ServiceInstance
+	err := s.db.First(&instance, "guid = ?", instanceGUID).Error
+	if gorm.IsRecordNotFoundError(err) {
+		return instance, ErrNotFound
+	}
+	return instance, err
+}
+
+func (s *GormStore) SaveServiceInstance(instance models.ServiceInstance) error {
+	return s.db.Save(&instance).Error
+}
+
+func (s *GormStore) DeleteServiceInstance(instanceGUID string) error {
+	result := s.db.Delete(models.ServiceInstance{}, "guid = ?", instanceGUID)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+package stores
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/orange-cloudfoundry/promfetcher/models"
+)
+
+// MemoryStore stores in memory, everything is lost on restart
+type MemoryStore struct {
+	mu               sync.RWMutex
+	appEndpoints     map[string]models.AppEndpoint
+	serviceInstances map[string]models.ServiceInstance
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		appEndpoints:     make(map[string]models.AppEndpoint),
+		serviceInstances: make(map[string]models.ServiceInstance),
+	}
+}
+
+func (s *MemoryStore) AppEndpoints() (models.AppEndpoints, error) {
+	return s.filterAppEndpoints(func(models.AppEndpoint) bool {
+		return true
+	}), nil
+}
+
+func (s *MemoryStore) AppEndpointsByApp(appGUID string) (models.AppEndpoints, error) {
+	return s.filterAppEndpoints(func(appEndpoint models.AppEndpoint) bool {
+		return appEndpoint.AppGUID == appGUID
+	}), nil
+}
+
+func (s *MemoryStore) AppEndpoint(bindingGUID string) (models.AppEndpoint, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	appEndpoint, ok := s.appEndpoints[bindingGUID]
+	if !ok {
+		return appEndpoint, ErrNotFound
+	}
+	return appEndpoint, nil
+}
+
+func (s *MemoryStore) CreateAppEndpoint(appEndpoint models.AppEndpoint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.appEndpoints[appEndpoint.GUID]; ok {
+		return fmt.Errorf("app endpoint %s already exists", appEndpoint.GUID)
+	}
+	s.appEndpoints[appEndpoint.GUID] = appEndpoint
+	return nil
+}
+
+func (s *MemoryStore) DeleteAppEndpoint(bindingGUID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.appEndpoints, bindingGUID)
+	return nil
+}
+
+func (s *MemoryStore) DeleteInstanceAppEndpoints(instanceGUID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for guid, appEndpoint := range s.appEndpoints {
+		if appEndpoint.InstanceGUID == instanceGUID {
+			delete(s.appEndpoints, guid)
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) UpdateInstanceAppEndpoints(instanceGUID string, inheritedEndpoint string, systemMetrics bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for guid, appEndpoint := range s.appEndpoints {
+		if appEndpoint.InstanceGUID != instanceGUID {
+			continue
+		}
+		if appEndpoint.Inherited {
+			appEndpoint.Endpoint = inheritedEndpoint
+		}
+		appEndpoint.SystemMetrics = systemMetrics
+		s.appEndpoints[guid] = appEndpoint
+	}
+	return nil
+}
+
+func (s *MemoryStore) ServiceInstance(instanceGUID string) (models.ServiceInstance, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	instance, ok := s.serviceInstances[instanceGUID]
+	if !ok {
+		return instance, ErrNotFound
+	}
+	return instance, nil
+}
+
+func (s *MemoryStore) SaveServiceInstance(instance models.ServiceInstance) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.serviceInstances[instance.GUID] = instance
+	return nil
+}
+
+func (s *MemoryStore) DeleteServiceInstance(instanceGUID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.serviceInstances[instanceGUID]; !ok {
+		return ErrNotFound
+	}
+	delete(s.serviceInstances, instanceGUID)
+	return nil
+}
+
+// clone gives a copy of store
+func (s *MemoryStore) clone() *MemoryStore {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	c := NewMemoryStore()
+	for guid, appEndpoint := range s.appEndpoints {
+		c.appEndpoints[guid] = appEndpoint
+	}
+	for guid, instance := range s.serviceInstances {
+		c.serviceInstances[guid] = instance
+	}
+	return c
+}
+
+// filterAppEndpoints gives app endpoints matching filter ordered by endpoint as done by sql stores
+func (s *MemoryStore) filterAppEndpoints(filter func(models.AppEndpoint) bool) models.AppEndpoints {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	appEndpoints := make(models.AppEndpoints, 0)
+	for _, appEndpoint := range s.appEndpoints {
+		if filter(appEndpoint) {
+			appEndpoints = append(appEndpoints, appEndpoint)
+		}
+	}
+	sort.Slice(appEndpoints, func(i, j int) bool {
+		if appEndpoints[i].Endpoint == appEndpoints[j].Endpoint {
+			return appEndpoints[i].GUID < appEndpoints[j].GUID
+		}
+		return appEndpoints[i].Endpoint < appEndpoints[j].Endpoint
+	})
+	return appEndpoints
+}
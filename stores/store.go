@@ -0,0 +1,32 @@
+package stores
+
+import (
+	"errors"
+
+	"github.com/orange-cloudfoundry/promfetcher/models"
+)
+
+var ErrNotFound = errors.New("not found")
+
+// EndpointStore persists service instances and app endpoints set by broker
+type EndpointStore interface {
+	// AppEndpoints gives all app endpoints
+	AppEndpoints() (models.AppEndpoints, error)
+	// AppEndpointsByApp gives app endpoints of an app
+	AppEndpointsByApp(appGUID string) (models.AppEndpoints, error)
+	// AppEndpoint gives app endpoint set by a binding, ErrNotFound is given when not found
+	AppEndpoint(bindingGUID string) (models.AppEndpoint, error)
+	CreateAppEndpoint(appEndpoint models.AppEndpoint) error
+	DeleteAppEndpoint(bindingGUID string) error
+	// DeleteInstanceAppEndpoints deletes all app endpoints set by bindings of a service instance
+	DeleteInstanceAppEndpoints(instanceGUID string) error
+	// UpdateInstanceAppEndpoints sets endpoint on inherited app endpoints of a service instance
+	// and system metrics on all of them
+	UpdateInstanceAppEndpoints(instanceGUID string, inheritedEndpoint string, systemMetrics bool) error
+
+	// ServiceInstance gives a service instance, ErrNotFound is given when not found
+	ServiceInstance(instanceGUID string) (models.ServiceInstance, error)
+	SaveServiceInstance(instance models.ServiceInstance) error
+	// DeleteServiceInstance deletes a service instance, ErrNotFound is given when not found
+	DeleteServiceInstance(instanceGUID string) error
+}
@@ -0,0 +1,169 @@
+package stores_test
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/orange-cloudfoundry/promfetcher/migrations"
+	"github.com/orange-cloudfoundry/promfetcher/models"
+	"github.com/orange-cloudfoundry/promfetcher/stores"
+)
+
+var instanceGUID = "a758f25d-2d01-419e-b63b-de3aabcd9e15"
+var appGUID = "d245c244-1875-a718-1248-2547e141a45c"
+
+func behavesLikeEndpointStore(newStore func() stores.EndpointStore) {
+	var store stores.EndpointStore
+
+	BeforeEach(func() {
+		store = newStore()
+		for _, appEndpoint := range []models.AppEndpoint{
+			{GUID: "binding-1", AppGUID: appGUID, InstanceGUID: instanceGUID, Endpoint: "/metrics"},
+			{GUID: "binding-2", AppGUID: appGUID, InstanceGUID: instanceGUID, Endpoint: "/actuator/prometheus", Inherited: true},
+			{GUID: "binding-3", AppGUID: "e245c244-1875-a718-1248-2547e141a45c", Endpoint: "/metrics"},
+		} {
+			Expect(store.CreateAppEndpoint(appEndpoint)).To(Succeed())
+		}
+		Expect(store.SaveServiceInstance(models.ServiceInstance{
+			GUID:       instanceGUID,
+			PlanID:     "plan",
+			Parameters: `{"endpoint":"/actuator/prometheus"}`,
+		})).To(Succeed())
+	})
+
+	It("gives app endpoints ordered by endpoint", func() {
+		appEndpoints, err := store.AppEndpoints()
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(appEndpoints).To(HaveLen(3))
+		Expect(appEndpoints[0].Endpoint).To(Equal("/actuator/prometheus"))
+
+		appEndpoints, err = store.AppEndpointsByApp(appGUID)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(appEndpoints.Paths("/metrics")).To(Equal([]string{"/actuator/prometheus", "/metrics"}))
+	})
+
+	It("gives an app endpoint by binding", func() {
+		appEndpoint, err := store.AppEndpoint("binding-2")
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(appEndpoint.Inherited).To(BeTrue())
+
+		_, err = store.AppEndpoint("unknown")
+		Expect(err).To(MatchError(stores.ErrNotFound))
+	})
+
+	It("deletes app endpoints", func() {
+		Expect(store.DeleteAppEndpoint("binding-3")).To(Succeed())
+		_, err := store.AppEndpoint("binding-3")
+		Expect(err).To(MatchError(stores.ErrNotFound))
+
+		Expect(store.DeleteInstanceAppEndpoints(instanceGUID)).To(Succeed())
+		appEndpoints, err := store.AppEndpoints()
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(appEndpoints).To(BeEmpty())
+	})
+
+	It("updates app endpoints of an instance", func() {
+		Expect(store.UpdateInstanceAppEndpoints(instanceGUID, "/prometheus", true)).To(Succeed())
+
+		appEndpoints, err := store.AppEndpointsByApp(appGUID)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(appEndpoints.Paths("/metrics")).To(Equal([]string{"/metrics", "/prometheus"}))
+		Expect(appEndpoints[0].SystemMetrics).To(BeTrue())
+		Expect(appEndpoints[1].SystemMetrics).To(BeTrue())
+
+		appEndpoint, err := store.AppEndpoint("binding-3")
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(appEndpoint.SystemMetrics).To(BeFalse())
+	})
+
+	It("manages service instances", func() {
+		instance, err := store.ServiceInstance(instanceGUID)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(instance.PlanID).To(Equal("plan"))
+
+		instance.PlanID = "other-plan"
+		Expect(store.SaveServiceInstance(instance)).To(Succeed())
+		instance, err = store.ServiceInstance(instanceGUID)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(instance.PlanID).To(Equal("other-plan"))
+
+		Expect(store.DeleteServiceInstance(instanceGUID)).To(Succeed())
+		_, err = store.ServiceInstance(instanceGUID)
+		Expect(err).To(MatchError(stores.ErrNotFound))
+		Expect(store.DeleteServiceInstance(instanceGUID)).To(MatchError(stores.ErrNotFound))
+	})
+}
+
+var _ = Describe("GormStore", func() {
+	var db *gorm.DB
+
+	AfterEach(func() {
+		Expect(db.Close()).To(Succeed())
+	})
+
+	behavesLikeEndpointStore(func() stores.EndpointStore {
+		var err error
+		db, err = gorm.Open("sqlite3", "file::memory:?cache=shared")
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(migrations.Up(db)).To(Succeed())
+		return stores.NewGormStore(db)
+	})
+})
+
+var _ = Describe("MemoryStore", func() {
+	behavesLikeEndpointStore(func() stores.EndpointStore {
+		return stores.NewMemoryStore()
+	})
+})
+
+var _ = Describe("FileStore", func() {
+	var path string
+
+	behavesLikeEndpointStore(func() stores.EndpointStore {
+		path = filepath.Join(GinkgoT().TempDir(), "store.json")
+		store, err := stores.NewFileStore(path)
+		Expect(err).ShouldNot(HaveOccurred())
+		return store
+	})
+
+	It("reloads everything from file", func() {
+		store, err := stores.NewFileStore(path)
+		Expect(err).ShouldNot(HaveOccurred())
+
+		appEndpoints, err := store.AppEndpoints()
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(appEndpoints).To(HaveLen(3))
+		_, err = store.ServiceInstance(instanceGUID)
+		Expect(err).ShouldNot(HaveOccurred())
+	})
+
+	It("keeps memory unchanged when file can't be written", func() {
+		store, err := stores.NewFileStore(path)
+		Expect(err).ShouldNot(HaveOccurred())
+		// store file can't be replaced by a directory
+		Expect(os.Remove(path)).To(Succeed())
+		Expect(os.Mkdir(path, 0700)).To(Succeed())
+
+		Expect(store.CreateAppEndpoint(models.AppEndpoint{GUID: "binding-4", AppGUID: appGUID})).ToNot(Succeed())
+		Expect(store.DeleteServiceInstance(instanceGUID)).ToNot(Succeed())
+		Expect(store.UpdateInstanceAppEndpoints(instanceGUID, "/prometheus", true)).ToNot(Succeed())
+
+		appEndpoints, err := store.AppEndpoints()
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(appEndpoints).To(HaveLen(3))
+		Expect(appEndpoints.Paths("/metrics")).To(Equal([]string{"/actuator/prometheus", "/metrics"}))
+		_, err = store.ServiceInstance(instanceGUID)
+		Expect(err).ShouldNot(HaveOccurred())
+	})
+
+	It("fails on invalid file", func() {
+		Expect(os.WriteFile(path, []byte("{"), 0600)).To(Succeed())
+		_, err := stores.NewFileStore(path)
+		Expect(err).To(HaveOccurred())
+	})
+})